@@ -0,0 +1,281 @@
+package filesyncer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveFormat is a kind of archive an ArchiveStore can read and write
+type ArchiveFormat string
+
+const (
+	ArchiveTar   ArchiveFormat = "tar"
+	ArchiveTarGz ArchiveFormat = "tar.gz"
+	ArchiveZip   ArchiveFormat = "zip"
+)
+
+// Returns the archive format for a file name going by its extension
+func ArchiveFormatOf(name string) (ArchiveFormat, bool) {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return ArchiveTarGz, true
+	case strings.HasSuffix(lower, ".tar"):
+		return ArchiveTar, true
+	case strings.HasSuffix(lower, ".zip"):
+		return ArchiveZip, true
+	default:
+		return "", false
+	}
+}
+
+var ErrReadOnlyStore = errors.New("Store is read only")
+
+// ArchiveStore is a Store backed by a tar or zip archive with its files held
+// in memory. Opened read only it is a source for main. Opened for writing
+// changes stay in memory until Commit writes a new archive in one go, so the
+// archive on disk is always a complete snapshot.
+type ArchiveStore struct {
+	files    *MemStore
+	path     string
+	format   ArchiveFormat
+	writable bool
+}
+
+// Opens an existing archive to sync from
+func OpenArchive(name string) (*ArchiveStore, error) {
+	return openArchive(name, false)
+}
+
+// Opens an archive to sync into. It need not exist yet.
+func OpenArchiveForWrite(name string) (*ArchiveStore, error) {
+	return openArchive(name, true)
+}
+
+func openArchive(name string, writable bool) (*ArchiveStore, error) {
+	format, ok := ArchiveFormatOf(name)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a .tar, .tar.gz, .tgz or .zip archive", name)
+	}
+	a := &ArchiveStore{files: NewMemStore(), path: name, format: format, writable: writable}
+
+	var err error
+	if format == ArchiveZip {
+		err = a.readZip()
+	} else {
+		err = a.readTar()
+	}
+	if writable && errors.Is(err, fs.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive %s: %w", name, err)
+	}
+	return a, nil
+}
+
+// Adds a file from the archive, refusing names that would escape it
+func (a *ArchiveStore) add(name string, data []byte, modTime time.Time) error {
+	name = path.Clean(strings.TrimPrefix(name, "./"))
+	if err := ValidateFileName(name); err != nil {
+		return err
+	}
+	a.files.files[name] = memFile{data: data, modTime: modTime}
+	return nil
+}
+
+func (a *ArchiveStore) readTar() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if a.format == ArchiveTarGz {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err := a.add(header.Name, data, header.ModTime); err != nil {
+			return err
+		}
+	}
+}
+
+func (a *ArchiveStore) readZip() error {
+	zr, err := zip.OpenReader(a.path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, entry := range zr.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if err := a.add(entry.Name, data, entry.Modified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *ArchiveStore) List() ([]FileInfo, error) {
+	return a.files.List()
+}
+
+func (a *ArchiveStore) Stat(name string) (FileInfo, error) {
+	return a.files.Stat(name)
+}
+
+func (a *ArchiveStore) Open(name string) (io.ReadCloser, error) {
+	return a.files.Open(name)
+}
+
+func (a *ArchiveStore) Create(name string) (FileWriter, error) {
+	if !a.writable {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: ErrReadOnlyStore}
+	}
+	return a.files.Create(name)
+}
+
+func (a *ArchiveStore) Rename(from string, to string) error {
+	if !a.writable {
+		return &fs.PathError{Op: "rename", Path: from, Err: ErrReadOnlyStore}
+	}
+	return a.files.Rename(from, to)
+}
+
+func (a *ArchiveStore) Remove(name string) error {
+	if !a.writable {
+		return &fs.PathError{Op: "remove", Path: name, Err: ErrReadOnlyStore}
+	}
+	return a.files.Remove(name)
+}
+
+// Writes the files as a new archive next to the old one and renames it into
+// place. Entries are sorted by name so the same files give the same archive.
+func (a *ArchiveStore) Commit() error {
+	if !a.writable {
+		return ErrReadOnlyStore
+	}
+	a.files.mu.Lock()
+	names := make([]string, 0, len(a.files.files))
+	for name := range a.files.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	var err error
+	if a.format == ArchiveZip {
+		err = a.writeZip(&buf, names)
+	} else {
+		err = a.writeTar(&buf, names)
+	}
+	a.files.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to build archive %s: %w", a.path, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), "."+filepath.Base(a.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), a.path)
+}
+
+// Must be called with a.files.mu held
+func (a *ArchiveStore) writeTar(w io.Writer, names []string) error {
+	var gz *gzip.Writer
+	if a.format == ArchiveTarGz {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		f := a.files.files[name]
+		header := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(f.data)), ModTime: f.modTime}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+// Must be called with a.files.mu held
+func (a *ArchiveStore) writeZip(w io.Writer, names []string) error {
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		f := a.files.files[name]
+		entry, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: f.modTime})
+		if err != nil {
+			return err
+		}
+		if _, err := entry.Write(f.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
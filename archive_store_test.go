@@ -0,0 +1,63 @@
+package filesyncer
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveStoreRoundTrip(t *testing.T) {
+	for _, name := range []string{"docs.tar", "docs.tar.gz", "docs.zip"} {
+		t.Run(name, func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), name)
+
+			// Sync a directory into a new archive
+			mainDir := t.TempDir()
+			writeTestFiles(t, mainDir, map[string]string{"a.md": "# A\n", "api/b.md": "# B\n"})
+			mainFC, err := CreateFileCache(mainDir)
+			assert.NoError(t, err)
+			sink, err := OpenArchiveForWrite(archivePath)
+			assert.NoError(t, err)
+			replicaFC, err := CreateFileCacheFromStore(sink, FileCacheOptions{})
+			assert.NoError(t, err)
+			runTestSync(t, &Syncer{FileCache: mainFC}, &Syncer{Replica: true, FileCache: replicaFC})
+			assert.NoError(t, sink.Commit())
+
+			// Then sync from the archive out to a directory
+			source, err := OpenArchive(archivePath)
+			assert.NoError(t, err)
+			sourceFC, err := CreateFileCacheFromStore(source, FileCacheOptions{})
+			assert.NoError(t, err)
+			outDir := t.TempDir()
+			writeTestFiles(t, outDir, map[string]string{"extra.md": "# Extra\n"})
+			outFC, err := CreateFileCache(outDir)
+			assert.NoError(t, err)
+			_, report := runTestSync(t, &Syncer{FileCache: sourceFC}, &Syncer{Replica: true, FileCache: outFC})
+			assert.Equal(t, map[string]FileAction{"a.md": ActionReceived, "api/b.md": ActionReceived, "extra.md": ActionDeleted}, reportActions(report))
+
+			data, err := os.ReadFile(filepath.Join(outDir, "api", "b.md"))
+			assert.NoError(t, err)
+			assert.Equal(t, "# B\n", string(data))
+
+			_, err = source.Create("c.md")
+			assert.ErrorIs(t, err, ErrReadOnlyStore)
+		})
+	}
+}
+
+func TestArchiveRejectsEscapingNames(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "evil.tar")
+	f, err := os.Create(archivePath)
+	assert.NoError(t, err)
+	tw := tar.NewWriter(f)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "../evil.md", Mode: 0644, Size: 1}))
+	tw.Write([]byte("x"))
+	tw.Close()
+	f.Close()
+
+	_, err = OpenArchive(archivePath)
+	assert.ErrorIs(t, err, ErrInvalidPath)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the YAML config file. Each profile maps flag names to values, so
+// anything that can be set with a flag can be set in a profile:
+//
+//	profiles:
+//	  notes:
+//	    directory: ~/notes
+//	    addr: notes.example.com:8080
+//	    api-key-file: ~/.config/file-syncer/notes.key
+//	    idle-timeout: 5m
+type Config struct {
+	Profiles map[string]map[string]any `yaml:"profiles"`
+}
+
+// Flags that pick the config file and profile. Registered on every command
+// that reads a profile.
+type ConfigArgs struct {
+	path    string
+	profile string
+	// Profile settings for flags other commands have, warned about once
+	// logging is set up
+	ignored []string
+}
+
+func (c *ConfigArgs) Register(fs *flag.FlagSet) {
+	fs.StringVar(&c.path, "config", defaultConfigPath(), "Path to the YAML config file")
+	fs.StringVar(&c.profile, "profile", "", "Name of the profile in the config file to take settings from")
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "file-syncer", "config.yaml")
+}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// Where the value of a flag came from
+type settingSource int
+
+const (
+	sourceDefault settingSource = iota
+	sourceProfile
+	sourceEnv
+	sourceFlag
+)
+
+// Fills in every flag that was not given on the command line, first from a
+// FILE_SYNCER_FLAG_<FLAG_NAME> environment variable and then from the
+// selected profile. Returns where each flag's value came from. Profile
+// settings that aren't a flag of any command are rejected so typos aren't
+// silently ignored.
+func (c *ConfigArgs) Apply(fs *flag.FlagSet) (map[string]settingSource, error) {
+	sources := map[string]settingSource{}
+	fs.Visit(func(f *flag.Flag) { sources[f.Name] = sourceFlag })
+
+	// The config file and profile can come from the environment too
+	for _, name := range []string{"config", "profile"} {
+		if sources[name] == sourceFlag {
+			continue
+		}
+		if value, ok := os.LookupEnv(envName(name)); ok {
+			if err := fs.Set(name, value); err != nil {
+				return nil, err
+			}
+			sources[name] = sourceEnv
+		}
+	}
+
+	var profile map[string]any
+	if c.profile != "" {
+		config, err := loadConfig(c.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load profile %q: %w", c.profile, err)
+		}
+		var ok bool
+		profile, ok = config.Profiles[c.profile]
+		if !ok {
+			return nil, fmt.Errorf("no profile %q in %s", c.profile, c.path)
+		}
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, set := sources[f.Name]; set {
+			return
+		}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			errs = append(errs, setFlag(fs, f.Name, value, "environment"))
+			sources[f.Name] = sourceEnv
+			return
+		}
+		if raw, ok := profile[f.Name]; ok {
+			value, err := profileValue(raw)
+			if err == nil {
+				err = setFlag(fs, f.Name, expandHome(value), "profile "+c.profile)
+			}
+			errs = append(errs, err)
+			sources[f.Name] = sourceProfile
+		}
+	})
+	c.ignored = nil
+	for key := range profile {
+		switch {
+		case fs.Lookup(key) != nil:
+		case isCommandFlag(key):
+			c.ignored = append(c.ignored, key)
+		default:
+			errs = append(errs, fmt.Errorf("unknown setting %q in profile %q of %s", key, c.profile, c.path))
+		}
+	}
+	sort.Strings(c.ignored)
+	return sources, errors.Join(errs...)
+}
+
+// Warns about the profile settings this command ignored. Called once logging
+// is set up as Apply runs before it.
+func (c *ConfigArgs) warnIgnored() {
+	for _, key := range c.ignored {
+		slog.Warn("Profile setting does not apply to this command", "profile", c.profile, "setting", key)
+	}
+}
+
+func setFlag(fs *flag.FlagSet, name string, value string, from string) error {
+	if err := fs.Set(name, value); err != nil {
+		return fmt.Errorf("invalid value %q for %s from %s: %w", value, name, from, err)
+	}
+	return nil
+}
+
+// Prefix of the environment variables that set flags. Kept apart from the
+// FILE_SYNCER_* variables hooks are given, so file-syncer run from a hook
+// doesn't pick up the directory and the like of the sync that ran it.
+const flagEnvPrefix = "FILE_SYNCER_FLAG_"
+
+// flagEnvPrefix plus the flag name in upper snake case
+func envName(flagName string) string {
+	return flagEnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Turns a YAML scalar or list of scalars into a flag value. Lists are comma
+// joined.
+func profileValue(raw any) (string, error) {
+	switch v := raw.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			part, err := profileValue(item)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, part)
+		}
+		return strings.Join(parts, ","), nil
+	case map[string]any:
+		return "", errors.New("profile values cannot be maps")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+func expandHome(value string) string {
+	if !strings.HasPrefix(value, "~/") {
+		return value
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return value
+	}
+	return filepath.Join(home, value[2:])
+}
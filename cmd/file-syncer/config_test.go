@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `profiles:
+  notes:
+    idle-timeout: 5m
+    addr: notes.example.com:8080
+    conflicts: [docs=merge, drafts=keep-both]
+    window: 8
+  other:
+    idle-timeout: 7m
+  typo:
+    directroy: elsewhere
+`
+
+// Parses args for a push style command with the environment set to env
+func parseTestArgs(t *testing.T, args []string, env map[string]string) (CmdArgs, error) {
+	t.Helper()
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	cmdArgs := CmdArgs{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cmdArgs.Register(fs)
+	cmdArgs.RegisterReplica(fs)
+	err := cmdArgs.Parse(fs, args, "replica")
+	return cmdArgs, err
+}
+
+func writeTestConfig(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(testConfig), 0600))
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	config := writeTestConfig(t)
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		timeout time.Duration
+		source  settingSource
+	}{
+		{name: "default", args: nil, timeout: 2 * time.Minute, source: sourceDefault},
+		{name: "profile", args: []string{"-config", config, "-profile", "notes"}, timeout: 5 * time.Minute, source: sourceProfile},
+		{name: "env beats profile", args: []string{"-config", config, "-profile", "notes"}, env: map[string]string{"FILE_SYNCER_FLAG_IDLE_TIMEOUT": "6m"}, timeout: 6 * time.Minute, source: sourceEnv},
+		{name: "flag beats env", args: []string{"-config", config, "-profile", "notes", "-idle-timeout", "1m"}, env: map[string]string{"FILE_SYNCER_FLAG_IDLE_TIMEOUT": "6m"}, timeout: time.Minute, source: sourceFlag},
+		{name: "profile from env", args: []string{"-config", config}, env: map[string]string{"FILE_SYNCER_FLAG_PROFILE": "other"}, timeout: 7 * time.Minute, source: sourceProfile},
+		{name: "flag beats profile from env", args: []string{"-config", config, "-profile", "notes"}, env: map[string]string{"FILE_SYNCER_FLAG_PROFILE": "other"}, timeout: 5 * time.Minute, source: sourceProfile},
+		{name: "config from env", args: []string{"-profile", "other"}, env: map[string]string{"FILE_SYNCER_FLAG_CONFIG": config}, timeout: 7 * time.Minute, source: sourceProfile},
+		// Hooks are given FILE_SYNCER_DIRECTORY and the like, which must
+		// not be read back as flags
+		{name: "hook variables", args: nil, env: map[string]string{"FILE_SYNCER_IDLE_TIMEOUT": "6m", "FILE_SYNCER_DIRECTORY": "elsewhere"}, timeout: 2 * time.Minute, source: sourceDefault},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmdArgs, err := parseTestArgs(t, tt.args, tt.env)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.timeout, cmdArgs.idleTimeout)
+			assert.Equal(t, tt.source, cmdArgs.sources["idle-timeout"])
+			assert.Equal(t, "test_data", cmdArgs.directory)
+		})
+	}
+}
+
+func TestConfigProfileValues(t *testing.T) {
+	cmdArgs, err := parseTestArgs(t, []string{"-config", writeTestConfig(t), "-profile", "notes"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "notes.example.com:8080", cmdArgs.addr)
+	assert.Equal(t, "docs=merge,drafts=keep-both", cmdArgs.conflicts)
+	// Only push style commands that run as main take -window
+	assert.Equal(t, []string{"window"}, cmdArgs.config.ignored)
+}
+
+func TestConfigErrors(t *testing.T) {
+	config := writeTestConfig(t)
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{name: "missing profile", args: []string{"-config", config, "-profile", "nope"}},
+		{name: "missing config", args: []string{"-config", filepath.Join(t.TempDir(), "none.yaml"), "-profile", "notes"}},
+		{name: "bad env value", env: map[string]string{"FILE_SYNCER_FLAG_IDLE_TIMEOUT": "soon"}},
+		{name: "unknown setting", args: []string{"-config", config, "-profile", "typo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTestArgs(t, tt.args, tt.env)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLoadAPIKey(t *testing.T) {
+	dir := t.TempDir()
+	flagKey, envKey, emptyKey := filepath.Join(dir, "flag.key"), filepath.Join(dir, "env.key"), filepath.Join(dir, "empty.key")
+	assert.NoError(t, os.WriteFile(flagKey, []byte("from-flag-file\n"), 0600))
+	assert.NoError(t, os.WriteFile(envKey, []byte("from-env-file"), 0600))
+	assert.NoError(t, os.WriteFile(emptyKey, []byte("\n"), 0600))
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		want    string
+		wantErr bool
+	}{
+		{name: "flag file beats env key", args: []string{"-api-key-file", flagKey}, env: map[string]string{"FILE_SYNCER_API_KEY": "from-env"}, want: "from-flag-file"},
+		{name: "env key beats env file", env: map[string]string{"FILE_SYNCER_API_KEY": "from-env", "FILE_SYNCER_FLAG_API_KEY_FILE": envKey}, want: "from-env"},
+		{name: "env file", env: map[string]string{"FILE_SYNCER_FLAG_API_KEY_FILE": envKey}, want: "from-env-file"},
+		{name: "empty file", args: []string{"-api-key-file", emptyKey}, wantErr: true},
+		{name: "missing file", args: []string{"-api-key-file", filepath.Join(dir, "none.key")}, wantErr: true},
+		{name: "nothing", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Whatever the test process was started with doesn't count
+			t.Setenv("FILE_SYNCER_API_KEY", "")
+			cmdArgs, err := parseTestArgs(t, tt.args, tt.env)
+			assert.NoError(t, err)
+			key, err := cmdArgs.loadAPIKey()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, key)
+		})
+	}
+}
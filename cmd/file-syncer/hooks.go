@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	"github.com/isichei/file-syncer"
+)
+
+// Hooks are shell commands run at fixed points of a sync. Details of the
+// sync are passed in FILE_SYNCER_* environment variables.
+type Hooks struct {
+	PreScan     string
+	PreApply    string
+	PostFile    string
+	PostSession string
+
+	role      string
+	directory string
+}
+
+func (h *Hooks) RegisterMain(fs *flag.FlagSet) {
+	fs.StringVar(&h.PreScan, "hook-pre-scan", "", "Command run before the directory is scanned, a non-zero exit aborts the sync")
+	fs.StringVar(&h.PostSession, "hook-post-session", "", "Command run after the sync finishes")
+}
+
+func (h *Hooks) RegisterReplica(fs *flag.FlagSet) {
+	fs.StringVar(&h.PreApply, "hook-pre-apply", "", "Command run before changes are applied, a non-zero exit aborts the sync")
+	fs.StringVar(&h.PostFile, "hook-post-file", "", "Command run after each file is written")
+	fs.StringVar(&h.PostSession, "hook-post-session", "", "Command run after each sync finishes")
+}
+
+// Runs the hook command through the shell in the sync directory
+func (h *Hooks) run(stage string, command string, env ...string) error {
+	if command == "" {
+		return nil
+	}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = h.directory
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"FILE_SYNCER_HOOK="+stage,
+		"FILE_SYNCER_ROLE="+h.role,
+		"FILE_SYNCER_DIRECTORY="+h.directory,
+	)
+	cmd.Env = append(cmd.Env, env...)
+
+	slog.Debug("Running hook", "stage", stage, "command", command)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook %q failed: %w", stage, command, err)
+	}
+	return nil
+}
+
+func (h *Hooks) RunPreScan() error {
+	return h.run("pre-scan", h.PreScan)
+}
+
+func (h *Hooks) RunPreApply() error {
+	return h.run("pre-apply", h.PreApply)
+}
+
+func (h *Hooks) RunPostFile(path string, size int64) {
+	err := h.run("post-file", h.PostFile,
+		"FILE_SYNCER_FILE="+path,
+		"FILE_SYNCER_FILE_SIZE="+strconv.FormatInt(size, 10),
+	)
+	if err != nil {
+		slog.Warn("Hook failed", "error", err)
+	}
+}
+
+// Runs the post session hook with counts from the report and the list of
+// changed files written to a temp file
+func (h *Hooks) RunPostSession(report *filesyncer.SyncReport, syncErr error) {
+	if h.PostSession == "" {
+		return
+	}
+
+	var changed []string
+	if report != nil {
+		for _, fr := range report.Files {
+			switch fr.Action {
+			case filesyncer.ActionUnchanged, filesyncer.ActionKept, filesyncer.ActionSkipped, filesyncer.ActionFailed:
+			default:
+				changed = append(changed, fr.Path)
+			}
+		}
+	}
+	changedFile, err := os.CreateTemp("", "file-syncer-changed-*.txt")
+	if err != nil {
+		slog.Warn("Could not create changed file list for hook", "error", err)
+		return
+	}
+	defer os.Remove(changedFile.Name())
+	for _, path := range changed {
+		if _, err = fmt.Fprintln(changedFile, path); err != nil {
+			break
+		}
+	}
+	if err = errors.Join(err, changedFile.Close()); err != nil {
+		slog.Warn("Could not write changed file list for hook", "error", err)
+		return
+	}
+
+	exitStatus, errText := "0", ""
+	if syncErr != nil {
+		exitStatus, errText = "1", syncErr.Error()
+	}
+	env := []string{
+		"FILE_SYNCER_CHANGED_FILES=" + changedFile.Name(),
+		"FILE_SYNCER_FILES_CHANGED=" + strconv.Itoa(len(changed)),
+		"FILE_SYNCER_EXIT_STATUS=" + exitStatus,
+		"FILE_SYNCER_ERROR=" + errText,
+	}
+	if report != nil {
+		env = append(env,
+			"FILE_SYNCER_FILES_UNCHANGED="+strconv.Itoa(report.Count(filesyncer.ActionUnchanged)),
+			"FILE_SYNCER_FILES_DELETED="+strconv.Itoa(report.Count(filesyncer.ActionDeleted)),
+			"FILE_SYNCER_FILES_FAILED="+strconv.Itoa(report.Count(filesyncer.ActionFailed)),
+			"FILE_SYNCER_BYTES="+strconv.FormatInt(report.Bytes(), 10),
+		)
+	}
+	if err := h.run("post-session", h.PostSession, env...); err != nil {
+		slog.Warn("Hook failed", "error", err)
+	}
+}
+
+// Runs the post file hook as the replica writes files. The hooks run one at a
+// time off the session's goroutine, so a slow hook doesn't stall the session
+// into its idle timeout, and all have finished once the session ends.
+type hookObserver struct {
+	filesyncer.NopObserver
+	hooks *Hooks
+
+	mu      sync.Mutex
+	queue   []writtenFile
+	running bool
+	wg      sync.WaitGroup
+}
+
+type writtenFile struct {
+	path string
+	size int64
+}
+
+func (o *hookObserver) FileWritten(path string, size int64) {
+	if o.hooks.PostFile == "" {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.queue = append(o.queue, writtenFile{path: path, size: size})
+	if !o.running {
+		o.running = true
+		o.wg.Add(1)
+		go o.runPostFileHooks()
+	}
+}
+
+func (o *hookObserver) runPostFileHooks() {
+	defer o.wg.Done()
+	for {
+		o.mu.Lock()
+		if len(o.queue) == 0 {
+			o.running = false
+			o.mu.Unlock()
+			return
+		}
+		file := o.queue[0]
+		o.queue = o.queue[1:]
+		o.mu.Unlock()
+		o.hooks.RunPostFile(file.path, file.size)
+	}
+}
+
+func (o *hookObserver) SessionEnded(report *filesyncer.SyncReport, err error) {
+	o.wg.Wait()
+}
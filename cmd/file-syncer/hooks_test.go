@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isichei/file-syncer"
+	"github.com/stretchr/testify/assert"
+)
+
+// Hook command that appends the FILE_SYNCER_* environment it was given to out,
+// then runs then
+func envHook(out string, then string) string {
+	return "env | grep '^FILE_SYNCER_' | sort >> " + out + "; echo --- >> " + out + "; " + then
+}
+
+// Reads back what envHook wrote, one map of variables per run
+func readHookRuns(t *testing.T, out string) []map[string]string {
+	t.Helper()
+	data, err := os.ReadFile(out)
+	assert.NoError(t, err)
+	var runs []map[string]string
+	run := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "---" {
+			runs = append(runs, run)
+			run = map[string]string{}
+			continue
+		}
+		name, value, _ := strings.Cut(line, "=")
+		run[name] = value
+	}
+	return runs
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func TestHookEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(t.TempDir(), "env")
+	hooks := Hooks{PreScan: envHook(out, "true"), PostFile: envHook(out, "true"), role: "main", directory: dir}
+
+	assert.NoError(t, hooks.RunPreScan())
+	hooks.RunPostFile("docs/a.md", 42)
+	runs := readHookRuns(t, out)
+	want := []map[string]string{
+		{"FILE_SYNCER_HOOK": "pre-scan", "FILE_SYNCER_ROLE": "main", "FILE_SYNCER_DIRECTORY": dir},
+		{
+			"FILE_SYNCER_HOOK":      "post-file",
+			"FILE_SYNCER_ROLE":      "main",
+			"FILE_SYNCER_DIRECTORY": dir,
+			"FILE_SYNCER_FILE":      "docs/a.md",
+			"FILE_SYNCER_FILE_SIZE": "42",
+		},
+	}
+	if assert.Len(t, runs, len(want)) {
+		for i, vars := range want {
+			for name, value := range vars {
+				assert.Equal(t, value, runs[i][name], name)
+			}
+		}
+	}
+}
+
+func TestHookPreStagesAbort(t *testing.T) {
+	hooks := Hooks{PreScan: "exit 3", PreApply: "exit 4", directory: t.TempDir()}
+	assert.ErrorContains(t, hooks.RunPreScan(), "pre-scan hook")
+	assert.ErrorContains(t, hooks.RunPreApply(), "pre-apply hook")
+
+	// Hooks run in the sync directory
+	out := filepath.Join(hooks.directory, "ran")
+	hooks.PreScan = "touch ran"
+	assert.NoError(t, hooks.RunPreScan())
+	assert.FileExists(t, out)
+}
+
+func TestHookPostSession(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(t.TempDir(), "env")
+	changed := filepath.Join(t.TempDir(), "changed")
+	hooks := Hooks{PostSession: envHook(out, `cp "$FILE_SYNCER_CHANGED_FILES" `+changed), role: "replica", directory: dir}
+
+	report := &filesyncer.SyncReport{Files: []filesyncer.FileReport{
+		{Path: "same.md", Action: filesyncer.ActionUnchanged},
+		{Path: "new.md", Action: filesyncer.ActionReceived, Bytes: 10},
+		{Path: "gone.md", Action: filesyncer.ActionDeleted},
+		{Path: "broken.md", Action: filesyncer.ActionFailed},
+		{Path: "renamed.md", Action: filesyncer.ActionReused},
+	}}
+	hooks.RunPostSession(report, filesyncer.ErrFilesFailed)
+
+	runs := readHookRuns(t, out)
+	if assert.Len(t, runs, 1) {
+		env := runs[0]
+		assert.Equal(t, "post-session", env["FILE_SYNCER_HOOK"])
+		assert.Equal(t, "3", env["FILE_SYNCER_FILES_CHANGED"])
+		assert.Equal(t, "1", env["FILE_SYNCER_FILES_UNCHANGED"])
+		assert.Equal(t, "1", env["FILE_SYNCER_FILES_DELETED"])
+		assert.Equal(t, "1", env["FILE_SYNCER_FILES_FAILED"])
+		assert.Equal(t, "10", env["FILE_SYNCER_BYTES"])
+		assert.Equal(t, "1", env["FILE_SYNCER_EXIT_STATUS"])
+		assert.Equal(t, filesyncer.ErrFilesFailed.Error(), env["FILE_SYNCER_ERROR"])
+		assert.NoFileExists(t, env["FILE_SYNCER_CHANGED_FILES"], "The list is removed once the hook is done")
+	}
+	data, err := os.ReadFile(changed)
+	assert.NoError(t, err)
+	assert.Equal(t, "new.md\ngone.md\nrenamed.md\n", string(data))
+}
+
+// Parses serve's flags for a replica of dir with the given hook flags
+func serveTestArgs(t *testing.T, dir string, hookArgs ...string) CmdArgs {
+	t.Helper()
+	fs, a := serveFlags()
+	args := append([]string{"-directory", dir, "-idle-timeout", "5s"}, hookArgs...)
+	assert.NoError(t, a.cmdArgs.Parse(fs, args, "replica"))
+	return a.cmdArgs
+}
+
+// Runs a push of mainDir against serveSession, returning main's and the
+// replica's errors
+func runServeSession(t *testing.T, mainDir string, cmdArgs CmdArgs) (error, error) {
+	t.Helper()
+	mainFC, err := filesyncer.CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	mainConn, replicaConn := net.Pipe()
+	client := &filesyncer.ClientKey{ID: "test", Permissions: []filesyncer.Permission{filesyncer.PermissionPush}, Enabled: true}
+
+	replicaErr := make(chan error, 1)
+	go func() {
+		replicaErr <- serveSession(replicaConn, client, cmdArgs, nil, nil)
+	}()
+	_, mainErr := (&filesyncer.Syncer{Conn: mainConn, FileCache: mainFC, IdleTimeout: 5 * time.Second}).Run()
+	return mainErr, <-replicaErr
+}
+
+func TestServePreApplyHookRefusesSession(t *testing.T) {
+	mainDir, replicaDir := t.TempDir(), t.TempDir()
+	writeFiles(t, mainDir, map[string]string{"a.md": "# A\n"})
+	postSession := filepath.Join(t.TempDir(), "post-session")
+	cmdArgs := serveTestArgs(t, replicaDir, "-hook-pre-apply", "exit 1", "-hook-post-session", "touch "+postSession)
+
+	mainErr, replicaErr := runServeSession(t, mainDir, cmdArgs)
+	assert.Error(t, replicaErr)
+	var pe *filesyncer.ProtocolError
+	if assert.ErrorAs(t, mainErr, &pe) {
+		assert.Equal(t, filesyncer.ErrCodeInternal, pe.Code)
+		assert.Contains(t, pe.Text, "pre-apply hook")
+	}
+	assert.NoFileExists(t, filepath.Join(replicaDir, "a.md"), "Nothing is applied")
+	assert.NoFileExists(t, postSession, "A refused session has no post-session hook")
+}
+
+// Post-file hooks run off the session but all of them finish before the
+// post-session hook
+func TestServePostFileHooksFinishBeforePostSession(t *testing.T) {
+	mainDir, replicaDir := t.TempDir(), t.TempDir()
+	files := map[string]string{}
+	for _, name := range []string{"a.md", "b.md", "c.md", "docs/d.md", "docs/e.md"} {
+		files[name] = "# " + name + "\n"
+	}
+	writeFiles(t, mainDir, files)
+	log := filepath.Join(t.TempDir(), "log")
+	cmdArgs := serveTestArgs(t, replicaDir,
+		"-hook-post-file", `sleep 0.05; echo "file $FILE_SYNCER_FILE" >> `+log,
+		"-hook-post-session", `echo "session $FILE_SYNCER_FILES_CHANGED" >> `+log,
+	)
+
+	mainErr, replicaErr := runServeSession(t, mainDir, cmdArgs)
+	assert.NoError(t, mainErr)
+	assert.NoError(t, replicaErr)
+
+	data, err := os.ReadFile(log)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Len(t, lines, len(files)+1) {
+		var written []string
+		for _, line := range lines[:len(files)] {
+			written = append(written, strings.TrimPrefix(line, "file "))
+		}
+		assert.ElementsMatch(t, []string{"a.md", "b.md", "c.md", "docs/d.md", "docs/e.md"}, written)
+		assert.Equal(t, "session 5", lines[len(files)])
+	}
+}
@@ -1,82 +1,372 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
-	"net"
 	"os"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/isichei/file-syncer"
-	"golang.org/x/sync/errgroup"
 )
 
-type CmdArgs struct {
-	replica   bool
-	addr      string
-	directory string
-	debug     bool
-}
-
-func (c *CmdArgs) Register() {
-	flag.BoolVar(&c.replica, "replica", false, "If this is the main filesystem or replica")
-	flag.StringVar(&c.addr, "addr", ":8080", "What address should the tcp connection be on")
-	flag.StringVar(&c.directory, "directory", "test_data", "Path to the dir to sync the files to")
-	flag.BoolVar(&c.debug, "debug", false, "Enable debug logging")
-	flag.Parse()
-	
-	if c.debug {
-		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+type command struct {
+	name    string
+	summary string
+	// Creates the command's flag set without parsing anything
+	flags func() *flag.FlagSet
+	run   func(args []string) error
+}
+
+// Set in init as reading a profile checks its settings against every
+// command's flags, which would otherwise make an initialization cycle
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: "serve", summary: "Run the replica daemon, applying every authenticated push", flags: flagSetOf(serveFlags), run: runServe},
+		{name: "push", summary: "Sync the local directory to a replica", flags: flagSetOf(pushFlags), run: runPush},
+		{name: "diff", summary: "Show what a push would change without syncing", flags: flagSetOf(diffFlags), run: runDiff},
+		{name: "status", summary: "Show the last sync recorded in a directory", flags: flagSetOf(statusFlags), run: runStatus},
+		{name: "verify", summary: "Rehash both sides and check they match without transferring", flags: flagSetOf(verifyFlags), run: runVerify},
+		{name: "keygen", summary: "Generate a new API key", flags: flagSetOf(keygenFlags), run: runKeygen},
+		{name: "snapshots", summary: "List, diff, restore and prune replica snapshots", flags: flagSetOf(snapshotsFlags), run: runSnapshots},
 	}
-	slog.Debug("CmdArgs.Register", "replica", c.replica, "addr", c.addr, "directory", c.directory)
+}
+
+// Drops the settings from a command's flag set builder
+func flagSetOf[T any](build func() (*flag.FlagSet, T)) func() *flag.FlagSet {
+	return func() *flag.FlagSet {
+		fs, _ := build()
+		return fs
+	}
+}
+
+// True if name is a flag of any command
+func isCommandFlag(name string) bool {
+	for _, cmd := range commands {
+		if cmd.flags().Lookup(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Returned by commands that have already reported what went wrong and only
+// need a non-zero exit
+var errSilentExit = errors.New("exit")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: file-syncer <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'file-syncer <command> -h' for the flags of a command.\n")
 }
 
 func main() {
-	cmdArgs := CmdArgs{}
-	cmdArgs.Register()
+	if len(os.Args) < 2 || os.Args[1] == "-h" || os.Args[1] == "-help" || os.Args[1] == "help" {
+		usage()
+		os.Exit(2)
+	}
 
-	// Get API key from environment
-	apiKey := os.Getenv("FILE_SYNCER_API_KEY")
-	if apiKey == "" {
-		slog.Error("FILE_SYNCER_API_KEY environment variable is required")
-		os.Exit(1)
+	name := os.Args[1]
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		err := cmd.run(os.Args[2:])
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		if err != nil {
+			if !errors.Is(err, errSilentExit) {
+				slog.Error(fmt.Sprintf("%s failed", name), "error", err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+// Creates the flag set for a subcommand with its help text
+func newFlagSet(name string, usageLine string, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: file-syncer %s %s\n\n%s\n\nFlags:\n", name, usageLine, description)
+		fs.PrintDefaults()
 	}
+	return fs
+}
+
+// Flags shared by the commands that run a sync session
+type CmdArgs struct {
+	addr           string
+	directory      string
+	store          string
+	debug          bool
+	idleTimeout    time.Duration
+	sessionTimeout time.Duration
+	heartbeat      time.Duration
+	report         bool
+	reportJSON     string
+	apiKeyFile     string
+	bwLimit        string
+	bwBurst        string
+	bwSchedule     string
+	throttle       *filesyncer.Throttle
+	hashWorkers    int
+	window         int
+	writeWorkers   int
+	verifyRetries  int
+	dedup          bool
+	merge          bool
+	conflicts      string
+	mode           string
+	syncMode       filesyncer.SyncMode
+	paths          []string
+	hooks          Hooks
+	config         ConfigArgs
+	sources        map[string]settingSource
+	role           string
+}
 
-	var conn net.Conn
-	var fc *filesyncer.FileCache
+func (c *CmdArgs) Register(fs *flag.FlagSet) {
+	fs.StringVar(&c.addr, "addr", ":8080", "What address should the tcp connection be on")
+	fs.StringVar(&c.directory, "directory", "test_data", "Path to the dir to sync the files to, or a .tar, .tar.gz or .zip archive")
+	fs.StringVar(&c.store, "store", "", "Sync an object store such as s3://bucket/prefix?endpoint=URL instead of -directory")
+	fs.BoolVar(&c.debug, "debug", false, "Enable debug logging")
+	fs.DurationVar(&c.idleTimeout, "idle-timeout", 2*time.Minute, "End the session if the other side is silent this long (0 disables)")
+	fs.DurationVar(&c.sessionTimeout, "session-timeout", 0, "End the session if it runs longer than this (0 disables)")
+	fs.DurationVar(&c.heartbeat, "heartbeat", 30*time.Second, "How often to ping the other side to keep the connection alive (0 disables)")
+	fs.BoolVar(&c.report, "report", false, "Print a table of what happened to each file at the end of the sync")
+	fs.StringVar(&c.reportJSON, "report-json", "", "Write the sync report as JSON to this file")
+	fs.StringVar(&c.apiKeyFile, "api-key-file", "", "Read the API key from this file instead of FILE_SYNCER_API_KEY")
+	fs.StringVar(&c.bwLimit, "bwlimit", "0", "Limit writes to the connection to this many bytes per second, e.g. 1MB (0 is unlimited)")
+	fs.StringVar(&c.bwBurst, "bwburst", "0", "Bytes that may be written at once before -bwlimit applies (0 is one second's worth)")
+	fs.StringVar(&c.bwSchedule, "bwschedule", "", "Time of day limits that override -bwlimit, e.g. 09:00-18:00=1MB,18:00-09:00=0")
+	fs.IntVar(&c.hashWorkers, "hash-workers", runtime.GOMAXPROCS(0), "How many files to hash at once when scanning the directory")
+	c.config.Register(fs)
+}
 
-	g := new(errgroup.Group)
+// Flags only the commands that run as main take
+func (c *CmdArgs) RegisterMain(fs *flag.FlagSet) {
+	fs.IntVar(&c.window, "window", 16, "How many files may be checked or sent at once before earlier ones are answered")
+	fs.BoolVar(&c.merge, "merge", false, "Merge files changed on both sides since the last merge instead of overwriting the replica's changes")
+	fs.StringVar(&c.mode, "mode", "mirror", "What the push may change: mirror, additive (never delete), update-only (only existing files) or create-only (never overwrite)")
+}
+
+// Flags only the commands that run as replica take
+func (c *CmdArgs) RegisterReplica(fs *flag.FlagSet) {
+	fs.IntVar(&c.writeWorkers, "write-workers", 4, "How many received files may be written to disk at once")
+	fs.IntVar(&c.verifyRetries, "verify-retries", 2, "How many times to ask for a file again when what was written doesn't match main's md5")
+	fs.BoolVar(&c.dedup, "dedup", false, "Store each distinct file content once under .filesyncer/objects and hard link it into place")
+	fs.BoolVar(&c.merge, "merge", false, "Keep the base of every file so pushes with -merge can merge changes made on both sides")
+	fs.StringVar(&c.mode, "mode", "mirror", "The most a push may change, whatever mode it asks for: mirror, additive, update-only or create-only")
+	fs.StringVar(&c.conflicts, "conflicts", "", "Comma separated pattern=policy rules for files changed on both sides, e.g. docs/api=merge,drafts=keep-both. Policies are merge, main-wins, replica-wins, newest-mtime-wins, keep-both and abort. Implies -merge.")
+}
 
-	// Set off TCP Connection
-	g.Go(func() error {
-		var err error
-		conn, err = filesyncer.CreateTcpConnection(cmdArgs.addr, apiKey, cmdArgs.replica)
+// Parses the command line, fills in the rest from the environment and the
+// config profile, then applies flags that need work once parsing is done
+func (c *CmdArgs) Parse(fs *flag.FlagSet, args []string, role string) error {
+	if err := fs.Parse(args); err != nil {
 		return err
-	})
+	}
+	sources, err := c.config.Apply(fs)
+	if err != nil {
+		return err
+	}
+	c.sources = sources
 
-	// Set of file cache creation
-	g.Go(func() error {
-		var err error
-		fc, err = filesyncer.CreateFileCache(cmdArgs.directory)
+	throttle, err := c.buildThrottle()
+	if err != nil {
 		return err
-	})
+	}
+	c.throttle = throttle
+
+	if c.syncMode, err = filesyncer.ParseSyncMode(c.mode); err != nil {
+		return fmt.Errorf("-mode: %w", err)
+	}
+	if role == "main" {
+		if c.paths, err = filesyncer.ParseSyncPaths(fs.Args()); err != nil {
+			return err
+		}
+	}
+
+	c.role = role
+	c.hooks.role = role
+	c.hooks.directory = c.directory
+	setupLogging(c.debug)
+	c.config.warnIgnored()
+	slog.Debug("CmdArgs.Parse", "role", role, "addr", c.addr, "directory", c.directory, "profile", c.config.profile)
+	return nil
+}
 
-	if err := g.Wait(); err != nil {
-		slog.Error("Setup for TCP or File cache failed", "error", err)
-		os.Exit(1)
+// How often a progress line is logged while hashing a large directory
+const hashProgressEvery = 1000
+
+// True when the command syncs a plain directory rather than an object store
+// or an archive
+func (c *CmdArgs) localDirectory() bool {
+	_, archive := filesyncer.ArchiveFormatOf(c.directory)
+	return c.store == "" && !archive
+}
+
+// Opens the object store or archive being synced, or returns nil for a plain
+// directory that isn't deduplicated. Archives are only written to when
+// writable is set.
+func (c *CmdArgs) openStore(writable bool) (filesyncer.Store, error) {
+	switch {
+	case c.store != "":
+		return openStore(c.store)
+	case !c.localDirectory() && writable:
+		return filesyncer.OpenArchiveForWrite(c.directory)
+	case !c.localDirectory():
+		return filesyncer.OpenArchive(c.directory)
+	case c.dedup:
+		return filesyncer.NewDedupStore(c.directory), nil
+	default:
+		return nil, nil
+	}
+}
+
+// Scans and hashes store, or the sync directory if it is nil, logging
+// progress for large trees
+func (c *CmdArgs) createFileCache(store filesyncer.Store) (*filesyncer.FileCache, error) {
+	options := filesyncer.FileCacheOptions{
+		HashWorkers: c.hashWorkers,
+		// Main reads its own symlinks wherever they lead
+		FollowSymlinks: c.role == "main",
+		Progress: func(done int, total int, filename string) {
+			if done%hashProgressEvery == 0 {
+				slog.Info("Hashing files", "done", done, "total", total)
+			}
+		},
+	}
+	if store == nil {
+		return filesyncer.CreateFileCacheWithOptions(c.directory, options)
+	}
+	return filesyncer.CreateFileCacheFromStore(store, options)
+}
+
+// Builds the bandwidth limit shared by every session, or nil when unlimited
+func (c *CmdArgs) buildThrottle() (*filesyncer.Throttle, error) {
+	rate, err := filesyncer.ParseByteRate(c.bwLimit)
+	if err != nil {
+		return nil, fmt.Errorf("-bwlimit: %w", err)
+	}
+	burst, err := filesyncer.ParseByteRate(c.bwBurst)
+	if err != nil {
+		return nil, fmt.Errorf("-bwburst: %w", err)
+	}
+	schedule, err := filesyncer.ParseSchedule(c.bwSchedule)
+	if err != nil {
+		return nil, fmt.Errorf("-bwschedule: %w", err)
+	}
+	if rate == 0 && len(schedule) == 0 {
+		return nil, nil
+	}
+	throttle := filesyncer.NewThrottle(rate, burst)
+	throttle.SetSchedule(schedule)
+	return throttle, nil
+}
+
+// Flags beat the environment which beats the profile, so an -api-key-file
+// flag wins over FILE_SYNCER_API_KEY, which wins over a key file named in
+// FILE_SYNCER_FLAG_API_KEY_FILE or the profile
+func (c *CmdArgs) loadAPIKey() (string, error) {
+	if c.sources["api-key-file"] != sourceFlag {
+		if apiKey := os.Getenv("FILE_SYNCER_API_KEY"); apiKey != "" {
+			return apiKey, nil
+		}
+	}
+	if c.apiKeyFile == "" {
+		return "", errors.New("FILE_SYNCER_API_KEY environment variable or an api-key-file is required")
+	}
+	data, err := os.ReadFile(c.apiKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read API key file: %w", err)
+	}
+	apiKey := strings.TrimSpace(string(data))
+	if apiKey == "" {
+		return "", fmt.Errorf("API key file %s is empty", c.apiKeyFile)
+	}
+	return apiKey, nil
+}
+
+func setupLogging(debug bool) {
+	if debug {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
 	}
+}
 
-	syncer := filesyncer.Syncer{Replica: cmdArgs.replica, Conn: conn, FileCache: fc}
-	var syncerName string
-	if syncer.Replica {
-		syncerName = "Replica"
+// Logs the per file errors of a session and the cause of a fatal one
+func logSyncErrors(name string, syncer *filesyncer.Syncer, err error) {
+	for _, fileErr := range syncer.FileErrors {
+		slog.Error("File failed to sync", "path", fileErr.Path, "code", string(fileErr.Code), "remote", fileErr.Remote, "error", fileErr.Text)
+	}
+	if err == nil {
+		return
+	}
+	var protoErr *filesyncer.ProtocolError
+	if errors.As(err, &protoErr) {
+		slog.Error(fmt.Sprintf("%s failed", name), "code", string(protoErr.Code), "path", protoErr.Path, "remote", protoErr.Remote, "error", protoErr.Text)
 	} else {
-		syncerName = "Main"
+		slog.Error(fmt.Sprintf("%s failed", name), "error", err)
 	}
+}
 
-	slog.Info(fmt.Sprintf("Running sender as %s", syncerName), "addr", cmdArgs.addr)
-	if err := syncer.Run(); err != nil {
-		slog.Error(fmt.Sprintf("%s failed", syncerName),  "error", err)
-		os.Exit(1)
+// Points out files left with conflict markers for someone to resolve
+func logConflicts(report *filesyncer.SyncReport) {
+	if report == nil || report.DryRun {
+		return
+	}
+	for _, fr := range report.Files {
+		if fr.Action == filesyncer.ActionConflict {
+			slog.Warn("Conflicting changes left to resolve on the replica", "path", fr.Path)
+		}
+	}
+}
+
+func writeReport(report *filesyncer.SyncReport, cmdArgs CmdArgs) error {
+	if report == nil {
+		return nil
+	}
+	if cmdArgs.report {
+		if err := report.WriteTable(os.Stdout); err != nil {
+			return err
+		}
+	}
+	if cmdArgs.reportJSON != "" {
+		f, err := os.Create(cmdArgs.reportJSON)
+		if err != nil {
+			return err
+		}
+		if err := report.WriteJSON(f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	return nil
+}
+
+// Records a finished real sync in the local directory so the status command
+// can show it
+func saveLastSync(cmdArgs CmdArgs, peer string, report *filesyncer.SyncReport) {
+	if report == nil || report.DryRun || !cmdArgs.localDirectory() {
+		return
+	}
+	directory := cmdArgs.directory
+	state := filesyncer.SyncState{Finished: time.Now(), Peer: peer, Report: report}
+	if err := filesyncer.SaveLastSync(directory, state); err != nil {
+		slog.Warn("Could not save sync state", "directory", directory, "error", err)
 	}
 }
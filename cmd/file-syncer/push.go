@@ -0,0 +1,187 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/isichei/file-syncer"
+	"golang.org/x/sync/errgroup"
+)
+
+func pushFlags() (*flag.FlagSet, *CmdArgs) {
+	cmdArgs := &CmdArgs{}
+	fs := newFlagSet("push", "[flags] [path ...]", "Sync the local directory to the replica listening on -addr, making the\nreplica match it exactly. Given paths, only those files and directories\nare synced and everything else on the replica is left alone.")
+	cmdArgs.Register(fs)
+	cmdArgs.RegisterMain(fs)
+	cmdArgs.hooks.RegisterMain(fs)
+	return fs, cmdArgs
+}
+
+func runPush(args []string) error {
+	fs, cmdArgs := pushFlags()
+	if err := cmdArgs.Parse(fs, args, "main"); err != nil {
+		return err
+	}
+
+	report, err := runMainSession(*cmdArgs, filesyncer.SessionOptions{Mode: cmdArgs.syncMode, Merge: cmdArgs.merge, Paths: cmdArgs.paths})
+	saveLastSync(*cmdArgs, cmdArgs.addr, report)
+	return err
+}
+
+type diffArgs struct {
+	cmdArgs CmdArgs
+	all     bool
+}
+
+func diffFlags() (*flag.FlagSet, *diffArgs) {
+	a := &diffArgs{}
+	fs := newFlagSet("diff", "[flags] [path ...]", "Show the files a push would send to or delete from the replica on -addr.\nNothing is transferred or changed on either side.")
+	a.cmdArgs.Register(fs)
+	a.cmdArgs.RegisterMain(fs)
+	fs.BoolVar(&a.all, "all", false, "Also list files that are unchanged")
+	return fs, a
+}
+
+func runDiff(args []string) error {
+	fs, a := diffFlags()
+	if err := a.cmdArgs.Parse(fs, args, "main"); err != nil {
+		return err
+	}
+	cmdArgs := a.cmdArgs
+
+	report, err := runMainSession(cmdArgs, filesyncer.SessionOptions{DryRun: true, Mode: cmdArgs.syncMode, Merge: cmdArgs.merge, Paths: cmdArgs.paths})
+	if err != nil {
+		return err
+	}
+	for _, fr := range report.Files {
+		if fr.Action == filesyncer.ActionUnchanged && !a.all {
+			continue
+		}
+		fmt.Printf("%s\t%s\n", diffMarker(fr.Action), fr.Path)
+	}
+	return nil
+}
+
+func verifyFlags() (*flag.FlagSet, *CmdArgs) {
+	cmdArgs := &CmdArgs{}
+	fs := newFlagSet("verify", "[flags] [path ...]", "Rehash the local directory and the replica on -addr and check they hold\nexactly the same files. Nothing is transferred. Exits non-zero if they differ.")
+	cmdArgs.Register(fs)
+	cmdArgs.RegisterMain(fs)
+	return fs, cmdArgs
+}
+
+func runVerify(args []string) error {
+	fs, cmdArgs := verifyFlags()
+	if err := cmdArgs.Parse(fs, args, "main"); err != nil {
+		return err
+	}
+
+	report, err := runMainSession(*cmdArgs, filesyncer.SessionOptions{DryRun: true, Paths: cmdArgs.paths})
+	if err != nil {
+		return err
+	}
+	differences := len(report.Files) - report.Count(filesyncer.ActionUnchanged)
+	if differences > 0 {
+		for _, fr := range report.Files {
+			if fr.Action != filesyncer.ActionUnchanged {
+				fmt.Printf("%s\t%s\n", diffMarker(fr.Action), fr.Path)
+			}
+		}
+		fmt.Printf("%d of %d files differ\n", differences, len(report.Files))
+		return errSilentExit
+	}
+	// Replicas from before tree digests don't send one
+	if report.PeerTreeDigest != "" && !report.TreesMatch() {
+		fmt.Printf("All %d files match but the trees differ: %s here, %s on the replica\n", len(report.Files), report.TreeDigest, report.PeerTreeDigest)
+		return errSilentExit
+	}
+	fmt.Printf("All %d files match\n", len(report.Files))
+	return nil
+}
+
+// Marker for a dry run action, the way a diff would show it
+func diffMarker(action filesyncer.FileAction) string {
+	switch action {
+	case filesyncer.ActionSent:
+		return "M"
+	case filesyncer.ActionDeleted:
+		return "D"
+	case filesyncer.ActionFailed:
+		return "!"
+	default:
+		return "="
+	}
+}
+
+// Connects to the replica and runs one session as main
+func runMainSession(cmdArgs CmdArgs, options filesyncer.SessionOptions) (*filesyncer.SyncReport, error) {
+	apiKey, err := cmdArgs.loadAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	var fc *filesyncer.FileCache
+
+	g := new(errgroup.Group)
+
+	// Set off TCP Connection
+	g.Go(func() error {
+		var err error
+		conn, err = filesyncer.CreateMainSenderConn(cmdArgs.addr, apiKey)
+		return err
+	})
+
+	// Set of file cache creation
+	g.Go(func() error {
+		if err := cmdArgs.hooks.RunPreScan(); err != nil {
+			return err
+		}
+		store, err := cmdArgs.openStore(false)
+		if err != nil {
+			return err
+		}
+		fc, err = cmdArgs.createFileCache(store)
+		return err
+	})
+
+	if err := g.Wait(); err != nil {
+		slog.Error("Setup for TCP or File cache failed", "error", err)
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, errSilentExit
+	}
+
+	syncer := filesyncer.Syncer{
+		Conn:              conn,
+		FileCache:         fc,
+		Options:           options,
+		IdleTimeout:       cmdArgs.idleTimeout,
+		SessionTimeout:    cmdArgs.sessionTimeout,
+		HeartbeatInterval: cmdArgs.heartbeat,
+		Window:            cmdArgs.window,
+		Throttle:          cmdArgs.throttle,
+		Observer:          &hookObserver{hooks: &cmdArgs.hooks},
+	}
+
+	slog.Info("Running sender as Main", "addr", cmdArgs.addr, "dryRun", options.DryRun, "mode", string(options.Mode), "merge", options.Merge, "paths", options.Paths)
+	report, err := syncer.Run()
+	if options.Merge && !syncer.Options.Merge {
+		slog.Warn("Replica does not keep merge bases, its changes were overwritten")
+	}
+	logConflicts(report)
+	if !options.DryRun {
+		cmdArgs.hooks.RunPostSession(report, err)
+	}
+	if writeErr := writeReport(report, cmdArgs); writeErr != nil {
+		slog.Error("Could not write sync report", "error", writeErr)
+	}
+	logSyncErrors("Main", &syncer, err)
+	if err != nil {
+		return report, errSilentExit
+	}
+	return report, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/isichei/file-syncer"
+)
+
+type serveArgs struct {
+	cmdArgs      CmdArgs
+	metricsAddr  string
+	once         bool
+	keysPath     string
+	guardArgs    GuardArgs
+	snapshotArgs SnapshotArgs
+}
+
+func serveFlags() (*flag.FlagSet, *serveArgs) {
+	a := &serveArgs{}
+	fs := newFlagSet("serve", "[flags]", "Listen on -addr and apply every authenticated push to the directory.\nSessions are handled one at a time.")
+	a.cmdArgs.Register(fs)
+	a.cmdArgs.RegisterReplica(fs)
+	a.cmdArgs.hooks.RegisterReplica(fs)
+	fs.StringVar(&a.metricsAddr, "metrics-addr", "", "Serve Prometheus metrics on this address at /metrics (disabled if empty)")
+	fs.BoolVar(&a.once, "once", false, "Exit after the first session")
+	fs.StringVar(&a.keysPath, "keys", "", "Key store file of per client API keys, reloaded on SIGHUP. Replaces FILE_SYNCER_API_KEY.")
+	a.guardArgs.Register(fs)
+	a.snapshotArgs.Register(fs)
+	return fs, a
+}
+
+func runServe(args []string) error {
+	fs, a := serveFlags()
+	if err := a.cmdArgs.Parse(fs, args, "replica"); err != nil {
+		return err
+	}
+	cmdArgs := a.cmdArgs
+	snapshots, err := a.snapshotArgs.Snapshots(cmdArgs)
+	if err != nil {
+		return err
+	}
+	conflictRules, err := filesyncer.ParseConflictRules(cmdArgs.conflicts)
+	if err != nil {
+		return fmt.Errorf("-conflicts: %w", err)
+	}
+	if len(conflictRules) > 0 {
+		cmdArgs.merge = true
+	}
+	if cmdArgs.merge && !cmdArgs.localDirectory() {
+		return errors.New("-merge and -conflicts need -directory to be a local directory")
+	}
+
+	auth, err := loadAuthenticator(a.keysPath, cmdArgs)
+	if err != nil {
+		return err
+	}
+
+	if a.metricsAddr != "" {
+		go func() {
+			if err := filesyncer.ServeMetrics(a.metricsAddr); err != nil {
+				slog.Error("Metrics server failed", "error", err)
+			}
+		}()
+	}
+
+	guardConfig, err := a.guardArgs.Config()
+	if err != nil {
+		return err
+	}
+	ln, err := filesyncer.ListenReplica(cmdArgs.addr, auth, filesyncer.NewConnGuard(guardConfig))
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	for {
+		conn, client, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+
+		err = serveSession(conn, client, cmdArgs, snapshots, conflictRules)
+		if a.once {
+			return err
+		}
+	}
+}
+
+// Runs one replica session on an authenticated connection
+func serveSession(conn net.Conn, client *filesyncer.ClientKey, cmdArgs CmdArgs, snapshots *filesyncer.Snapshots, conflictRules []filesyncer.ConflictRule) error {
+	peer := conn.RemoteAddr().String()
+	store, err := cmdArgs.openStore(true)
+	var fc *filesyncer.FileCache
+	if err == nil {
+		fc, err = cmdArgs.createFileCache(store)
+	}
+	if err != nil {
+		slog.Error("File cache creation failed", "error", err)
+		refuseSession(conn, cmdArgs, "failed to scan the replica's directory")
+		return errSilentExit
+	}
+	if err := cmdArgs.hooks.RunPreApply(); err != nil {
+		slog.Error("Aborting sync", "remote", peer, "error", err)
+		refuseSession(conn, cmdArgs, err.Error())
+		return errSilentExit
+	}
+
+	syncer := filesyncer.Syncer{
+		Replica:           true,
+		Conn:              conn,
+		FileCache:         fc,
+		IdleTimeout:       cmdArgs.idleTimeout,
+		SessionTimeout:    cmdArgs.sessionTimeout,
+		HeartbeatInterval: cmdArgs.heartbeat,
+		WriteWorkers:      cmdArgs.writeWorkers,
+		VerifyRetries:     cmdArgs.verifyRetries,
+		Throttle:          cmdArgs.throttle,
+		Observer:          &hookObserver{hooks: &cmdArgs.hooks},
+		Client:            client,
+		Snapshots:         snapshots,
+		ConflictRules:     conflictRules,
+		Mode:              cmdArgs.syncMode,
+	}
+	if cmdArgs.merge {
+		syncer.MergeBases = filesyncer.NewMergeBases(cmdArgs.directory)
+	}
+
+	slog.Info("Running sender as Replica", "remote", peer, "keyID", client.ID)
+	report, err := syncer.Run()
+	// Archives only change on disk once the session has applied everything
+	if archive, ok := store.(*filesyncer.ArchiveStore); ok && report != nil && !report.DryRun && (err == nil || errors.Is(err, filesyncer.ErrFilesFailed)) {
+		if commitErr := archive.Commit(); commitErr != nil {
+			slog.Error("Could not write archive", "path", cmdArgs.directory, "error", commitErr)
+			err = errors.Join(err, commitErr)
+		}
+	}
+	if report != nil && !report.DryRun {
+		cmdArgs.hooks.RunPostSession(report, err)
+	}
+	saveLastSync(cmdArgs, peer, report)
+	logConflicts(report)
+	if writeErr := writeReport(report, cmdArgs); writeErr != nil {
+		slog.Error("Could not write sync report", "error", writeErr)
+	}
+	logSyncErrors("Replica", &syncer, err)
+	if err != nil {
+		return errSilentExit
+	}
+	return nil
+}
+
+// Tells main why the replica won't run its session before hanging up
+func refuseSession(conn net.Conn, cmdArgs CmdArgs, reason string) {
+	syncer := filesyncer.Syncer{Replica: true, Conn: conn, IdleTimeout: cmdArgs.idleTimeout}
+	err := syncer.Refuse(&filesyncer.ProtocolError{Code: filesyncer.ErrCodeInternal, Text: reason})
+	slog.Debug("Refused session", "remote", conn.RemoteAddr(), "error", err)
+}
+
+// Uses the key store if one is given, reloading it on SIGHUP, otherwise the
+// single shared API key
+func loadAuthenticator(keysPath string, cmdArgs CmdArgs) (filesyncer.Authenticator, error) {
+	if keysPath == "" {
+		apiKey, err := cmdArgs.loadAPIKey()
+		if err != nil {
+			return nil, err
+		}
+		return filesyncer.StaticKey(apiKey), nil
+	}
+
+	ks, err := filesyncer.LoadKeyStore(keysPath)
+	if err != nil {
+		return nil, err
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := ks.Reload(); err != nil {
+				slog.Error("Failed to reload key store, keeping the old keys", "path", keysPath, "error", err)
+				continue
+			}
+			slog.Info("Reloaded key store", "path", keysPath)
+		}
+	}()
+	return ks, nil
+}
+
+// Flags for how hard the replica is on connections before they authenticate
+type GuardArgs struct {
+	config filesyncer.GuardConfig
+	allow  string
+	deny   string
+}
+
+func (g *GuardArgs) Register(fs *flag.FlagSet) {
+	g.config = filesyncer.DefaultGuardConfig()
+	fs.Float64Var(&g.config.Rate, "conn-rate", g.config.Rate, "Connection attempts allowed per second from one IP (0 disables)")
+	fs.IntVar(&g.config.Burst, "conn-burst", g.config.Burst, "Connection attempts allowed at once from one IP")
+	fs.IntVar(&g.config.MaxFailures, "max-auth-failures", g.config.MaxFailures, "Failed authentications from one IP before it is locked out (0 disables)")
+	fs.DurationVar(&g.config.LockoutBase, "lockout", g.config.LockoutBase, "First lockout, doubled for every further failure")
+	fs.DurationVar(&g.config.LockoutMax, "max-lockout", g.config.LockoutMax, "Longest lockout")
+	fs.IntVar(&g.config.MaxUnauthenticated, "max-unauthenticated", g.config.MaxUnauthenticated, "Connections allowed to be authenticating at once (0 means no cap)")
+	fs.StringVar(&g.allow, "allow", "", "Comma separated CIDRs allowed to connect (default any)")
+	fs.StringVar(&g.deny, "deny", "", "Comma separated CIDRs never allowed to connect")
+}
+
+func (g *GuardArgs) Config() (filesyncer.GuardConfig, error) {
+	var err error
+	config := g.config
+	if config.Allow, err = filesyncer.ParseCIDRList(g.allow); err != nil {
+		return config, fmt.Errorf("invalid -allow: %w", err)
+	}
+	if config.Deny, err = filesyncer.ParseCIDRList(g.deny); err != nil {
+		return config, fmt.Errorf("invalid -deny: %w", err)
+	}
+	return config, nil
+}
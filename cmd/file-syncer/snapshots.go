@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/isichei/file-syncer"
+)
+
+// Serve flags for recording a snapshot after each session
+type SnapshotArgs struct {
+	enabled    bool
+	keepLast   int
+	keepWithin time.Duration
+}
+
+func (a *SnapshotArgs) Register(fs *flag.FlagSet) {
+	fs.BoolVar(&a.enabled, "snapshots", false, "Record a snapshot of the directory after every successful session")
+	fs.IntVar(&a.keepLast, "keep-snapshots", 0, "Keep this many of the newest snapshots (0 keeps all unless -keep-snapshots-for is set)")
+	fs.DurationVar(&a.keepWithin, "keep-snapshots-for", 0, "Keep snapshots younger than this")
+}
+
+// Returns the snapshots to record for the session, or nil if disabled
+func (a *SnapshotArgs) Snapshots(cmdArgs CmdArgs) (*filesyncer.Snapshots, error) {
+	if !a.enabled {
+		return nil, nil
+	}
+	if !cmdArgs.localDirectory() {
+		return nil, fmt.Errorf("-snapshots needs -directory to be a plain directory")
+	}
+	snapshots := filesyncer.NewSnapshots(cmdArgs.directory)
+	snapshots.Retention = filesyncer.RetentionPolicy{KeepLast: a.keepLast, KeepWithin: a.keepWithin}
+	return snapshots, nil
+}
+
+type snapshotsArgs struct {
+	directory    string
+	asJSON       bool
+	snapshotArgs SnapshotArgs
+	config       ConfigArgs
+}
+
+func snapshotsFlags() (*flag.FlagSet, *snapshotsArgs) {
+	a := &snapshotsArgs{snapshotArgs: SnapshotArgs{enabled: true}}
+	fs := newFlagSet("snapshots", "[flags] list | diff <from> <to> | restore <id> <target> | prune",
+		"List, compare, restore and prune the snapshots a replica recorded with\n-snapshots. \"latest\" can be used in place of a snapshot id.")
+	fs.StringVar(&a.directory, "directory", "test_data", "Path to the synced dir")
+	fs.BoolVar(&a.asJSON, "json", false, "Print list and diff output as JSON")
+	fs.IntVar(&a.snapshotArgs.keepLast, "keep-snapshots", 0, "For prune, keep this many of the newest snapshots")
+	fs.DurationVar(&a.snapshotArgs.keepWithin, "keep-snapshots-for", 0, "For prune, keep snapshots younger than this")
+	a.config.Register(fs)
+	return fs, a
+}
+
+func runSnapshots(args []string) error {
+	fs, a := snapshotsFlags()
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if _, err := a.config.Apply(fs); err != nil {
+		return err
+	}
+	a.config.warnIgnored()
+
+	snapshots, err := a.snapshotArgs.Snapshots(CmdArgs{directory: a.directory})
+	if err != nil {
+		return err
+	}
+	rest := fs.Args()
+	if len(rest) == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	switch action := rest[0]; {
+	case action == "list" && len(rest) == 1:
+		snaps, err := snapshots.List()
+		if err != nil {
+			return err
+		}
+		if a.asJSON {
+			return printJSON(snaps)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tCREATED\tFILES")
+		for _, snap := range snaps {
+			fmt.Fprintf(tw, "%s\t%s\t%d\n", snap.ID, snap.Created.Local().Format(time.RFC3339), len(snap.Files))
+		}
+		return tw.Flush()
+
+	case action == "diff" && len(rest) == 3:
+		from, err := snapshots.Load(rest[1])
+		if err != nil {
+			return err
+		}
+		to, err := snapshots.Load(rest[2])
+		if err != nil {
+			return err
+		}
+		changes := filesyncer.DiffSnapshots(from, to)
+		if a.asJSON {
+			return printJSON(changes)
+		}
+		for _, change := range changes {
+			fmt.Printf("%s\t%s\n", snapshotMarker(change.Change), change.Path)
+		}
+		return nil
+
+	case action == "restore" && len(rest) == 3:
+		if err := snapshots.Restore(rest[1], rest[2]); err != nil {
+			return err
+		}
+		fmt.Printf("Restored %s into %s\n", rest[1], rest[2])
+		return nil
+
+	case action == "prune" && len(rest) == 1:
+		removed, err := snapshots.Prune()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %d snapshot(s)\n", len(removed))
+		return nil
+
+	default:
+		fs.Usage()
+		return flag.ErrHelp
+	}
+}
+
+// Marker for a snapshot change, the way a diff would show it
+func snapshotMarker(change string) string {
+	switch change {
+	case filesyncer.SnapshotAdded:
+		return "A"
+	case filesyncer.SnapshotRemoved:
+		return "D"
+	default:
+		return "M"
+	}
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/isichei/file-syncer"
+	"gopkg.in/yaml.v3"
+)
+
+type statusArgs struct {
+	directory string
+	asJSON    bool
+	config    ConfigArgs
+}
+
+func statusFlags() (*flag.FlagSet, *statusArgs) {
+	a := &statusArgs{}
+	fs := newFlagSet("status", "[flags]", "Show the last sync recorded in the directory.")
+	fs.StringVar(&a.directory, "directory", "test_data", "Path to the synced dir")
+	fs.BoolVar(&a.asJSON, "json", false, "Print the full state as JSON")
+	a.config.Register(fs)
+	return fs, a
+}
+
+func runStatus(args []string) error {
+	fs, a := statusFlags()
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if _, err := a.config.Apply(fs); err != nil {
+		return err
+	}
+	a.config.warnIgnored()
+
+	state, err := filesyncer.LoadLastSync(a.directory)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No sync recorded in %s\n", a.directory)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if a.asJSON {
+		return state.Report.WriteJSON(os.Stdout)
+	}
+
+	report := state.Report
+	result := "ok"
+	if report.Error != "" {
+		result = "failed: " + report.Error
+	}
+	fmt.Printf("Last sync:  %s (%s ago)\n", state.Finished.Format(time.RFC3339), time.Since(state.Finished).Round(time.Second))
+	fmt.Printf("Role:       %s\n", report.Role)
+	fmt.Printf("Peer:       %s\n", state.Peer)
+	fmt.Printf("Result:     %s\n", result)
+	fmt.Printf("Duration:   %s\n", report.Duration.Round(time.Millisecond))
+	fmt.Printf("Files:      %d unchanged, %d sent, %d received, %d reused, %d merged, %d conflicts, %d deleted, %d failed\n",
+		report.Count(filesyncer.ActionUnchanged),
+		report.Count(filesyncer.ActionSent),
+		report.Count(filesyncer.ActionReceived),
+		report.Count(filesyncer.ActionReused),
+		report.Count(filesyncer.ActionMerged),
+		report.Count(filesyncer.ActionConflict),
+		report.Count(filesyncer.ActionDeleted),
+		report.Count(filesyncer.ActionFailed),
+	)
+	fmt.Printf("Bytes:      %d\n", report.Bytes())
+	return nil
+}
+
+type keygenArgs struct {
+	size        int
+	id          string
+	permissions string
+	paths       string
+}
+
+func keygenFlags() (*flag.FlagSet, *keygenArgs) {
+	a := &keygenArgs{}
+	fs := newFlagSet("keygen", "[flags]", "Generate a random API key. Without -id it is a shared key to use as\nFILE_SYNCER_API_KEY on both sides. With -id it is a per client key and the\nentry to add to the replica's key store is printed after it.")
+	fs.IntVar(&a.size, "bytes", 32, "Number of random bytes in a shared key")
+	fs.StringVar(&a.id, "id", "", "Generate a per client key with this id")
+	fs.StringVar(&a.permissions, "permissions", "push", "Comma separated permissions of a per client key (pull, push)")
+	fs.StringVar(&a.paths, "paths", "", "Comma separated paths a per client key may sync (default everything)")
+	return fs, a
+}
+
+func runKeygen(args []string) error {
+	fs, a := keygenFlags()
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if a.id != "" {
+		var perms []filesyncer.Permission
+		for _, p := range splitList(a.permissions) {
+			perms = append(perms, filesyncer.Permission(p))
+		}
+		key, entry, err := filesyncer.GenerateClientKey(a.id, perms...)
+		if err != nil {
+			return fmt.Errorf("failed to generate key: %w", err)
+		}
+		entry.Paths = splitList(a.paths)
+		storeEntry, err := yaml.Marshal([]filesyncer.ClientKey{entry})
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		fmt.Printf("\n# Add to the keys list of the replica's key store:\n%s", storeEntry)
+		return nil
+	}
+
+	if a.size < 16 {
+		return errors.New("keys must have at least 16 random bytes")
+	}
+	key := make([]byte, a.size)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	fmt.Println(base64.RawURLEncoding.EncodeToString(key))
+	return nil
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/isichei/file-syncer"
+)
+
+// Opens the store named by a -store URL. Only s3://bucket/prefix is
+// supported, with the endpoint and region as query parameters and the
+// credentials taken from the usual AWS environment variables.
+func openStore(storeURL string) (filesyncer.Store, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -store %q: %w", storeURL, err)
+	}
+	switch u.Scheme {
+	case "s3":
+		query := u.Query()
+		endpoint := query.Get("endpoint")
+		region := query.Get("region")
+		if region == "" {
+			region = os.Getenv("AWS_REGION")
+		}
+		if endpoint == "" {
+			if region == "" {
+				region = "us-east-1"
+			}
+			endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+		}
+		return filesyncer.NewS3Store(filesyncer.S3Config{
+			Endpoint:     endpoint,
+			Region:       region,
+			Bucket:       u.Host,
+			Prefix:       strings.TrimPrefix(u.Path, "/"),
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		})
+	default:
+		return nil, fmt.Errorf("unsupported -store %q: expected s3://bucket/prefix", storeURL)
+	}
+}
@@ -0,0 +1,182 @@
+package filesyncer
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ConflictPolicy is how a replica resolves a file that changed on both main
+// and the replica since the last session
+type ConflictPolicy string
+
+const (
+	// Line merge both versions, see merge3
+	ConflictMerge ConflictPolicy = "merge"
+	// Overwrite the replica's version, as a plain mirror would
+	ConflictMainWins ConflictPolicy = "main-wins"
+	// Keep the replica's version
+	ConflictReplicaWins ConflictPolicy = "replica-wins"
+	// Keep whichever version was modified last
+	ConflictNewestWins ConflictPolicy = "newest-mtime-wins"
+	// Move the replica's version aside to a conflict copy and take main's
+	ConflictKeepBoth ConflictPolicy = "keep-both"
+	// End the session. Files already applied stay applied.
+	ConflictAbort ConflictPolicy = "abort"
+)
+
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(s); policy {
+	case ConflictMerge, ConflictMainWins, ConflictReplicaWins, ConflictNewestWins, ConflictKeepBoth, ConflictAbort:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown conflict policy %q", s)
+	}
+}
+
+// ConflictRule applies Policy to the files Pattern matches. A pattern without
+// a slash matches any file or directory name, like *.draft.md or archive. One
+// with a slash matches from the root, like docs/api or notes/*. Matching a
+// directory matches everything under it.
+type ConflictRule struct {
+	Pattern string
+	Policy  ConflictPolicy
+}
+
+func (r ConflictRule) Matches(name string) bool {
+	pattern := strings.TrimSuffix(r.Pattern, "/")
+	parts := strings.Split(name, "/")
+	if !strings.Contains(pattern, "/") {
+		for _, part := range parts {
+			if ok, _ := path.Match(pattern, part); ok {
+				return true
+			}
+		}
+		return false
+	}
+	for i := range parts {
+		if ok, _ := path.Match(pattern, strings.Join(parts[:i+1], "/")); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses comma separated pattern=policy rules such as
+// "docs/api=merge,*.log.md=main-wins,archive=abort"
+func ParseConflictRules(s string) ([]ConflictRule, error) {
+	var rules []ConflictRule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pattern, policyText, found := strings.Cut(item, "=")
+		if !found || pattern == "" {
+			return nil, fmt.Errorf("conflict rule %q is not pattern=policy", item)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("conflict rule %q: %w", item, err)
+		}
+		policy, err := ParseConflictPolicy(policyText)
+		if err != nil {
+			return nil, fmt.Errorf("conflict rule %q: %w", item, err)
+		}
+		rules = append(rules, ConflictRule{Pattern: pattern, Policy: policy})
+	}
+	return rules, nil
+}
+
+// The policy of the first rule matching name. Files no rule matches are
+// merged in merge sessions and otherwise take main's version.
+func (s *Syncer) conflictPolicy(name string) ConflictPolicy {
+	for _, rule := range s.ConflictRules {
+		if rule.Matches(name) {
+			return rule.Policy
+		}
+	}
+	if s.Options.Merge {
+		return ConflictMerge
+	}
+	return ConflictMainWins
+}
+
+// Decides what to do with main's version of a file the replica holds a
+// different version of. It is only a conflict if both changed it since the
+// last session. If only the replica did its changes stand unless main wins,
+// and the answer is only ever main-wins, replica-wins, merge, keep-both or
+// abort.
+func (s *Syncer) resolveChange(msg Message, fileData fileCacheData, rs *replicaState) ConflictPolicy {
+	base, hasBase := rs.bases[msg.FileName]
+	if !hasBase || base == fileData.md5 {
+		return ConflictMainWins
+	}
+	policy := s.conflictPolicy(msg.FileName)
+	if base == msg.MD5 {
+		if policy == ConflictMainWins {
+			return ConflictMainWins
+		}
+		return ConflictReplicaWins
+	}
+
+	if policy == ConflictNewestWins {
+		policy = ConflictReplicaWins
+		// Older mains don't say, so they win as they would have before
+		if msg.ModTime.IsZero() || msg.ModTime.After(fileData.modTime) {
+			policy = ConflictMainWins
+		}
+	}
+	slog.Info("File changed on both main and replica", "filename", msg.FileName, "policy", string(policy))
+	return policy
+}
+
+// Applies the conflict policy to a file main and the replica hold different
+// versions of. Returns true if the replica keeps its version. Errors fail
+// the file, or end the session under the abort policy.
+func (s *Syncer) resolveConflict(msg Message, fileData fileCacheData, rs *replicaState) (bool, error) {
+	switch s.resolveChange(msg, fileData, rs) {
+	case ConflictReplicaWins:
+		return true, nil
+	case ConflictMerge:
+		rs.merges[msg.FileName] = rs.bases[msg.FileName]
+	case ConflictKeepBoth:
+		if s.Options.DryRun {
+			break
+		}
+		copyName := conflictCopyName(msg.FileName, conflictHost(), time.Now())
+		if err := s.FileCache.store.Rename(msg.FileName, copyName); err != nil {
+			return false, err
+		}
+		s.FileCache.set(copyName, fileCacheData{md5: fileData.md5, size: fileData.size, synced: true})
+		s.report.record(FileReport{Path: copyName, Action: ActionKept})
+		slog.Info("Moved the replica's version aside", "filename", msg.FileName, "copy", copyName)
+	case ConflictAbort:
+		return false, &ProtocolError{Code: ErrCodeConflict, Path: msg.FileName, Text: "changed on both main and the replica"}
+	}
+	return false, nil
+}
+
+var conflictCopyPattern = regexp.MustCompile(`\.conflict-[^/]+-\d{8}T\d{6}Z\.md$`)
+
+// Where keep-both moves the replica's version of name
+func conflictCopyName(name string, host string, at time.Time) string {
+	return fmt.Sprintf("%s.conflict-%s-%s.md", strings.TrimSuffix(name, ".md"), host, at.UTC().Format("20060102T150405Z"))
+}
+
+// Conflict copies only exist on the replica so they are never deleted for
+// being missing from main
+func isConflictCopy(name string) bool {
+	return conflictCopyPattern.MatchString(name)
+}
+
+func conflictHost() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "replica"
+	}
+	return strings.ReplaceAll(host, "/", "_")
+}
@@ -0,0 +1,149 @@
+package filesyncer
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConflictRuleMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		matches bool
+	}{
+		{pattern: "*.md", name: "a.md", matches: true},
+		{pattern: "*.md", name: "docs/a.md", matches: true},
+		{pattern: "drafts", name: "notes/drafts/a.md", matches: true},
+		{pattern: "drafts", name: "drafts.md", matches: false},
+		{pattern: "docs/api", name: "docs/api/v1/a.md", matches: true},
+		{pattern: "docs/api/", name: "docs/api/a.md", matches: true},
+		{pattern: "docs/api", name: "notes/docs/api/a.md", matches: false},
+		{pattern: "docs/*.md", name: "docs/a.md", matches: true},
+		{pattern: "docs/*.md", name: "docs/sub/a.md", matches: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.matches, ConflictRule{Pattern: tt.pattern}.Matches(tt.name))
+		})
+	}
+}
+
+func TestParseConflictRules(t *testing.T) {
+	rules, err := ParseConflictRules("docs/api=merge, drafts=keep-both,*=main-wins")
+	assert.NoError(t, err)
+	assert.Equal(t, []ConflictRule{
+		{Pattern: "docs/api", Policy: ConflictMerge},
+		{Pattern: "drafts", Policy: ConflictKeepBoth},
+		{Pattern: "*", Policy: ConflictMainWins},
+	}, rules)
+
+	for _, bad := range []string{"docs", "=merge", "docs=sometimes", "[=merge"} {
+		_, err := ParseConflictRules(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+// Each folder's rule decides what happens to files changed on both sides
+func TestSyncerConflictPolicies(t *testing.T) {
+	mainDir, replicaDir := t.TempDir(), t.TempDir()
+	rules := []ConflictRule{
+		{Pattern: "main", Policy: ConflictMainWins},
+		{Pattern: "replica", Policy: ConflictReplicaWins},
+		{Pattern: "newest", Policy: ConflictNewestWins},
+		{Pattern: "both", Policy: ConflictKeepBoth},
+		{Pattern: "stop", Policy: ConflictAbort},
+	}
+	sync := func() (*SyncReport, *SyncReport, error) {
+		mainFC, err := CreateFileCache(mainDir)
+		assert.NoError(t, err)
+		replicaFC, err := CreateFileCache(replicaDir)
+		assert.NoError(t, err)
+		replica := &Syncer{Replica: true, FileCache: replicaFC, MergeBases: NewMergeBases(replicaDir), ConflictRules: rules}
+		var replicaReport *SyncReport
+		var replicaErr error
+		done := make(chan struct{})
+		mainConn, replicaConn := net.Pipe()
+		replica.Conn = replicaConn
+		go func() {
+			replicaReport, replicaErr = replica.Run()
+			close(done)
+		}()
+		mainReport, err := (&Syncer{FileCache: mainFC, Conn: mainConn}).Run()
+		<-done
+		return mainReport, replicaReport, errors.Join(err, replicaErr)
+	}
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(replicaDir, name))
+		assert.NoError(t, err)
+		return string(data)
+	}
+
+	names := []string{"main/a.md", "replica/a.md", "newest/main.md", "newest/replica.md", "both/a.md", "untouched.md"}
+	original := map[string]string{}
+	for _, name := range names {
+		original[name] = "original\n"
+	}
+	writeTestFiles(t, mainDir, original)
+	_, _, err := sync()
+	assert.NoError(t, err)
+
+	changed := func(dir string, side string) {
+		files := map[string]string{}
+		for _, name := range names {
+			files[name] = side + "\n"
+		}
+		writeTestFiles(t, dir, files)
+	}
+	changed(mainDir, "main")
+	changed(replicaDir, "replica")
+	later := time.Now().Add(time.Hour)
+	assert.NoError(t, os.Chtimes(filepath.Join(mainDir, "newest/main.md"), later, later))
+	assert.NoError(t, os.Chtimes(filepath.Join(replicaDir, "newest/replica.md"), later, later))
+	// Only changed on the replica, and no rule covers it so main wins
+	writeTestFiles(t, mainDir, map[string]string{"untouched.md": "original\n"})
+
+	mainReport, replicaReport, err := sync()
+	assert.NoError(t, err)
+	assert.Equal(t, "main\n", read("main/a.md"))
+	assert.Equal(t, "replica\n", read("replica/a.md"))
+	assert.Equal(t, "main\n", read("newest/main.md"))
+	assert.Equal(t, "replica\n", read("newest/replica.md"))
+	assert.Equal(t, "main\n", read("both/a.md"))
+	assert.Equal(t, "original\n", read("untouched.md"))
+	assert.Equal(t, ActionKept, reportActions(mainReport)["replica/a.md"])
+	assert.Equal(t, ActionKept, reportActions(mainReport)["newest/replica.md"])
+
+	copies, err := filepath.Glob(filepath.Join(replicaDir, "both", "a.conflict-*.md"))
+	assert.NoError(t, err)
+	if assert.Len(t, copies, 1) {
+		assert.True(t, isConflictCopy(filepath.ToSlash(copies[0])))
+		assert.Equal(t, "replica\n", read(filepath.Join("both", filepath.Base(copies[0]))))
+		assert.Equal(t, ActionKept, reportActions(replicaReport)["both/"+filepath.Base(copies[0])])
+	}
+
+	// Conflict copies survive later syncs even though main lacks them
+	_, _, err = sync()
+	assert.NoError(t, err)
+	copies, _ = filepath.Glob(filepath.Join(replicaDir, "both", "a.conflict-*.md"))
+	assert.Len(t, copies, 1)
+
+	// abort ends the session
+	writeTestFiles(t, mainDir, map[string]string{"stop/a.md": "original\n"})
+	_, _, err = sync()
+	assert.NoError(t, err)
+	writeTestFiles(t, mainDir, map[string]string{"stop/a.md": "main\n"})
+	writeTestFiles(t, replicaDir, map[string]string{"stop/a.md": "replica\n"})
+	_, _, err = sync()
+	var pe *ProtocolError
+	if assert.ErrorAs(t, err, &pe) {
+		assert.Equal(t, ErrCodeConflict, pe.Code)
+	}
+	assert.Equal(t, "replica\n", read("stop/a.md"))
+
+}
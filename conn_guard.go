@@ -0,0 +1,231 @@
+package filesyncer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrConnRejected = errors.New("Connection rejected")
+
+// GuardConfig sets how hard ConnGuard is on connections before they authenticate
+type GuardConfig struct {
+	// Connection attempts allowed per second from one IP, with Burst allowed
+	// at once. Zero Rate disables the limit.
+	Rate  float64
+	Burst int
+	// Consecutive auth failures from one IP before it is locked out. Each
+	// further failure doubles the lockout, up to LockoutMax. Failures are
+	// forgotten once an IP has gone LockoutMax without one, or an hour if
+	// there is no LockoutMax. Zero disables.
+	MaxFailures int
+	LockoutBase time.Duration
+	LockoutMax  time.Duration
+	// Connections allowed to be authenticating at once across all IPs.
+	// Zero means no cap.
+	MaxUnauthenticated int
+	// If Allow is set only IPs in it may connect. IPs in Deny never may.
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+func DefaultGuardConfig() GuardConfig {
+	return GuardConfig{
+		Rate:               1,
+		Burst:              5,
+		MaxFailures:        5,
+		LockoutBase:        time.Minute,
+		LockoutMax:         time.Hour,
+		MaxUnauthenticated: 16,
+	}
+}
+
+// ConnGuard decides which incoming connections get a chance to authenticate
+type ConnGuard struct {
+	config  GuardConfig
+	mu      sync.Mutex
+	clients map[string]*guardClient
+	pending int
+	pruned  time.Time
+	now     func() time.Time
+}
+
+type guardClient struct {
+	tokens      float64
+	last        time.Time
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func NewConnGuard(config GuardConfig) *ConnGuard {
+	return &ConnGuard{config: config, clients: map[string]*guardClient{}, now: time.Now}
+}
+
+// Admit is called for every new connection before it authenticates. On
+// success the caller must call release once authentication is over.
+func (g *ConnGuard) Admit(addr net.Addr) (release func(), err error) {
+	host := addrHost(addr)
+	ip := net.ParseIP(host)
+	if reason := g.checkLists(ip); reason != "" {
+		metrics.connectionsRejected.inc(reason)
+		return nil, fmt.Errorf("%w: %s is %s", ErrConnRejected, host, reason)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	g.prune(now)
+	client := g.client(host, now)
+
+	if now.Before(client.lockedUntil) {
+		metrics.connectionsRejected.inc("locked_out")
+		return nil, fmt.Errorf("%w: %s is locked out for %s", ErrConnRejected, host, client.lockedUntil.Sub(now).Round(time.Second))
+	}
+	if g.config.Rate > 0 {
+		client.tokens = min(float64(g.config.Burst), client.tokens+now.Sub(client.last).Seconds()*g.config.Rate)
+		client.last = now
+		if client.tokens < 1 {
+			metrics.connectionsRejected.inc("rate_limited")
+			return nil, fmt.Errorf("%w: %s is connecting too often", ErrConnRejected, host)
+		}
+		client.tokens--
+	}
+	if g.config.MaxUnauthenticated > 0 && g.pending >= g.config.MaxUnauthenticated {
+		metrics.connectionsRejected.inc("too_many_pending")
+		return nil, fmt.Errorf("%w: too many connections authenticating", ErrConnRejected)
+	}
+
+	g.pending++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			g.pending--
+			g.mu.Unlock()
+		})
+	}, nil
+}
+
+// Records a failed authentication, locking the IP out once it has failed too often
+func (g *ConnGuard) AuthFailed(addr net.Addr) {
+	if g.config.MaxFailures <= 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	client := g.client(addrHost(addr), now)
+	if now.Sub(client.lastFailure) > g.failureWindow() {
+		client.failures = 0
+	}
+	client.failures++
+	client.lastFailure = now
+	if over := client.failures - g.config.MaxFailures; over >= 0 {
+		lockout := time.Duration(float64(g.config.LockoutBase) * math.Pow(2, float64(over)))
+		if g.config.LockoutMax > 0 && (lockout > g.config.LockoutMax || lockout <= 0) {
+			lockout = g.config.LockoutMax
+		}
+		client.lockedUntil = now.Add(lockout)
+	}
+}
+
+// Clears the failure count after a good authentication
+func (g *ConnGuard) AuthSucceeded(addr net.Addr) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	client := g.client(addrHost(addr), g.now())
+	client.failures = 0
+	client.lockedUntil = time.Time{}
+}
+
+// Returns why ip is not allowed by the allow and deny lists, empty if it is
+func (g *ConnGuard) checkLists(ip net.IP) string {
+	for _, n := range g.config.Deny {
+		if ip != nil && n.Contains(ip) {
+			return "denied"
+		}
+	}
+	if len(g.config.Allow) == 0 {
+		return ""
+	}
+	for _, n := range g.config.Allow {
+		if ip != nil && n.Contains(ip) {
+			return ""
+		}
+	}
+	return "not_allowed"
+}
+
+// How long an IP's failures count against it after the last one
+func (g *ConnGuard) failureWindow() time.Duration {
+	if g.config.LockoutMax > 0 {
+		return g.config.LockoutMax
+	}
+	return time.Hour
+}
+
+// Must be called with g.mu held
+func (g *ConnGuard) client(host string, now time.Time) *guardClient {
+	client, ok := g.clients[host]
+	if !ok {
+		client = &guardClient{tokens: float64(g.config.Burst), last: now}
+		g.clients[host] = client
+	}
+	return client
+}
+
+// Forgets IPs that are not locked out, whose tokens have refilled and whose
+// failures have been forgotten. Must be called with g.mu held.
+func (g *ConnGuard) prune(now time.Time) {
+	if now.Sub(g.pruned) < time.Minute {
+		return
+	}
+	g.pruned = now
+	refill := time.Duration(0)
+	if g.config.Rate > 0 {
+		refill = time.Duration(float64(g.config.Burst) / g.config.Rate * float64(time.Second))
+	}
+	for host, client := range g.clients {
+		if now.After(client.lockedUntil) && now.Sub(client.last) > refill && (client.failures == 0 || now.Sub(client.lastFailure) > g.failureWindow()) {
+			delete(g.clients, host)
+		}
+	}
+}
+
+func addrHost(addr net.Addr) string {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// ParseCIDRList parses a comma separated list of CIDRs. Bare IPs are taken
+// as a single address.
+func ParseCIDRList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", item, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
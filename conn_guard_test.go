@@ -0,0 +1,157 @@
+package filesyncer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+func TestConnGuardRateLimit(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	g := NewConnGuard(GuardConfig{Rate: 1, Burst: 2})
+	g.now = clock.Now
+	addr := tcpAddr("10.0.0.1")
+
+	for range 2 {
+		release, err := g.Admit(addr)
+		assert.NoError(t, err)
+		release()
+	}
+	_, err := g.Admit(addr)
+	assert.ErrorIs(t, err, ErrConnRejected, "Burst should be used up")
+
+	_, err = g.Admit(tcpAddr("10.0.0.2"))
+	assert.NoError(t, err, "Other IPs have their own limit")
+
+	clock.now = clock.now.Add(time.Second)
+	_, err = g.Admit(addr)
+	assert.NoError(t, err, "A token should have refilled")
+}
+
+func TestConnGuardLockout(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	g := NewConnGuard(GuardConfig{MaxFailures: 2, LockoutBase: time.Minute, LockoutMax: 3 * time.Minute})
+	g.now = clock.Now
+	addr := tcpAddr("10.0.0.1")
+
+	g.AuthFailed(addr)
+	_, err := g.Admit(addr)
+	assert.NoError(t, err, "One failure is not enough for a lockout")
+
+	g.AuthFailed(addr)
+	_, err = g.Admit(addr)
+	assert.ErrorIs(t, err, ErrConnRejected)
+
+	clock.now = clock.now.Add(time.Minute + time.Second)
+	_, err = g.Admit(addr)
+	assert.NoError(t, err, "Lockout should have expired")
+
+	// Next failure doubles the lockout
+	g.AuthFailed(addr)
+	clock.now = clock.now.Add(time.Minute + time.Second)
+	_, err = g.Admit(addr)
+	assert.ErrorIs(t, err, ErrConnRejected)
+	clock.now = clock.now.Add(time.Minute)
+	_, err = g.Admit(addr)
+	assert.NoError(t, err)
+
+	g.AuthSucceeded(addr)
+	g.AuthFailed(addr)
+	_, err = g.Admit(addr)
+	assert.NoError(t, err, "Success should reset the failure count")
+}
+
+// Failing just under the limit between prunes still ends in a lockout
+func TestConnGuardFailuresSurvivePrune(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	config := DefaultGuardConfig()
+	g := NewConnGuard(config)
+	g.now = clock.Now
+	addr := tcpAddr("10.0.0.1")
+
+	for range config.MaxFailures - 1 {
+		g.AuthFailed(addr)
+	}
+	clock.now = clock.now.Add(2 * time.Minute)
+	_, err := g.Admit(addr)
+	assert.NoError(t, err, "Not locked out yet")
+	g.AuthFailed(addr)
+	_, err = g.Admit(addr)
+	assert.ErrorIs(t, err, ErrConnRejected)
+
+	// Failures are forgotten after a quiet LockoutMax
+	g.AuthSucceeded(addr)
+	for range config.MaxFailures - 1 {
+		g.AuthFailed(addr)
+	}
+	clock.now = clock.now.Add(config.LockoutMax + time.Minute)
+	g.AuthFailed(addr)
+	_, err = g.Admit(addr)
+	assert.NoError(t, err)
+}
+
+func TestConnGuardMaxUnauthenticated(t *testing.T) {
+	g := NewConnGuard(GuardConfig{MaxUnauthenticated: 1})
+	release, err := g.Admit(tcpAddr("10.0.0.1"))
+	assert.NoError(t, err)
+	_, err = g.Admit(tcpAddr("10.0.0.2"))
+	assert.ErrorIs(t, err, ErrConnRejected)
+	release()
+	release()
+	_, err = g.Admit(tcpAddr("10.0.0.2"))
+	assert.NoError(t, err)
+}
+
+func TestConnGuardAllowDeny(t *testing.T) {
+	allow, err := ParseCIDRList("10.0.0.0/8, 192.168.1.5")
+	assert.NoError(t, err)
+	deny, err := ParseCIDRList("10.0.0.66")
+	assert.NoError(t, err)
+	g := NewConnGuard(GuardConfig{Allow: allow, Deny: deny})
+
+	_, err = g.Admit(tcpAddr("10.1.2.3"))
+	assert.NoError(t, err)
+	_, err = g.Admit(tcpAddr("192.168.1.5"))
+	assert.NoError(t, err)
+	_, err = g.Admit(tcpAddr("192.168.1.6"))
+	assert.ErrorIs(t, err, ErrConnRejected)
+	_, err = g.Admit(tcpAddr("10.0.0.66"))
+	assert.ErrorIs(t, err, ErrConnRejected)
+
+	_, err = ParseCIDRList("not-a-cidr")
+	assert.Error(t, err)
+}
+
+// A client with a bad key should not stop the listener handing out the next
+// good connection
+func TestReplicaListenerSkipsFailedAuth(t *testing.T) {
+	ln, err := ListenReplica("127.0.0.1:0", StaticKey("good"), nil)
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	_, err = CreateMainSenderConn(ln.Addr().String(), "bad")
+	assert.ErrorIs(t, err, ErrAuthFailed)
+
+	mainConn, err := CreateMainSenderConn(ln.Addr().String(), "good")
+	assert.NoError(t, err)
+	defer mainConn.Close()
+
+	conn, client, err := ln.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "default", client.ID)
+}
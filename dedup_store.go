@@ -0,0 +1,163 @@
+package filesyncer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+)
+
+var errWriteAborted = errors.New("write aborted")
+
+// DedupStore is a LocalStore that keeps each distinct file content once, by
+// md5, in the object store of the directory and hard links it into place, so
+// identical files at different paths share the same disk space. Linked files
+// are read only as changing one would change every file sharing it; they are
+// only ever replaced. Where the file system can't hard link the object is
+// copied instead.
+//
+// Removing an object, as pruning snapshots may, leaves the files linked to
+// it intact. Their content is only stored again the next time it is written.
+// Objects no file links to any more are removed by CollectGarbage.
+type DedupStore struct {
+	*LocalStore
+	objects *ObjectStore
+}
+
+func NewDedupStore(directory string) *DedupStore {
+	return &DedupStore{LocalStore: NewLocalStore(directory), objects: NewObjectStore(directory)}
+}
+
+// Streams the content into the object store, linking it into place as name
+// on Close
+func (s *DedupStore) Create(name string) (FileWriter, error) {
+	pr, pw := io.Pipe()
+	w := &dedupFileWriter{store: s, name: name, pipe: pw, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		w.id, _, w.err = s.objects.Put(pr)
+		// Unblocks Write if the object store gave up early
+		pr.CloseWithError(w.err)
+	}()
+	return w, nil
+}
+
+// Materialises name from the stored object with the given md5, returning
+// its size. Fails with fs.ErrNotExist if no such object is stored.
+func (s *DedupStore) LinkObject(name string, md5 string) (int64, error) {
+	if !s.objects.Has(md5) {
+		return 0, fmt.Errorf("%w: no stored object %s", fs.ErrNotExist, md5)
+	}
+	fi, err := os.Stat(s.objects.path(md5))
+	if err != nil {
+		return 0, err
+	}
+	if err := s.link(md5, name); err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (s *DedupStore) link(id string, name string) error {
+	root, err := s.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	if dir := path.Dir(name); dir != "." {
+		if err := root.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	tmp := tempName(name)
+	if err := root.Link(objectName(id), tmp); err != nil {
+		slog.Debug("Could not hard link object, copying it", "id", id, "filename", name, "error", err)
+		return s.copyObject(id, name)
+	}
+	err = root.Rename(tmp, name)
+	// Renaming onto a link to the same object does nothing, leaving tmp
+	// behind, so it is always cleaned up
+	root.Remove(tmp)
+	return err
+}
+
+func (s *DedupStore) copyObject(id string, name string) error {
+	in, err := s.objects.Open(id)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := s.LocalStore.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Abort()
+		return err
+	}
+	return out.Close()
+}
+
+// Removes objects no file is linked to any more and no snapshot or merge
+// base refers to, so deleted and overwritten contents don't take up space
+// forever. Objects whose links can't be counted are kept.
+func (s *DedupStore) CollectGarbage() error {
+	used, err := NewSnapshots(s.directory).usedObjects()
+	if err != nil {
+		return err
+	}
+	ids, err := s.objects.List()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if used[id] {
+			continue
+		}
+		fi, err := os.Stat(s.objects.path(id))
+		if err != nil {
+			return err
+		}
+		if linkCount(fi) != 1 {
+			continue
+		}
+		if err := s.objects.Remove(id); err != nil {
+			return err
+		}
+		slog.Debug("Removed unlinked object", "id", id)
+	}
+	return nil
+}
+
+type dedupFileWriter struct {
+	store *DedupStore
+	name  string
+	pipe  *io.PipeWriter
+	done  chan struct{}
+	// Set by the object store once the content is stored
+	id  string
+	err error
+}
+
+func (w *dedupFileWriter) Write(b []byte) (int, error) {
+	return w.pipe.Write(b)
+}
+
+func (w *dedupFileWriter) Close() error {
+	w.pipe.Close()
+	<-w.done
+	if w.err != nil {
+		return w.err
+	}
+	return w.store.link(w.id, w.name)
+}
+
+func (w *dedupFileWriter) Abort() error {
+	w.pipe.CloseWithError(errWriteAborted)
+	<-w.done
+	return nil
+}
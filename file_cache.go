@@ -6,52 +6,312 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"os"
-	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 type FileCache struct {
-	data      map[string]fileCacheData
-	directory string
+	data   map[string]fileCacheData
+	byHash map[string]map[string]struct{}
+	// Directories by path, see dirNode
+	dirs  map[string]*dirNode
+	store Store
 }
 
 type fileCacheData struct {
 	md5    string
+	size   int64
 	synced bool
+	// As listed when the cache was created, zero for files written since
+	modTime time.Time
+}
+
+// FileCacheOptions tunes how CreateFileCacheWithOptions scans a directory
+type FileCacheOptions struct {
+	// Number of files hashed at once, GOMAXPROCS if zero
+	HashWorkers int
+	// Called after each file is hashed with the count done so far and the
+	// total. Calls are serialised but come from the hashing goroutines.
+	Progress func(done int, total int, filename string)
+	// Read symlinks that lead outside the directory, for main scanning its
+	// own files. Replicas leave it off so nothing outside is read, and such
+	// symlinks are skipped.
+	FollowSymlinks bool
 }
 
 // Returns a filecached with files scanned
 func CreateFileCache(directory string) (*FileCache, error) {
-	fc := FileCache{directory: directory, data: map[string]fileCacheData{}}
+	return CreateFileCacheWithOptions(directory, FileCacheOptions{})
+}
 
-	c, err := os.ReadDir(directory)
-	if err != nil {
+// Returns a filecache for a directory on disk with files hashed by a pool of
+// workers
+func CreateFileCacheWithOptions(directory string, options FileCacheOptions) (*FileCache, error) {
+	if _, err := os.Stat(directory); err != nil {
 		return nil, errors.Join(errors.New("Failed to open directory"), err)
 	}
+	store := NewLocalStore(directory)
+	store.followSymlinks = options.FollowSymlinks
+	return CreateFileCacheFromStore(store, options)
+}
+
+// Returns a filecache of the .md files in store. The cache is the same
+// whatever the number of workers, and if any files fail an error for each of
+// them is returned.
+func CreateFileCacheFromStore(store Store, options FileCacheOptions) (*FileCache, error) {
+	fc := FileCache{store: store, data: map[string]fileCacheData{}, byHash: map[string]map[string]struct{}{}, dirs: map[string]*dirNode{}}
+
+	files, err := store.List()
+	if err != nil {
+		return nil, errors.Join(errors.New("Failed to list files"), err)
+	}
+
+	var names []string
+	modTimes := map[string]time.Time{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name, ".md") {
+			continue
+		}
+		names = append(names, file.Name)
+		modTimes[file.Name] = file.ModTime
+	}
+	sort.Strings(names)
+
+	workers := options.HashWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, len(names))
+
+	// Each worker writes only its own slots so results stay in name order
+	results := make([]fileCacheData, len(names))
+	errs := make([]error, len(names))
+	next := make(chan int)
+	var progressMu sync.Mutex
+	done := 0
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for i := range next {
+				results[i], errs[i] = hashFile(store, names[i])
+				if options.Progress != nil {
+					progressMu.Lock()
+					done++
+					options.Progress(done, len(names), names[i])
+					progressMu.Unlock()
+				}
+			}
+		})
+	}
+	for i := range names {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		results[i].modTime = modTimes[name]
+		fc.set(name, results[i])
+	}
+	return &fc, nil
+}
+
+func hashFile(store Store, filename string) (fileCacheData, error) {
+	f, err := store.Open(filename)
+	if err != nil {
+		slog.Error("Failed to open file", "path", filename, "error", err)
+		return fileCacheData{}, fmt.Errorf("Failed to open file %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	hashStarted := time.Now()
+	h := md5.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		slog.Error("Failed to hash file", "path", filename, "error", err)
+		return fileCacheData{}, fmt.Errorf("Failed to hash file %s: %w", filename, err)
+	}
+	metrics.hashSeconds.observe(time.Since(hashStarted))
+	return fileCacheData{md5: hex.EncodeToString(h.Sum(nil)), size: size, synced: false}, nil
+}
+
+// Merkle root of the files include accepts, see selectedDirHash. Two caches
+// with the same digest hold exactly the same files.
+func (fc *FileCache) treeDigest(include func(name string) bool) string {
+	if digest := fc.selectedDirHash(rootDir, include); digest != "" {
+		return digest
+	}
+	return emptyDirHash
+}
+
+// Sets the cache entry for filename and keeps the hash index and directory
+// tree in step
+func (fc *FileCache) set(filename string, fcData fileCacheData) {
+	fc.unset(filename)
+	fc.data[filename] = fcData
+	fc.addToTree(filename)
+	if fcData.md5 == "" {
+		return
+	}
+	if fc.byHash[fcData.md5] == nil {
+		fc.byHash[fcData.md5] = map[string]struct{}{}
+	}
+	fc.byHash[fcData.md5][filename] = struct{}{}
+}
+
+// Removes filename from the cache, the hash index and the directory tree
+func (fc *FileCache) unset(filename string) {
+	old, ok := fc.data[filename]
+	if !ok {
+		return
+	}
+	delete(fc.data, filename)
+	fc.removeFromTree(filename)
+	if names, ok := fc.byHash[old.md5]; ok {
+		delete(names, filename)
+		if len(names) == 0 {
+			delete(fc.byHash, old.md5)
+		}
+	}
+}
+
+// Returns the cached files with the given md5 in sorted order so the
+// choice of source file is deterministic
+func (fc *FileCache) filesWithHash(md5 string) []string {
+	names := make([]string, 0, len(fc.byHash[md5]))
+	for name := range fc.byHash[md5] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Stores that keep contents by md5, like DedupStore, can materialise a file
+// from its md5 alone
+type objectLinker interface {
+	LinkObject(name string, md5 string) (int64, error)
+}
+
+// Stores that keep contents after the files using them are gone, like
+// DedupStore, free them at the end of a session
+type garbageCollector interface {
+	CollectGarbage() error
+}
 
-	for _, entry := range c {
-		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".md") {
+// Satisfies filename from a local file with the same md5 instead of having it
+// sent over the wire. A source file nobody has claimed yet this session that
+// canMove accepts is renamed (it would be deleted at the end anyway),
+// otherwise the store links it from its stored object if it can, or it is
+// copied. Returns false if there is no usable local content.
+func (fc *FileCache) reuseLocalFile(filename string, md5 string, canMove func(name string) bool) bool {
+	var source string
+	var size int64
+	unclaimed := false
+	for _, name := range fc.filesWithHash(md5) {
+		if name == filename {
 			continue
 		}
+		if !fc.data[name].synced && canMove(name) {
+			source, unclaimed = name, true
+			break
+		}
+		if source == "" {
+			source = name
+		}
+	}
+	if !unclaimed {
+		if linker, ok := fc.store.(objectLinker); ok {
+			linkedSize, err := linker.LinkObject(filename, md5)
+			if err == nil {
+				slog.Debug("Linked stored object with matching content", "md5", md5, "to", filename)
+				fc.set(filename, fileCacheData{md5: md5, size: linkedSize, synced: true})
+				return true
+			}
+			slog.Debug("Could not link stored object", "md5", md5, "to", filename, "error", err)
+		}
+	}
+	if source == "" {
+		return false
+	}
+	size = fc.data[source].size
 
-		f, err := os.Open(filepath.Join(directory, entry.Name()))
-		if err != nil {
-			slog.Error("Failed to open file", "error", err)
-			return nil, fmt.Errorf("Failed to open file %s: %w", entry.Name(), err)
+	if unclaimed {
+		if err := fc.store.Rename(source, filename); err != nil {
+			slog.Warn("Could not rename local file with matching content", "from", source, "to", filename, "error", err)
+			return false
+		}
+		fc.unset(source)
+		slog.Debug("Renamed local file with matching content", "from", source, "to", filename)
+	} else {
+		if err := fc.copyFile(source, filename); err != nil {
+			slog.Warn("Could not copy local file with matching content", "from", source, "to", filename, "error", err)
+			return false
 		}
+		slog.Debug("Copied local file with matching content", "from", source, "to", filename)
+	}
+	fc.set(filename, fileCacheData{md5: md5, size: size, synced: true})
+	return true
+}
 
-		h := md5.New()
-		if _, err := io.Copy(h, f); err != nil {
-			slog.Error("Failed to hash file", "error", err)
-			f.Close()
-			return nil, fmt.Errorf("Failed to hash file %s: %w", entry.Name(), err)
+// Reads the content of any cached file with the given md5
+func (fc *FileCache) readHash(md5 string) ([]byte, error) {
+	for _, name := range fc.filesWithHash(md5) {
+		if data, err := fc.readFile(name); err == nil {
+			return data, nil
 		}
+	}
+	return nil, fmt.Errorf("%w: no file with md5 %s", fs.ErrNotExist, md5)
+}
 
-		hash := hex.EncodeToString(h.Sum(nil))
-		fc.data[entry.Name()] = fileCacheData{md5: hash, synced: false}
-		f.Close()
+func (fc *FileCache) readFile(filename string) ([]byte, error) {
+	f, err := fc.store.Open(filename)
+	if err != nil {
+		return nil, err
 	}
-	return &fc, nil
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (fc *FileCache) writeFile(filename string, data []byte) error {
+	w, err := fc.store.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+func (fc *FileCache) removeFile(filename string) error {
+	return fc.store.Remove(filename)
+}
+
+func (fc *FileCache) copyFile(src string, dst string) error {
+	in, err := fc.store.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fc.store.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Abort()
+		return err
+	}
+	return out.Close()
 }
@@ -0,0 +1,78 @@
+package filesyncer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateFileCacheWithOptions(t *testing.T) {
+	dir := t.TempDir()
+	for i := range 50 {
+		name := filepath.Join(dir, fmt.Sprintf("file%02d.md", i))
+		assert.NoError(t, os.WriteFile(name, []byte(fmt.Sprintf("content %d", i%10)), 0644))
+	}
+
+	serial, err := CreateFileCacheWithOptions(dir, FileCacheOptions{HashWorkers: 1})
+	assert.NoError(t, err)
+
+	var progress []int
+	parallel, err := CreateFileCacheWithOptions(dir, FileCacheOptions{
+		HashWorkers: 8,
+		Progress: func(done int, total int, filename string) {
+			assert.Equal(t, 50, total)
+			progress = append(progress, done)
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, serial.data, parallel.data)
+	assert.Equal(t, serial.byHash, parallel.byHash)
+	assert.Len(t, progress, 50)
+	assert.Equal(t, 50, progress[len(progress)-1])
+}
+
+func TestCreateFileCacheReportsEveryFailure(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "ok.md"), []byte("ok"), 0644))
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "broken1.md")))
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "broken2.md")))
+
+	fc, err := CreateFileCacheWithOptions(dir, FileCacheOptions{HashWorkers: 2})
+	assert.Nil(t, fc)
+	assert.ErrorContains(t, err, "broken1.md")
+	assert.ErrorContains(t, err, "broken2.md")
+}
+
+// Main reads its own symlinks wherever they lead, while a confined scan skips
+// ones leading outside instead of failing
+func TestCreateFileCacheSymlinkOutside(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "shared.md")
+	assert.NoError(t, os.WriteFile(outside, []byte("# Shared\n"), 0644))
+	mainDir, replicaDir := t.TempDir(), t.TempDir()
+	writeTestFiles(t, mainDir, map[string]string{"a.md": "# A\n"})
+	assert.NoError(t, os.Symlink(outside, filepath.Join(mainDir, "shared.md")))
+	assert.NoError(t, os.Symlink(outside, filepath.Join(replicaDir, "shared.md")))
+
+	confined, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	assert.NotContains(t, confined.data, "shared.md")
+
+	mainFC, err := CreateFileCacheWithOptions(mainDir, FileCacheOptions{FollowSymlinks: true})
+	assert.NoError(t, err)
+	assert.Contains(t, mainFC.data, "shared.md")
+	replicaFC, err := CreateFileCache(replicaDir)
+	assert.NoError(t, err)
+
+	_, replicaReport := runTestSync(t, &Syncer{FileCache: mainFC}, &Syncer{Replica: true, FileCache: replicaFC})
+	assert.Equal(t, ActionReceived, reportActions(replicaReport)["shared.md"])
+	data, err := os.ReadFile(filepath.Join(replicaDir, "shared.md"))
+	assert.NoError(t, err)
+	assert.Equal(t, "# Shared\n", string(data))
+	fi, err := os.Lstat(filepath.Join(replicaDir, "shared.md"))
+	assert.NoError(t, err)
+	assert.True(t, fi.Mode().IsRegular(), "The replica replaces its symlink rather than writing through it")
+}
@@ -0,0 +1,141 @@
+package filesyncer
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+var (
+	ErrIdleTimeout    = errors.New("Connection idle timeout")
+	ErrSessionTimeout = errors.New("Session timeout")
+)
+
+// Largest single write to the connection so the idle deadline is refreshed
+// while big files are still making progress
+const writeChunkSize = 64 * 1024
+
+type deadlineConn interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// Starts the session clock, the heartbeat and the sender answering the other
+// side's pings. The returned func stops them.
+func (s *Syncer) startKeepalive() func() {
+	s.sessionDeadline = time.Time{}
+	if s.SessionTimeout > 0 {
+		s.sessionDeadline = time.Now().Add(s.SessionTimeout)
+	}
+
+	done := make(chan struct{})
+	// One pending pong answers any number of pings, so a stalled peer
+	// holds up a single goroutine however often it pings
+	s.pongs = make(chan struct{}, 1)
+	go s.sendPongs(s.pongs, done)
+	if s.HeartbeatInterval <= 0 {
+		return func() { close(done) }
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.SendMessage(Message{Type: MsgTypePing}); err != nil {
+					slog.Debug("Heartbeat ping failed", "error", err)
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Answers pings queued by the reader. Sent off the reader's goroutine as the
+// other side may be busy writing to us.
+func (s *Syncer) sendPongs(pongs <-chan struct{}, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-pongs:
+			if err := s.SendMessage(Message{Type: MsgTypePong}); err != nil {
+				slog.Debug("Heartbeat pong failed", "error", err)
+				return
+			}
+		}
+	}
+}
+
+// Deadline for the next read or write, zero if there is none
+func (s *Syncer) nextDeadline() time.Time {
+	deadline := s.sessionDeadline
+	if s.IdleTimeout > 0 {
+		idle := time.Now().Add(s.IdleTimeout)
+		if deadline.IsZero() || idle.Before(deadline) {
+			deadline = idle
+		}
+	}
+	return deadline
+}
+
+// Swaps a deadline error for the timeout that caused it
+func (s *Syncer) timeoutError(err error) error {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	if !s.sessionDeadline.IsZero() && !time.Now().Before(s.sessionDeadline) {
+		return errors.Join(ErrSessionTimeout, err)
+	}
+	return errors.Join(ErrIdleTimeout, err)
+}
+
+// Reader over the connection that pushes the read deadline back on every read
+type idleReader struct {
+	s *Syncer
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	if dc, ok := r.s.Conn.(deadlineConn); ok {
+		dc.SetReadDeadline(r.s.nextDeadline())
+	}
+	n, err := r.s.Conn.Read(p)
+	return n, r.s.timeoutError(err)
+}
+
+func (s *Syncer) connReader() io.Reader {
+	return idleReader{s: s}
+}
+
+// Size of the next write to the connection. Throttled writes are no bigger
+// than the throttle's burst and wait at most a second, or half the idle
+// timeout if that is shorter, so none holds writeMu long enough to hold up
+// pings and trip an idle timeout.
+func (s *Syncer) nextChunkSize() int {
+	if s.Throttle == nil {
+		return writeChunkSize
+	}
+	maxWait := time.Second
+	if s.IdleTimeout > 0 {
+		maxWait = min(maxWait, s.IdleTimeout/2)
+	}
+	return s.Throttle.chunkSize(writeChunkSize, maxWait)
+}
+
+// Writes one chunk of a message, throttled, with the write deadline pushed back
+func (s *Syncer) writeChunk(b []byte) (int, error) {
+	if s.Throttle != nil {
+		s.Throttle.Wait(len(b))
+	}
+	if dc, ok := s.Conn.(deadlineConn); ok {
+		dc.SetWriteDeadline(s.nextDeadline())
+	}
+	n, err := s.Conn.Write(b)
+	return n, s.timeoutError(err)
+}
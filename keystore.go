@@ -0,0 +1,163 @@
+package filesyncer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+var ErrKeyDisabled = errors.New("API key is disabled")
+
+// Permission is something a client key is allowed to do on the replica
+type Permission string
+
+const (
+	// Read only sessions, such as diff and verify
+	PermissionPull Permission = "pull"
+	// Changing the replica. Implies pull.
+	PermissionPush Permission = "push"
+)
+
+// ClientKey is one entry in a KeyStore. Clients send "<ID>.<secret>" as their
+// API key and only the SHA-256 of the secret is stored.
+type ClientKey struct {
+	ID           string       `yaml:"id"`
+	SecretSHA256 string       `yaml:"secret_sha256"`
+	Permissions  []Permission `yaml:"permissions"`
+	// Paths the key may sync, relative to the replica directory. Empty means
+	// everything.
+	Paths   []string `yaml:"paths,omitempty"`
+	Enabled bool     `yaml:"enabled"`
+}
+
+func (k *ClientKey) Can(p Permission) bool {
+	if slices.Contains(k.Permissions, p) {
+		return true
+	}
+	return p == PermissionPull && slices.Contains(k.Permissions, PermissionPush)
+}
+
+// Reports if the file name is inside one of the key's allowed paths
+func (k *ClientKey) AllowsPath(name string) bool {
+	if len(k.Paths) == 0 {
+		return true
+	}
+	return withinPaths(name, k.Paths)
+}
+
+// Authenticator checks the API key sent by a main and returns who it is
+type Authenticator interface {
+	Authenticate(key []byte) (*ClientKey, error)
+}
+
+// StaticKey is a single shared API key that gives full access
+type StaticKey string
+
+func (k StaticKey) Authenticate(key []byte) (*ClientKey, error) {
+	if subtle.ConstantTimeCompare(key, []byte(k)) != 1 {
+		return nil, errors.New("Invalid API key")
+	}
+	return &ClientKey{ID: "default", Permissions: []Permission{PermissionPush}, Enabled: true}, nil
+}
+
+// KeyStore is a YAML file of client keys that can be reloaded while the
+// replica is running, so keys can be revoked without a restart
+type KeyStore struct {
+	path string
+	mu   sync.RWMutex
+	keys map[string]ClientKey
+}
+
+type keyStoreFile struct {
+	Keys []ClientKey `yaml:"keys"`
+}
+
+func LoadKeyStore(path string) (*KeyStore, error) {
+	ks := &KeyStore{path: path}
+	if err := ks.Reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Re-reads the key store file. The keys in use are left alone if it fails.
+func (ks *KeyStore) Reload() error {
+	data, err := os.ReadFile(ks.path)
+	if err != nil {
+		return fmt.Errorf("failed to read key store: %w", err)
+	}
+	var file keyStoreFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse key store %s: %w", ks.path, err)
+	}
+
+	keys := map[string]ClientKey{}
+	for _, key := range file.Keys {
+		if key.ID == "" || strings.Contains(key.ID, ".") {
+			return fmt.Errorf("key store %s has an invalid key id %q", ks.path, key.ID)
+		}
+		if _, dup := keys[key.ID]; dup {
+			return fmt.Errorf("key store %s has duplicate key id %q", ks.path, key.ID)
+		}
+		if digest, err := hex.DecodeString(key.SecretSHA256); err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("key store %s has an invalid secret_sha256 for key %q", ks.path, key.ID)
+		}
+		keys[key.ID] = key
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.mu.Unlock()
+	return nil
+}
+
+func (ks *KeyStore) Authenticate(key []byte) (*ClientKey, error) {
+	id, secret, ok := strings.Cut(string(key), ".")
+	if !ok {
+		return nil, errors.New("API key is not in <id>.<secret> form")
+	}
+
+	ks.mu.RLock()
+	entry, found := ks.keys[id]
+	ks.mu.RUnlock()
+
+	// Hash and compare even for unknown ids so they take as long as bad secrets
+	expected, _ := hex.DecodeString(entry.SecretSHA256)
+	if len(expected) != sha256.Size {
+		expected = make([]byte, sha256.Size)
+	}
+	got := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(got[:], expected) != 1 || !found {
+		return nil, fmt.Errorf("Invalid API key for id %q", id)
+	}
+	if !entry.Enabled {
+		return nil, fmt.Errorf("%w: %q", ErrKeyDisabled, id)
+	}
+	return &entry, nil
+}
+
+// GenerateClientKey makes a new random key for id. The key goes to the client,
+// the entry into the replica's key store.
+func GenerateClientKey(id string, permissions ...Permission) (string, ClientKey, error) {
+	if id == "" || strings.Contains(id, ".") {
+		return "", ClientKey{}, fmt.Errorf("invalid key id %q", id)
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", ClientKey{}, err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+	digest := sha256.Sum256([]byte(secret))
+	entry := ClientKey{ID: id, SecretSHA256: hex.EncodeToString(digest[:]), Permissions: permissions, Enabled: true}
+	return id + "." + secret, entry, nil
+}
@@ -0,0 +1,59 @@
+package filesyncer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func writeKeyStore(t *testing.T, path string, keys ...ClientKey) {
+	t.Helper()
+	data, err := yaml.Marshal(keyStoreFile{Keys: keys})
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, data, 0600))
+}
+
+func TestKeyStoreAuthenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	laptopKey, laptop, err := GenerateClientKey("laptop", PermissionPush)
+	assert.NoError(t, err)
+	ciKey, ci, err := GenerateClientKey("ci", PermissionPull)
+	assert.NoError(t, err)
+	ci.Enabled = false
+	writeKeyStore(t, path, laptop, ci)
+
+	ks, err := LoadKeyStore(path)
+	assert.NoError(t, err)
+
+	client, err := ks.Authenticate([]byte(laptopKey))
+	assert.NoError(t, err)
+	assert.Equal(t, "laptop", client.ID)
+	assert.True(t, client.Can(PermissionPush))
+	assert.True(t, client.Can(PermissionPull), "push should imply pull")
+
+	_, err = ks.Authenticate([]byte("laptop.wrong-secret"))
+	assert.Error(t, err)
+	_, err = ks.Authenticate([]byte("nobody.secret"))
+	assert.Error(t, err)
+	_, err = ks.Authenticate([]byte(ciKey))
+	assert.ErrorIs(t, err, ErrKeyDisabled)
+
+	// Revoke the laptop key and reload
+	laptop.Enabled = false
+	writeKeyStore(t, path, laptop, ci)
+	assert.NoError(t, ks.Reload())
+	_, err = ks.Authenticate([]byte(laptopKey))
+	assert.ErrorIs(t, err, ErrKeyDisabled)
+}
+
+func TestClientKeyAllowsPath(t *testing.T) {
+	key := ClientKey{Paths: []string{"notes/", "todo.md"}}
+	assert.True(t, key.AllowsPath("notes/a.md"))
+	assert.True(t, key.AllowsPath("todo.md"))
+	assert.False(t, key.AllowsPath("notes.md"))
+	assert.False(t, key.AllowsPath("other/a.md"))
+	assert.True(t, (&ClientKey{}).AllowsPath("anything.md"))
+}
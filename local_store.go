@@ -0,0 +1,196 @@
+package filesyncer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// LocalStore keeps files in a directory on disk. Every operation goes through
+// an os.Root so nothing can reach outside the directory, symlinks included,
+// unless reads are set to follow symlinks.
+type LocalStore struct {
+	directory string
+	// Opens files by their path on disk so symlinks leading outside the
+	// directory are read, as main reading its own files may. Writes are
+	// confined either way.
+	followSymlinks bool
+}
+
+func NewLocalStore(directory string) *LocalStore {
+	return &LocalStore{directory: directory}
+}
+
+func (s *LocalStore) openRoot() (*os.Root, error) {
+	return os.OpenRoot(s.directory)
+}
+
+func (s *LocalStore) List() ([]FileInfo, error) {
+	root, err := s.openRoot()
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+
+	var files []FileInfo
+	err = fs.WalkDir(root.FS(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if name == StateDirName {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		// Symlinks are listed as is and fail later if they lead nowhere.
+		// Ones leading outside the directory can't be read when confined,
+		// so they are skipped rather than failing the whole scan.
+		if d.Type()&fs.ModeSymlink != 0 && !s.followSymlinks && s.leadsOutside(root, name) {
+			slog.Warn("Skipping symlink that leads outside the directory", "path", name)
+			return nil
+		}
+		info := FileInfo{Name: name}
+		if fi, err := d.Info(); err == nil {
+			info.Size, info.ModTime = fi.Size(), fi.ModTime()
+		}
+		files = append(files, info)
+		return nil
+	})
+	return files, err
+}
+
+// True if the symlink name resolves, but only by leaving the directory
+func (s *LocalStore) leadsOutside(root *os.Root, name string) bool {
+	if _, err := root.Stat(name); err == nil {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(s.directory, filepath.FromSlash(name)))
+	return err == nil
+}
+
+func (s *LocalStore) Stat(name string) (FileInfo, error) {
+	root, err := s.openRoot()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer root.Close()
+	fi, err := root.Stat(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *LocalStore) Open(name string) (io.ReadCloser, error) {
+	if s.followSymlinks {
+		if err := ValidateFileName(name); err != nil {
+			return nil, err
+		}
+		return os.Open(filepath.Join(s.directory, filepath.FromSlash(name)))
+	}
+	root, err := s.openRoot()
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.Open(name)
+}
+
+// Writes to a hidden temporary file next to name which is renamed over it on
+// Close, so readers never see half a file
+func (s *LocalStore) Create(name string) (FileWriter, error) {
+	root, err := s.openRoot()
+	if err != nil {
+		return nil, err
+	}
+	if dir := path.Dir(name); dir != "." {
+		if err := root.MkdirAll(dir, 0755); err != nil {
+			root.Close()
+			return nil, err
+		}
+	}
+
+	tmp := tempName(name)
+	f, err := root.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		root.Close()
+		return nil, err
+	}
+	return &localFileWriter{root: root, file: f, tmp: tmp, name: name}, nil
+}
+
+// A hidden name next to name for content that isn't ready to be seen yet
+func tempName(name string) string {
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	return path.Join(path.Dir(name), "."+path.Base(name)+".tmp-"+hex.EncodeToString(suffix))
+}
+
+func (s *LocalStore) Rename(from string, to string) error {
+	root, err := s.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	if dir := path.Dir(to); dir != "." {
+		if err := root.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return root.Rename(from, to)
+}
+
+// Removes name and then any directories above it it leaves empty
+func (s *LocalStore) Remove(name string) error {
+	root, err := s.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	if err := root.Remove(name); err != nil {
+		return err
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		// Fails on the first directory that still has something in it
+		if root.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+type localFileWriter struct {
+	root *os.Root
+	file *os.File
+	tmp  string
+	name string
+}
+
+func (w *localFileWriter) Write(b []byte) (int, error) {
+	return w.file.Write(b)
+}
+
+func (w *localFileWriter) Close() error {
+	defer w.root.Close()
+	if err := w.file.Close(); err != nil {
+		w.root.Remove(w.tmp)
+		return err
+	}
+	if err := w.root.Rename(w.tmp, w.name); err != nil {
+		w.root.Remove(w.tmp)
+		return err
+	}
+	return nil
+}
+
+func (w *localFileWriter) Abort() error {
+	defer w.root.Close()
+	return errors.Join(w.file.Close(), w.root.Remove(w.tmp))
+}
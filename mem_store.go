@@ -0,0 +1,111 @@
+package filesyncer
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemStore keeps files in memory. It is meant for tests.
+type MemStore struct {
+	mu    sync.Mutex
+	files map[string]memFile
+	now   func() time.Time
+}
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{files: map[string]memFile{}, now: time.Now}
+}
+
+func (s *MemStore) List() ([]FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := make([]FileInfo, 0, len(s.files))
+	for name, f := range s.files {
+		if name == StateDirName || strings.HasPrefix(name, StateDirName+"/") {
+			continue
+		}
+		files = append(files, FileInfo{Name: name, Size: int64(len(f.data)), ModTime: f.modTime})
+	}
+	return files, nil
+}
+
+func (s *MemStore) Stat(name string) (FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[name]
+	if !ok {
+		return FileInfo{}, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return FileInfo{Name: name, Size: int64(len(f.data)), ModTime: f.modTime}, nil
+}
+
+func (s *MemStore) Open(name string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return io.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+func (s *MemStore) Create(name string) (FileWriter, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	return &memFileWriter{store: s, name: name}, nil
+}
+
+func (s *MemStore) Rename(from string, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[from]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: from, Err: fs.ErrNotExist}
+	}
+	delete(s.files, from)
+	s.files[path.Clean(to)] = f
+	return nil
+}
+
+func (s *MemStore) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(s.files, name)
+	return nil
+}
+
+type memFileWriter struct {
+	store *MemStore
+	name  string
+	buf   bytes.Buffer
+}
+
+func (w *memFileWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+func (w *memFileWriter) Close() error {
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	w.store.files[w.name] = memFile{data: bytes.Clone(w.buf.Bytes()), modTime: w.store.now()}
+	return nil
+}
+
+func (w *memFileWriter) Abort() error {
+	w.buf.Reset()
+	return nil
+}
@@ -0,0 +1,203 @@
+package filesyncer
+
+import (
+	"bytes"
+	"slices"
+)
+
+// Most lines matchLines will insert or delete looking for the shortest
+// edit script before it treats what is left as entirely changed. Bounds the
+// time and memory spent on files that were rewritten wholesale.
+const maxDiffEdits = 2000
+
+const (
+	conflictStart  = "<<<<<<< replica\n"
+	conflictMiddle = "=======\n"
+	conflictEnd    = ">>>>>>> main\n"
+)
+
+// Three way merges the replica's and main's versions of a file line by line
+// against the base they both started from. Changes to different lines are
+// both kept. Where the two changed the same lines differently both versions
+// are written between conflict markers and conflict is true.
+func merge3(base []byte, replica []byte, main []byte) ([]byte, bool) {
+	o, a, b := splitLines(base), splitLines(replica), splitLines(main)
+	matchA, matchB := matchLines(o, a), matchLines(o, b)
+
+	var out bytes.Buffer
+	conflict := false
+	i, j, k := 0, 0, 0
+	for i < len(o) || j < len(a) || k < len(b) {
+		// Lines neither side touched are copied straight through
+		n := 0
+		for i+n < len(o) && matchA[i+n] == j+n && matchB[i+n] == k+n {
+			n++
+		}
+		if n > 0 {
+			writeLines(&out, o[i:i+n])
+			i, j, k = i+n, j+n, k+n
+			continue
+		}
+
+		// Otherwise the changed chunk runs up to the next base line both
+		// sides kept
+		ni, nj, nk := len(o), len(a), len(b)
+		for x := i; x < len(o); x++ {
+			if matchA[x] >= 0 && matchB[x] >= 0 {
+				ni, nj, nk = x, matchA[x], matchB[x]
+				break
+			}
+		}
+		if mergeChunk(&out, o[i:ni], a[j:nj], b[k:nk]) {
+			conflict = true
+		}
+		i, j, k = ni, nj, nk
+	}
+	return out.Bytes(), conflict
+}
+
+// Writes whichever side changed the chunk, or both between conflict markers
+// if both did. Returns true for a conflict.
+func mergeChunk(out *bytes.Buffer, base []string, replica []string, main []string) bool {
+	switch {
+	case slices.Equal(replica, base):
+		writeLines(out, main)
+	case slices.Equal(main, base), slices.Equal(replica, main):
+		writeLines(out, replica)
+	default:
+		out.WriteString(conflictStart)
+		writeConflictSide(out, replica)
+		out.WriteString(conflictMiddle)
+		writeConflictSide(out, main)
+		out.WriteString(conflictEnd)
+		return true
+	}
+	return false
+}
+
+func writeLines(out *bytes.Buffer, lines []string) {
+	for _, line := range lines {
+		out.WriteString(line)
+	}
+}
+
+// Markers must start on their own line even if the file didn't end in one
+func writeConflictSide(out *bytes.Buffer, lines []string) {
+	writeLines(out, lines)
+	if n := len(lines); n > 0 && lines[n-1][len(lines[n-1])-1] != '\n' {
+		out.WriteByte('\n')
+	}
+}
+
+// Splits data into lines, each keeping its newline
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			lines = append(lines, string(data))
+			break
+		}
+		lines = append(lines, string(data[:i+1]))
+		data = data[i+1:]
+	}
+	return lines
+}
+
+// Returns, for every line of a, the index of the line of b it is kept as in
+// a shortest edit script from a to b, or -1 if it was deleted
+func matchLines(a []string, b []string) []int {
+	match := make([]int, len(a))
+	for i := range match {
+		match[i] = -1
+	}
+
+	// Edits tend to be small, so the common ends are matched up front
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		match[prefix] = prefix
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		match[len(a)-1-suffix] = len(b) - 1 - suffix
+		suffix++
+	}
+
+	myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix], func(x int, y int) {
+		match[prefix+x] = prefix + y
+	})
+	return match
+}
+
+// Finds a shortest edit script from a to b with Myers' algorithm, calling
+// equal for every pair of lines it keeps. Gives up without matching anything
+// if more than maxDiffEdits edits are needed.
+func myersDiff(a []string, b []string, equal func(x int, y int)) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return
+	}
+	offset := n + m
+	v := make([]int, 2*offset+2)
+	// The furthest point reached on each diagonal after each round, only
+	// diagonals -d to d can have been reached in round d
+	var trace [][]int
+
+	found := false
+	for d := 0; d <= n+m && d <= maxDiffEdits && !found; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+		trace = append(trace, slices.Clone(v[offset-d:offset+d+1]))
+	}
+	if !found {
+		return
+	}
+
+	// Walk back from the end, reporting the diagonal runs of equal lines
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		reached := func(k int) int { return prev[k+d-1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && reached(k-1) < reached(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := reached(prevK)
+		prevY := prevX - prevK
+		startX := prevX
+		if prevK == k-1 {
+			startX++
+		}
+		for x > startX {
+			x--
+			y--
+			equal(x, y)
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		equal(x, y)
+	}
+}
@@ -0,0 +1,176 @@
+package filesyncer
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+const mergeBaseFileName = "merge-base.json"
+
+// MergeBases remembers the content every file had at the end of the last
+// merge session on a replica. That is the common ancestor later changes on
+// main and on the replica are merged against. The contents are kept in the
+// ObjectStore of the directory so snapshots and bases share them.
+type MergeBases struct {
+	path    string
+	objects *ObjectStore
+}
+
+func NewMergeBases(directory string) *MergeBases {
+	return &MergeBases{
+		path:    filepath.Join(directory, StateDirName, mergeBaseFileName),
+		objects: NewObjectStore(directory),
+	}
+}
+
+// Returns the md5 of the base of each file by path. Empty before the first
+// merge session.
+func (b *MergeBases) Load() (map[string]string, error) {
+	data, err := os.ReadFile(b.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	bases := map[string]string{}
+	if err := json.Unmarshal(data, &bases); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to parse %s", mergeBaseFileName), err)
+	}
+	return bases, nil
+}
+
+// Reads the base content with the given md5
+func (b *MergeBases) read(id string) ([]byte, error) {
+	f, err := b.objects.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (b *MergeBases) save(bases map[string]string) error {
+	dir := filepath.Dir(b.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(bases, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a crash never leaves a half written file
+	tmp, err := os.CreateTemp(dir, mergeBaseFileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.path)
+}
+
+// Records the bases the session left behind. Files main sent or confirmed
+// take main's content as their new base, stored from the replica's copy if
+// the object store lacks it. Files that failed keep their old base and files
+// that are gone lose theirs.
+func (s *Syncer) saveMergeBases(rs *replicaState) error {
+	bases := map[string]string{}
+	for name, md5 := range rs.bases {
+		if _, ok := s.FileCache.data[name]; ok {
+			bases[name] = md5
+		} else if _, ok := rs.checked[name]; ok {
+			bases[name] = md5
+		}
+	}
+	for name, md5 := range rs.checked {
+		fcData, ok := s.FileCache.data[name]
+		if !ok || !fcData.synced {
+			continue
+		}
+		if !s.MergeBases.objects.Has(md5) {
+			// Only a file holding exactly main's content can provide it
+			if fcData.md5 != md5 {
+				continue
+			}
+			f, err := s.FileCache.store.Open(name)
+			if err != nil {
+				return fmt.Errorf("failed to read %s for its merge base: %w", name, err)
+			}
+			stored, _, err := s.MergeBases.objects.Put(f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("failed to store merge base of %s: %w", name, err)
+			}
+			// Changed since it was hashed, so it isn't main's content
+			if stored != md5 {
+				continue
+			}
+		}
+		bases[name] = md5
+	}
+	return s.MergeBases.save(bases)
+}
+
+// Merges main's version of a file into the replica's, both changed since
+// base. On a conflict the file gets conflict markers and each version is
+// kept beside it as <name>.main and <name>.replica, which are never synced.
+func (s *Syncer) mergeFile(msg Message, base string) writeResult {
+	r := writeResult{msg: msg}
+	if err := ValidateFileName(msg.FileName); err != nil {
+		r.err = err
+		return r
+	}
+	baseData, err := s.MergeBases.read(base)
+	if err != nil {
+		r.err = fmt.Errorf("failed to read merge base of %s: %w", msg.FileName, err)
+		return r
+	}
+	replicaData, err := s.FileCache.readFile(msg.FileName)
+	if err != nil {
+		r.err = fmt.Errorf("failed to read %s to merge: %w", msg.FileName, err)
+		return r
+	}
+	merged, conflict := merge3(baseData, replicaData, msg.Data)
+
+	// Main's version is what the next merge starts from
+	if _, _, err := s.MergeBases.objects.Put(bytes.NewReader(msg.Data)); err != nil {
+		r.err = fmt.Errorf("failed to store merge base of %s: %w", msg.FileName, err)
+		return r
+	}
+	r.action = ActionMerged
+	if conflict {
+		r.action = ActionConflict
+		if err := s.FileCache.writeFile(msg.FileName+".main", msg.Data); err != nil {
+			r.err = err
+			return r
+		}
+		if err := s.FileCache.writeFile(msg.FileName+".replica", replicaData); err != nil {
+			r.err = err
+			return r
+		}
+	}
+	if err := s.FileCache.writeFile(msg.FileName, merged); err != nil {
+		r.err = errors.Join(fmt.Errorf("failed to write merged %s", msg.FileName), err)
+		return r
+	}
+	sum := md5.Sum(merged)
+	r.md5, r.size = hex.EncodeToString(sum[:]), int64(len(merged))
+	slog.Debug("Replica merged file", "filename", msg.FileName, "conflict", conflict)
+	return r
+}
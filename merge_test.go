@@ -0,0 +1,150 @@
+package filesyncer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerge3(t *testing.T) {
+	base := "# Title\n\nintro\n\n## A\n\na text\n\n## B\n\nb text\n"
+	tests := []struct {
+		name string
+		// Defaults to base
+		base     string
+		replica  string
+		main     string
+		expected string
+		conflict bool
+	}{
+		{
+			name:     "Different sections",
+			replica:  strings.Replace(base, "a text", "a text edited on the replica", 1),
+			main:     strings.Replace(base, "b text", "b text edited on main", 1),
+			expected: "# Title\n\nintro\n\n## A\n\na text edited on the replica\n\n## B\n\nb text edited on main\n",
+		},
+		{
+			name:     "Insertions at both ends",
+			replica:  "replica header\n" + base,
+			main:     base + "main footer\n",
+			expected: "replica header\n" + base + "main footer\n",
+		},
+		{
+			name:     "Same edit on both sides",
+			replica:  strings.Replace(base, "intro", "better intro", 1),
+			main:     strings.Replace(base, "intro", "better intro", 1),
+			expected: strings.Replace(base, "intro", "better intro", 1),
+		},
+		{
+			name:     "Deletion and unrelated edit",
+			replica:  strings.Replace(base, "## B\n\nb text\n", "", 1),
+			main:     strings.Replace(base, "# Title", "# New title", 1),
+			expected: "# New title\n\nintro\n\n## A\n\na text\n\n",
+		},
+		{
+			name:     "Overlapping edits",
+			replica:  strings.Replace(base, "a text", "replica a", 1),
+			main:     strings.Replace(base, "a text", "main a", 1),
+			expected: "# Title\n\nintro\n\n## A\n\n<<<<<<< replica\nreplica a\n=======\nmain a\n>>>>>>> main\n\n## B\n\nb text\n",
+			conflict: true,
+		},
+		{
+			name:     "Conflict without a trailing newline",
+			base:     "one\ntwo",
+			replica:  "one\nreplica",
+			main:     "one\nmain",
+			expected: "one\n<<<<<<< replica\nreplica\n=======\nmain\n>>>>>>> main\n",
+			conflict: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.base
+			if b == "" {
+				b = base
+			}
+			merged, conflict := merge3([]byte(b), []byte(tt.replica), []byte(tt.main))
+			assert.Equal(t, tt.expected, string(merged))
+			assert.Equal(t, tt.conflict, conflict)
+		})
+	}
+}
+
+// Changes made on both sides since the last merge session are merged, and
+// overlapping ones are reported as conflicts with each version kept
+func TestSyncerMerge(t *testing.T) {
+	mainDir, replicaDir := t.TempDir(), t.TempDir()
+	sync := func() (*SyncReport, *SyncReport) {
+		mainFC, err := CreateFileCache(mainDir)
+		assert.NoError(t, err)
+		replicaFC, err := CreateFileCache(replicaDir)
+		assert.NoError(t, err)
+		return runTestSync(t,
+			&Syncer{FileCache: mainFC, Options: SessionOptions{Merge: true}},
+			&Syncer{Replica: true, FileCache: replicaFC, MergeBases: NewMergeBases(replicaDir)},
+		)
+	}
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(replicaDir, name))
+		assert.NoError(t, err)
+		return string(data)
+	}
+
+	writeTestFiles(t, mainDir, map[string]string{
+		"clean.md":    "one\ntwo\nthree\n",
+		"conflict.md": "one\ntwo\nthree\n",
+		"kept.md":     "one\n",
+		"plain.md":    "one\n",
+	})
+	sync()
+
+	writeTestFiles(t, mainDir, map[string]string{
+		"clean.md":    "one\ntwo\nthree main\n",
+		"conflict.md": "one main\ntwo\nthree\n",
+		"plain.md":    "one main\n",
+	})
+	writeTestFiles(t, replicaDir, map[string]string{
+		"clean.md":    "one replica\ntwo\nthree\n",
+		"conflict.md": "one replica\ntwo\nthree\n",
+		"kept.md":     "one replica\n",
+	})
+	mainReport, replicaReport := sync()
+	assert.Equal(t, map[string]FileAction{
+		"clean.md":    ActionMerged,
+		"conflict.md": ActionConflict,
+		"kept.md":     ActionKept,
+		"plain.md":    ActionReceived,
+	}, reportActions(replicaReport))
+	assert.Equal(t, ActionMerged, reportActions(mainReport)["clean.md"])
+	assert.Equal(t, ActionConflict, reportActions(mainReport)["conflict.md"])
+
+	assert.Equal(t, "one replica\ntwo\nthree main\n", read("clean.md"))
+	assert.Equal(t, "<<<<<<< replica\none replica\n=======\none main\n>>>>>>> main\ntwo\nthree\n", read("conflict.md"))
+	assert.Equal(t, "one main\ntwo\nthree\n", read("conflict.md.main"))
+	assert.Equal(t, "one replica\ntwo\nthree\n", read("conflict.md.replica"))
+	assert.Equal(t, "one replica\n", read("kept.md"))
+	assert.Equal(t, "one main\n", read("plain.md"))
+
+	// Main's version is the new base, so the merged files are left alone
+	// until main changes them again
+	_, replicaReport = sync()
+	assert.Equal(t, map[string]FileAction{
+		"clean.md":    ActionKept,
+		"conflict.md": ActionKept,
+		"kept.md":     ActionKept,
+		"plain.md":    ActionUnchanged,
+	}, reportActions(replicaReport))
+
+	// Without merge bases the replica refuses to merge
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	replicaFC, err := CreateFileCache(replicaDir)
+	assert.NoError(t, err)
+	mainSyncer := &Syncer{FileCache: mainFC, Options: SessionOptions{Merge: true}}
+	runTestSync(t, mainSyncer, &Syncer{Replica: true, FileCache: replicaFC})
+	assert.False(t, mainSyncer.Options.Merge)
+	assert.Equal(t, "one\n", read("kept.md"))
+}
@@ -0,0 +1,201 @@
+package filesyncer
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// The directory the rest of a FileCache's tree hangs off
+const rootDir = "."
+
+// A directory in the FileCache's Merkle tree. Its hash covers the name and
+// hash of everything in it, so two caches agree on a directory's hash
+// exactly when they hold the same files under it. Conflict copies only ever
+// exist on the replica so they are left out, otherwise the directories above
+// one would never match main again.
+type dirNode struct {
+	// Full names of the files and directories directly inside it
+	files   map[string]struct{}
+	subdirs map[string]struct{}
+	// Worked out when first asked for and cleared whenever anything under
+	// the directory changes
+	hash string
+}
+
+// Hash of a directory with nothing in it, which is also what directories
+// the cache doesn't have hash to
+var emptyDirHash = hashDirEntries(nil)
+
+// Adds a newly cached file to its directory, creating any directories
+// above it that didn't exist yet
+func (fc *FileCache) addToTree(filename string) {
+	if isConflictCopy(filename) {
+		return
+	}
+	child, dir := filename, path.Dir(filename)
+	isFile := true
+	for {
+		node, ok := fc.dirs[dir]
+		if !ok {
+			node = &dirNode{files: map[string]struct{}{}, subdirs: map[string]struct{}{}}
+			fc.dirs[dir] = node
+		}
+		if isFile {
+			node.files[child] = struct{}{}
+		} else {
+			node.subdirs[child] = struct{}{}
+		}
+		if ok || dir == rootDir {
+			break
+		}
+		child, dir, isFile = dir, path.Dir(dir), false
+	}
+	fc.invalidateTree(filename)
+}
+
+// Removes a file from its directory, along with directories left empty
+func (fc *FileCache) removeFromTree(filename string) {
+	if isConflictCopy(filename) {
+		return
+	}
+	fc.invalidateTree(filename)
+	child, dir := filename, path.Dir(filename)
+	isFile := true
+	for {
+		node, ok := fc.dirs[dir]
+		if !ok {
+			return
+		}
+		if isFile {
+			delete(node.files, child)
+		} else {
+			delete(node.subdirs, child)
+		}
+		if len(node.files) > 0 || len(node.subdirs) > 0 || dir == rootDir {
+			return
+		}
+		delete(fc.dirs, dir)
+		child, dir, isFile = dir, path.Dir(dir), false
+	}
+}
+
+// Clears the hash of every directory above filename
+func (fc *FileCache) invalidateTree(filename string) {
+	for dir := path.Dir(filename); ; dir = path.Dir(dir) {
+		if node, ok := fc.dirs[dir]; ok {
+			node.hash = ""
+		}
+		if dir == rootDir {
+			return
+		}
+	}
+}
+
+// Merkle hash of everything under dir, emptyDirHash if there is nothing
+func (fc *FileCache) dirHash(dir string) string {
+	node, ok := fc.dirs[dir]
+	if !ok {
+		return emptyDirHash
+	}
+	if node.hash != "" {
+		return node.hash
+	}
+	entries := make([]string, 0, len(node.files)+len(node.subdirs))
+	for name := range node.files {
+		entries = append(entries, fileEntry(name, fc.data[name].md5))
+	}
+	for name := range node.subdirs {
+		entries = append(entries, dirEntry(name, fc.dirHash(name)))
+	}
+	node.hash = hashDirEntries(entries)
+	return node.hash
+}
+
+// dirHash of dir as if the tree only held the files include accepts. A
+// directory include accepts is taken whole, using its cached hash, so
+// include must accept everything under any directory it accepts. Empty if
+// nothing under dir is accepted.
+func (fc *FileCache) selectedDirHash(dir string, include func(name string) bool) string {
+	node, ok := fc.dirs[dir]
+	if !ok {
+		return ""
+	}
+	if include(dir) {
+		return fc.dirHash(dir)
+	}
+	var entries []string
+	for name := range node.files {
+		if include(name) {
+			entries = append(entries, fileEntry(name, fc.data[name].md5))
+		}
+	}
+	for name := range node.subdirs {
+		if hash := fc.selectedDirHash(name, include); hash != "" {
+			entries = append(entries, dirEntry(name, hash))
+		}
+	}
+	if len(entries) == 0 {
+		return ""
+	}
+	return hashDirEntries(entries)
+}
+
+func fileEntry(name string, md5 string) string {
+	return fmt.Sprintf("f %s\x00%s\n", path.Base(name), md5)
+}
+
+func dirEntry(name string, hash string) string {
+	return fmt.Sprintf("d %s\x00%s\n", path.Base(name), hash)
+}
+
+func hashDirEntries(entries []string) string {
+	sort.Strings(entries)
+	h := md5.New()
+	for _, entry := range entries {
+		h.Write([]byte(entry))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// The files and directories directly inside dir, each sorted
+func (fc *FileCache) dirEntries(dir string) ([]string, []string) {
+	node, ok := fc.dirs[dir]
+	if !ok {
+		return nil, nil
+	}
+	files := make([]string, 0, len(node.files))
+	for name := range node.files {
+		files = append(files, name)
+	}
+	subdirs := make([]string, 0, len(node.subdirs))
+	for name := range node.subdirs {
+		subdirs = append(subdirs, name)
+	}
+	sort.Strings(files)
+	sort.Strings(subdirs)
+	return files, subdirs
+}
+
+// Every file under dir, in no particular order
+func (fc *FileCache) filesUnder(dir string) []string {
+	node, ok := fc.dirs[dir]
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, len(node.files))
+	for name := range node.files {
+		names = append(names, name)
+	}
+	for subdir := range node.subdirs {
+		names = append(names, fc.filesUnder(subdir)...)
+	}
+	return names
+}
+
+func (fc *FileCache) isDir(name string) bool {
+	_, ok := fc.dirs[name]
+	return ok
+}
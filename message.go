@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"strconv"
+	"time"
 )
 
 type MsgType byte
@@ -17,30 +19,66 @@ const (
 	MsgTypeAuth      MsgType = 'A'
 	MsgTypeAuthOK    MsgType = 'O'
 	MsgTypeAuthFail  MsgType = 'X'
+	MsgTypeError     MsgType = 'E'
+	MsgTypePing      MsgType = 'P'
+	MsgTypePong      MsgType = 'Q'
+	MsgTypeDeleted   MsgType = 'R'
+	MsgTypeHello     MsgType = 'H'
+	MsgTypeAck       MsgType = 'K'
+	MsgTypeLink      MsgType = 'L'
+	// Compares the Merkle hash of a directory rather than a single file
+	MsgTypeTree MsgType = 'T'
 )
 
 // Phat struct
 type Message struct {
 	Type     MsgType
 	FileName string
-	Data     []byte
-	MD5      string
-	Match    bool
+	// Request ID tying checks, data, acks and errors for one file together
+	// so several can be in flight at once. Zero for errors about no request.
+	ID   uint64
+	Data []byte
+	// Of the file on checks and links, the directory on trees and the whole
+	// tree on finishes
+	MD5     string
+	Match   bool
+	ErrCode ErrCode
+	ErrText string
+	// What the replica made of the file, on acks for files it didn't simply
+	// write and on matches for files it kept its own version of
+	Action FileAction
+	// When main's copy was last modified, on checks. Zero if unknown.
+	ModTime time.Time
 }
 
 func (msg *Message) AsBytesBuf() []byte {
 	buf := []byte{}
 
 	switch msg.Type {
-	case MsgTypeFinish, MsgTypeAuthOK, MsgTypeAuthFail:
+	case MsgTypeFinish:
+		buf = fmt.Appendf(buf, "%c:,%s", msg.Type, msg.MD5)
+
+	case MsgTypeAuthOK, MsgTypeAuthFail, MsgTypePing, MsgTypePong:
 		buf = fmt.Appendf(buf, "%c:,", msg.Type)
 
-	case MsgTypeAuth:
+	case MsgTypeAuth, MsgTypeHello:
 		buf = fmt.Appendf(buf, "%c:,", msg.Type)
 		buf = append(buf, msg.Data...)
 
-	case MsgTypeCheck:
-		buf = fmt.Appendf(buf, "%c:%s,%s", msg.Type, msg.FileName, msg.MD5)
+	case MsgTypeCheck, MsgTypeLink, MsgTypeTree:
+		buf = fmt.Appendf(buf, "%c:%s,%d,%s", msg.Type, msg.FileName, msg.ID, msg.MD5)
+		if msg.Type == MsgTypeCheck && !msg.ModTime.IsZero() {
+			buf = fmt.Appendf(buf, ",%d", msg.ModTime.UnixNano())
+		}
+
+	case MsgTypeAck:
+		buf = fmt.Appendf(buf, "%c:%s,%d", msg.Type, msg.FileName, msg.ID)
+		if msg.Action != "" {
+			buf = fmt.Appendf(buf, ",%s", msg.Action)
+		}
+
+	case MsgTypeDeleted:
+		buf = fmt.Appendf(buf, "%c:%s,", msg.Type, msg.FileName)
 
 	case MsgTypeMatch:
 		matchValue := 0
@@ -48,12 +86,18 @@ func (msg *Message) AsBytesBuf() []byte {
 			matchValue = 1
 		}
 
-		buf = fmt.Appendf(buf, "%c:%s,%d", msg.Type, msg.FileName, matchValue)
+		buf = fmt.Appendf(buf, "%c:%s,%d,%d", msg.Type, msg.FileName, msg.ID, matchValue)
+		if msg.Action != "" {
+			buf = fmt.Appendf(buf, ",%s", msg.Action)
+		}
 
 	case MsgTypeData:
-		buf = fmt.Appendf(buf, "%c:%s,", msg.Type, msg.FileName)
+		buf = fmt.Appendf(buf, "%c:%s,%d,", msg.Type, msg.FileName, msg.ID)
 		buf = append(buf, msg.Data...)
 
+	case MsgTypeError:
+		buf = fmt.Appendf(buf, "%c:%s,%d,%s,%s", msg.Type, msg.FileName, msg.ID, msg.ErrCode, msg.ErrText)
+
 	case MsgTypeUndefined:
 		// Leaving this panic here like an assert
 		panic("Got undefined Msg type when trying to create msg buf. This shouldn't happen.")
@@ -86,39 +130,116 @@ func ParseMessage(msgStream []byte) (Message, error) {
 	switch MsgType(msgStream[0]) {
 	case MsgTypeFinish:
 		msg.Type = MsgTypeFinish
+		msg.MD5 = string(split[1][:len(split[1])-1])
 
 	case MsgTypeAuth:
 		msg.Type = MsgTypeAuth
 		msg.Data = append(msg.Data, split[1][:len(split[1])-1]...)
 
+	case MsgTypeHello:
+		msg.Type = MsgTypeHello
+		msg.Data = append(msg.Data, split[1][:len(split[1])-1]...)
+
 	case MsgTypeAuthOK:
 		msg.Type = MsgTypeAuthOK
 
 	case MsgTypeAuthFail:
 		msg.Type = MsgTypeAuthFail
 
-	case MsgTypeCheck:
-		msg.Type = MsgTypeCheck
-		msg.MD5 = string(split[1][:len(split[1])-1])
+	case MsgTypePing:
+		msg.Type = MsgTypePing
+
+	case MsgTypePong:
+		msg.Type = MsgTypePong
+
+	case MsgTypeCheck, MsgTypeLink, MsgTypeTree:
+		msg.Type = MsgType(msgStream[0])
+		rest, err := msg.parseID(split[1][:len(split[1])-1])
+		if err != nil {
+			return msg, err
+		}
+		md5, modTime, found := bytes.Cut(rest, []byte(","))
+		msg.MD5 = string(md5)
+		if found && msg.Type == MsgTypeCheck {
+			nanos, err := strconv.ParseInt(string(modTime), 10, 64)
+			if err != nil {
+				return msg, fmt.Errorf("Check message has a bad modification time %q", modTime)
+			}
+			msg.ModTime = time.Unix(0, nanos).UTC()
+		}
+
+	case MsgTypeAck:
+		msg.Type = MsgTypeAck
+		rest, err := msg.parseID(split[1][:len(split[1])-1])
+		if err != nil {
+			return msg, err
+		}
+		msg.Action = FileAction(rest)
+
+	case MsgTypeDeleted:
+		msg.Type = MsgTypeDeleted
 
 	case MsgTypeMatch:
 		msg.Type = MsgTypeMatch
-		// Only exect one value after filename in format
-		switch split[1][0] {
+		rest, err := msg.parseID(split[1][:len(split[1])-1])
+		if err != nil {
+			return msg, err
+		}
+		// Only exect one value after filename and id in format, and maybe
+		// what the replica did instead
+		if value, action, found := bytes.Cut(rest, []byte(",")); found {
+			rest = value
+			msg.Action = FileAction(action)
+		}
+		if len(rest) != 1 {
+			return msg, fmt.Errorf("Expected 1 or 0 on MsgCheck response. Full byte slice %s.", string(split[1]))
+		}
+		switch rest[0] {
 		case '0':
 			msg.Match = false
 		case '1':
 			msg.Match = true
 		default:
-			return msg, fmt.Errorf("Expected 1 or 0 on MsgCheck response. Got: %c. Full byte slice %s.", split[1][0], string(split[1]))
+			return msg, fmt.Errorf("Expected 1 or 0 on MsgCheck response. Got: %c. Full byte slice %s.", rest[0], string(split[1]))
 		}
 
 	case MsgTypeData:
 		msg.Type = MsgTypeData
-		msg.Data = append(msg.Data, split[1][:len(split[1])-1]...)
+		rest, err := msg.parseID(split[1][:len(split[1])-1])
+		if err != nil {
+			return msg, err
+		}
+		msg.Data = append(msg.Data, rest...)
+
+	case MsgTypeError:
+		msg.Type = MsgTypeError
+		rest, err := msg.parseID(split[1][:len(split[1])-1])
+		if err != nil {
+			return msg, err
+		}
+		code, text, found := bytes.Cut(rest, []byte(","))
+		if !found {
+			return msg, errors.New("Error message is missing the error code")
+		}
+		msg.ErrCode = ErrCode(code)
+		msg.ErrText = string(text)
 
 	default:
 		return msg, errors.New("Could not parse error bad starting value in msg")
 	}
 	return msg, nil
 }
+
+// Reads the request id off the front of a payload and returns the rest
+func (msg *Message) parseID(payload []byte) ([]byte, error) {
+	idText, rest, found := bytes.Cut(payload, []byte(","))
+	if !found && msg.Type != MsgTypeAck {
+		return nil, fmt.Errorf("%c message is missing the request id", msg.Type)
+	}
+	id, err := strconv.ParseUint(string(idText), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%c message has a bad request id %q", msg.Type, idText)
+	}
+	msg.ID = id
+	return rest, nil
+}
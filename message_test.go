@@ -2,6 +2,7 @@ package filesyncer
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -14,24 +15,39 @@ func TestMsgRoundTrip(t *testing.T) {
 	}{
 		{
 			name:              "MsgTypeCheck",
-			expectedMsg:       Message{Type: MsgTypeCheck, FileName: "bob.md", MD5: "test"},
-			expectedMsgStream: []byte("C:bob.md,test\x00"),
+			expectedMsg:       Message{Type: MsgTypeCheck, FileName: "bob.md", ID: 7, MD5: "test"},
+			expectedMsgStream: []byte("C:bob.md,7,test\x00"),
+		},
+		{
+			name:              "MsgTypeCheckWithModTime",
+			expectedMsg:       Message{Type: MsgTypeCheck, FileName: "bob.md", ID: 7, MD5: "test", ModTime: time.Unix(1700000000, 5).UTC()},
+			expectedMsgStream: []byte("C:bob.md,7,test,1700000000000000005\x00"),
 		},
 		{
 			name:              "MsgTypeMatch",
-			expectedMsg:       Message{Type: MsgTypeMatch, FileName: "bob.md", Match: true},
-			expectedMsgStream: []byte("M:bob.md,1\x00"),
+			expectedMsg:       Message{Type: MsgTypeMatch, FileName: "bob.md", ID: 7, Match: true},
+			expectedMsgStream: []byte("M:bob.md,7,1\x00"),
+		},
+		{
+			name:              "MsgTypeMatchWithAction",
+			expectedMsg:       Message{Type: MsgTypeMatch, FileName: "bob.md", ID: 7, Match: true, Action: ActionKept},
+			expectedMsgStream: []byte("M:bob.md,7,1,kept\x00"),
 		},
 		{
 			name:              "MsgTypeData",
-			expectedMsg:       Message{Type: MsgTypeData, FileName: "bob.md", Data: []byte("#Title\n\n#Description\n\nSome text.\n")},
-			expectedMsgStream: []byte("D:bob.md,#Title\n\n#Description\n\nSome text.\n\x00"),
+			expectedMsg:       Message{Type: MsgTypeData, FileName: "bob.md", ID: 7, Data: []byte("#Title\n\n#Description\n\nSome text.\n")},
+			expectedMsgStream: []byte("D:bob.md,7,#Title\n\n#Description\n\nSome text.\n\x00"),
 		},
 		{
 			name:              "MsgTypeFinish",
 			expectedMsg:       Message{Type: MsgTypeFinish},
 			expectedMsgStream: []byte("F:,\x00"),
 		},
+		{
+			name:              "MsgTypeFinishWithDigest",
+			expectedMsg:       Message{Type: MsgTypeFinish, MD5: "abc"},
+			expectedMsgStream: []byte("F:,abc\x00"),
+		},
 		{
 			name:              "MsgTypeAuth",
 			expectedMsg:       Message{Type: MsgTypeAuth, Data: []byte("shhhhhh!")},
@@ -47,6 +63,51 @@ func TestMsgRoundTrip(t *testing.T) {
 			expectedMsg:       Message{Type: MsgTypeAuthFail},
 			expectedMsgStream: []byte("X:,\x00"),
 		},
+		{
+			name:              "MsgTypeHello",
+			expectedMsg:       Message{Type: MsgTypeHello, Data: []byte("dry_run=true")},
+			expectedMsgStream: []byte("H:,dry_run=true\x00"),
+		},
+		{
+			name:              "MsgTypeDeleted",
+			expectedMsg:       Message{Type: MsgTypeDeleted, FileName: "bob.md"},
+			expectedMsgStream: []byte("R:bob.md,\x00"),
+		},
+		{
+			name:              "MsgTypePing",
+			expectedMsg:       Message{Type: MsgTypePing},
+			expectedMsgStream: []byte("P:,\x00"),
+		},
+		{
+			name:              "MsgTypePong",
+			expectedMsg:       Message{Type: MsgTypePong},
+			expectedMsgStream: []byte("Q:,\x00"),
+		},
+		{
+			name:              "MsgTypeError",
+			expectedMsg:       Message{Type: MsgTypeError, FileName: "../bob.md", ErrCode: ErrCodeInvalidPath, ErrText: "Invalid file path, has '..'"},
+			expectedMsgStream: []byte("E:../bob.md,0,invalid_path,Invalid file path, has '..'\x00"),
+		},
+		{
+			name:              "MsgTypeLink",
+			expectedMsg:       Message{Type: MsgTypeLink, FileName: "copy.md", ID: 9, MD5: "abc"},
+			expectedMsgStream: []byte("L:copy.md,9,abc\x00"),
+		},
+		{
+			name:              "MsgTypeTree",
+			expectedMsg:       Message{Type: MsgTypeTree, FileName: "docs/api", ID: 3, MD5: "abc"},
+			expectedMsgStream: []byte("T:docs/api,3,abc\x00"),
+		},
+		{
+			name:              "MsgTypeAck",
+			expectedMsg:       Message{Type: MsgTypeAck, FileName: "bob.md", ID: 12},
+			expectedMsgStream: []byte("K:bob.md,12\x00"),
+		},
+		{
+			name:              "MsgTypeAckWithAction",
+			expectedMsg:       Message{Type: MsgTypeAck, FileName: "bob.md", ID: 12, Action: ActionConflict},
+			expectedMsgStream: []byte("K:bob.md,12,conflict\x00"),
+		},
 	}
 
 	for _, tc := range tests {
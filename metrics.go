@@ -0,0 +1,199 @@
+package filesyncer
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Remote addresses given their own auth failure series before the rest are
+// counted as "other"
+const maxRemoteSeries = 100
+
+// Package wide metrics, updated by Syncer, CreateFileCache and the auth path
+var metrics = newMetrics()
+
+type counter struct {
+	value atomic.Int64
+}
+
+func (c *counter) add(n int64) {
+	c.value.Add(n)
+}
+
+// Counter split by the value of a single label
+type counterVec struct {
+	label  string
+	mu     sync.Mutex
+	values map[string]int64
+	// If set, values seen once this many are already tracked are counted
+	// under "other", so label values anyone can choose can't add series
+	// without bound
+	limit int
+}
+
+const otherLabelValue = "other"
+
+func (c *counterVec) inc(labelValue string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.values[labelValue]; !ok && c.limit > 0 && len(c.values) >= c.limit {
+		labelValue = otherLabelValue
+	}
+	c.values[labelValue]++
+}
+
+type histogram struct {
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Metrics holds the counters served in the Prometheus text format
+type Metrics struct {
+	sessionsStarted     *counterVec
+	sessionsCompleted   *counterVec
+	sessionsFailed      *counterVec
+	authFailures        *counterVec
+	authFailuresRemote  *counterVec
+	connectionsRejected *counterVec
+	filesSent           counter
+	filesReceived       counter
+	bytesSent           counter
+	bytesReceived       counter
+	filesDeleted        counter
+	verifyFailures      counter
+	hashSeconds         *histogram
+	sessionSeconds      *histogram
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		sessionsStarted:     &counterVec{label: "role", values: map[string]int64{}},
+		sessionsCompleted:   &counterVec{label: "role", values: map[string]int64{}},
+		sessionsFailed:      &counterVec{label: "role", values: map[string]int64{}},
+		authFailures:        &counterVec{label: "reason", values: map[string]int64{}},
+		authFailuresRemote:  &counterVec{label: "remote", values: map[string]int64{}, limit: maxRemoteSeries},
+		connectionsRejected: &counterVec{label: "reason", values: map[string]int64{}},
+		hashSeconds:         newHistogram(0.0001, 0.001, 0.01, 0.1, 1, 10),
+		sessionSeconds:      newHistogram(0.1, 1, 10, 60, 300, 1800, 3600),
+	}
+}
+
+// Writes every metric in the Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	b := &strings.Builder{}
+	writeCounterVec(b, "filesyncer_sessions_started_total", "Sync sessions started.", m.sessionsStarted)
+	writeCounterVec(b, "filesyncer_sessions_completed_total", "Sync sessions that finished without error.", m.sessionsCompleted)
+	writeCounterVec(b, "filesyncer_sessions_failed_total", "Sync sessions that ended with an error.", m.sessionsFailed)
+	writeCounterVec(b, "filesyncer_auth_failures_total", "Failed authentication attempts by reason.", m.authFailures)
+	writeCounterVec(b, "filesyncer_auth_failures_by_remote_total", "Failed authentication attempts by remote address, the first 100 addresses seen and the rest as other.", m.authFailuresRemote)
+	writeCounterVec(b, "filesyncer_connections_rejected_total", "Connections turned away before authentication by reason.", m.connectionsRejected)
+	writeCounter(b, "filesyncer_files_sent_total", "Files sent to a replica.", &m.filesSent)
+	writeCounter(b, "filesyncer_files_received_total", "Files received from a main.", &m.filesReceived)
+	writeCounter(b, "filesyncer_bytes_sent_total", "File bytes sent to a replica.", &m.bytesSent)
+	writeCounter(b, "filesyncer_bytes_received_total", "File bytes received from a main.", &m.bytesReceived)
+	writeCounter(b, "filesyncer_files_deleted_total", "Files deleted by a replica.", &m.filesDeleted)
+	writeCounter(b, "filesyncer_verify_failures_total", "Files a replica wrote that did not match main's md5.", &m.verifyFailures)
+	writeHistogram(b, "filesyncer_hash_duration_seconds", "Time taken to hash a single file.", m.hashSeconds)
+	writeHistogram(b, "filesyncer_session_duration_seconds", "Time taken by a whole sync session.", m.sessionSeconds)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := m.WriteTo(w); err != nil {
+		slog.Warn("Failed to write metrics", "remote", r.RemoteAddr, "error", err)
+	}
+}
+
+// MetricsHandler serves the package metrics in the Prometheus text format
+func MetricsHandler() http.Handler {
+	return metrics
+}
+
+// ServeMetrics listens on address and serves the metrics on /metrics. It
+// only returns once the server fails.
+func ServeMetrics(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	slog.Info("Serving metrics", "address", address)
+	return http.ListenAndServe(address, mux)
+}
+
+func writeHeader(b *strings.Builder, name string, help string, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeCounter(b *strings.Builder, name string, help string, c *counter) {
+	writeHeader(b, name, help, "counter")
+	fmt.Fprintf(b, "%s %d\n", name, c.value.Load())
+}
+
+func writeCounterVec(b *strings.Builder, name string, help string, c *counterVec) {
+	writeHeader(b, name, help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	labelValues := make([]string, 0, len(c.values))
+	for v := range c.values {
+		labelValues = append(labelValues, v)
+	}
+	sort.Strings(labelValues)
+	for _, v := range labelValues {
+		fmt.Fprintf(b, "%s{%s=\"%s\"} %d\n", name, c.label, escapeLabelValue(v), c.values[v])
+	}
+}
+
+func writeHistogram(b *strings.Builder, name string, help string, h *histogram) {
+	writeHeader(b, name, help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		fmt.Fprintf(b, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(upper), h.counts[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(b, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(b, "%s_count %d\n", name, h.count)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelEscaper.Replace(v)
+}
@@ -0,0 +1,58 @@
+package filesyncer
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsTextFormat(t *testing.T) {
+	m := newMetrics()
+	m.sessionsStarted.inc("main")
+	m.sessionsStarted.inc("main")
+	m.authFailures.inc("invalid_key")
+	m.connectionsRejected.inc(`odd"reason`)
+	m.bytesSent.add(42)
+	m.sessionSeconds.observe(2 * time.Second)
+
+	b := &strings.Builder{}
+	_, err := m.WriteTo(b)
+	assert.NoError(t, err)
+	out := b.String()
+
+	assert.Contains(t, out, "# TYPE filesyncer_sessions_started_total counter\n")
+	assert.Contains(t, out, "filesyncer_sessions_started_total{role=\"main\"} 2\n")
+	assert.Contains(t, out, "filesyncer_auth_failures_total{reason=\"invalid_key\"} 1\n")
+	assert.Contains(t, out, "filesyncer_connections_rejected_total{reason=\"odd\\\"reason\"} 1\n")
+	assert.Contains(t, out, "filesyncer_bytes_sent_total 42\n")
+	assert.Contains(t, out, "filesyncer_session_duration_seconds_bucket{le=\"1\"} 0\n")
+	assert.Contains(t, out, "filesyncer_session_duration_seconds_bucket{le=\"10\"} 1\n")
+	assert.Contains(t, out, "filesyncer_session_duration_seconds_bucket{le=\"+Inf\"} 1\n")
+	assert.Contains(t, out, "filesyncer_session_duration_seconds_sum 2\n")
+	assert.Contains(t, out, "filesyncer_session_duration_seconds_count 1\n")
+}
+
+// Failures are counted per remote address up to the limit, then as other
+func TestMetricsAuthFailuresByRemote(t *testing.T) {
+	saved := metrics
+	metrics = newMetrics()
+	defer func() { metrics = saved }()
+
+	for i := range maxRemoteSeries + 5 {
+		authFailed(&net.TCPAddr{IP: net.IPv4(10, 0, byte(i/256), byte(i%256)), Port: 4000 + i}, "invalid_key", errors.New("bad key"))
+	}
+	authFailed(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 0), Port: 1}, "malformed", errors.New("bad message"))
+
+	b := &strings.Builder{}
+	_, err := metrics.WriteTo(b)
+	assert.NoError(t, err)
+	out := b.String()
+	assert.Contains(t, out, "filesyncer_auth_failures_by_remote_total{remote=\"10.0.0.0\"} 2\n")
+	assert.Contains(t, out, "filesyncer_auth_failures_by_remote_total{remote=\"other\"} 5\n")
+	assert.Equal(t, maxRemoteSeries+1, strings.Count(out, "filesyncer_auth_failures_by_remote_total{"))
+	assert.Contains(t, out, "filesyncer_auth_failures_total{reason=\"invalid_key\"} 105\n")
+}
@@ -0,0 +1,126 @@
+package filesyncer
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const objectsDirName = "objects"
+
+var ErrInvalidObjectID = errors.New("Invalid object id")
+
+// ObjectStore keeps file contents once each, named by their md5, in the
+// state directory of a synced directory. Objects are never changed once
+// written.
+type ObjectStore struct {
+	dir string
+}
+
+func NewObjectStore(directory string) *ObjectStore {
+	return &ObjectStore{dir: filepath.Join(directory, StateDirName, objectsDirName)}
+}
+
+// Object ids come from manifests on disk so they are checked before use as
+// a path
+func validObjectID(id string) error {
+	if len(id) != md5.Size*2 {
+		return fmt.Errorf("%w: %q", ErrInvalidObjectID, id)
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return fmt.Errorf("%w: %q", ErrInvalidObjectID, id)
+	}
+	return nil
+}
+
+// Where an object is kept, relative to the synced directory
+func objectName(id string) string {
+	return path.Join(StateDirName, objectsDirName, id[:2], id)
+}
+
+func (o *ObjectStore) path(id string) string {
+	return filepath.Join(o.dir, id[:2], id)
+}
+
+func (o *ObjectStore) Has(id string) bool {
+	if validObjectID(id) != nil {
+		return false
+	}
+	_, err := os.Stat(o.path(id))
+	return err == nil
+}
+
+// Stores the content of r, returning its md5 and size. Content that is
+// already stored is not written twice.
+func (o *ObjectStore) Put(r io.Reader) (string, int64, error) {
+	if err := os.MkdirAll(o.dir, 0755); err != nil {
+		return "", 0, err
+	}
+	tmp, err := os.CreateTemp(o.dir, "incoming-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := md5.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	id := hex.EncodeToString(h.Sum(nil))
+	if o.Has(id) {
+		return id, size, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(o.path(id)), 0755); err != nil {
+		return "", 0, err
+	}
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), o.path(id)); err != nil {
+		return "", 0, err
+	}
+	return id, size, nil
+}
+
+func (o *ObjectStore) Open(id string) (io.ReadCloser, error) {
+	if err := validObjectID(id); err != nil {
+		return nil, err
+	}
+	return os.Open(o.path(id))
+}
+
+func (o *ObjectStore) Remove(id string) error {
+	if err := validObjectID(id); err != nil {
+		return err
+	}
+	return os.Remove(o.path(id))
+}
+
+// Ids of every stored object
+func (o *ObjectStore) List() ([]string, error) {
+	var ids []string
+	err := filepath.WalkDir(o.dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == o.dir {
+			return fs.SkipAll
+		}
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && validObjectID(d.Name()) == nil {
+			ids = append(ids, d.Name())
+		}
+		return nil
+	})
+	return ids, err
+}
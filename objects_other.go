@@ -0,0 +1,10 @@
+//go:build !unix
+
+package filesyncer
+
+import "io/fs"
+
+// How many hard links the file has, or 0 if it can't be told
+func linkCount(fi fs.FileInfo) uint64 {
+	return 0
+}
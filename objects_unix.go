@@ -0,0 +1,16 @@
+//go:build unix
+
+package filesyncer
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// How many hard links the file has, or 0 if it can't be told
+func linkCount(fi fs.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 0
+}
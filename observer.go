@@ -0,0 +1,80 @@
+package filesyncer
+
+import "sync"
+
+// Observer is told what a Syncer is doing so embedding applications can
+// update a UI or kick off follow up work. Callbacks are never called
+// concurrently but may come from different goroutines, and they hold up the
+// session so they should return quickly.
+type Observer interface {
+	SessionStarted(replica bool)
+	// Called on both sides once the replica has answered a check
+	FileChecked(path string, match bool)
+	// Called on main as a file's bytes go out on the connection
+	TransferProgress(path string, sent int64, total int64)
+	// Called on the replica once a file's new content is on disk
+	FileWritten(path string, size int64)
+	// Called on both sides for each file the replica deleted
+	FileDeleted(path string)
+	SessionEnded(report *SyncReport, err error)
+}
+
+// NopObserver does nothing. Embed it to only implement the callbacks you need.
+type NopObserver struct{}
+
+func (NopObserver) SessionStarted(replica bool)                           {}
+func (NopObserver) FileChecked(path string, match bool)                   {}
+func (NopObserver) TransferProgress(path string, sent int64, total int64) {}
+func (NopObserver) FileWritten(path string, size int64)                   {}
+func (NopObserver) FileDeleted(path string)                               {}
+func (NopObserver) SessionEnded(report *SyncReport, err error)            {}
+
+func (s *Syncer) observer() Observer {
+	if s.Observer == nil {
+		return NopObserver{}
+	}
+	return lockedObserver{mu: &s.observerMu, next: s.Observer}
+}
+
+// Serialises callbacks as main reads replies and sends data on separate
+// goroutines
+type lockedObserver struct {
+	mu   *sync.Mutex
+	next Observer
+}
+
+func (o lockedObserver) SessionStarted(replica bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.next.SessionStarted(replica)
+}
+
+func (o lockedObserver) FileChecked(path string, match bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.next.FileChecked(path, match)
+}
+
+func (o lockedObserver) TransferProgress(path string, sent int64, total int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.next.TransferProgress(path, sent, total)
+}
+
+func (o lockedObserver) FileWritten(path string, size int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.next.FileWritten(path, size)
+}
+
+func (o lockedObserver) FileDeleted(path string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.next.FileDeleted(path)
+}
+
+func (o lockedObserver) SessionEnded(report *SyncReport, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.next.SessionEnded(report, err)
+}
@@ -0,0 +1,271 @@
+package filesyncer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// How many files main keeps in flight when Syncer.Window is zero
+const defaultWindow = 16
+
+// How many files the replica writes at once when Syncer.WriteWorkers is zero
+const defaultWriteWorkers = 4
+
+// A file main has sent a check for and not yet heard the outcome of
+type transfer struct {
+	id       uint64
+	filename string
+	md5      string
+	size     int64
+	started  time.Time
+	// The replica was told to reuse content sent earlier in the session
+	linked bool
+	// Times the file has gone out, more than once if the replica's copy
+	// failed verification
+	attempts int
+	// A directory compared by its Merkle hash rather than a file
+	dir bool
+}
+
+// Tracks main's in flight files. Each one holds a slot so the window bounds
+// how many checks and data streams are outstanding at once.
+type pipeline struct {
+	mu       sync.Mutex
+	nextID   uint64
+	inflight map[uint64]*transfer
+	slots    chan struct{}
+	// Hashes whose content has been sent this session
+	delivered map[string]bool
+}
+
+func newPipeline(window int) *pipeline {
+	if window <= 0 {
+		window = defaultWindow
+	}
+	return &pipeline{inflight: map[uint64]*transfer{}, slots: make(chan struct{}, window), delivered: map[string]bool{}}
+}
+
+// Registers a file under a new request id. The caller must hold a slot.
+func (p *pipeline) start(filename string, md5 string, size int64) *transfer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextID++
+	t := &transfer{id: p.nextID, filename: filename, md5: md5, size: size, started: time.Now()}
+	p.inflight[t.id] = t
+	return t
+}
+
+// Registers a directory under a new request id. The caller must hold a slot.
+func (p *pipeline) startDir(dir string, hash string) *transfer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextID++
+	t := &transfer{id: p.nextID, filename: dir, md5: hash, started: time.Now(), dir: true}
+	p.inflight[t.id] = t
+	return t
+}
+
+// Returns a copy of the in flight file with the id
+func (p *pipeline) get(id uint64) (transfer, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.inflight[id]
+	if !ok {
+		return transfer{}, false
+	}
+	return *t, true
+}
+
+// Records how many bytes went out for the file and that its content has now
+// been delivered
+func (p *pipeline) sent(id uint64, size int64, linked bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t, ok := p.inflight[id]; ok {
+		t.size = size
+		t.linked = linked
+		p.delivered[t.md5] = true
+	}
+}
+
+// Counts another send of the file, returning how many went before. Counted
+// before the send so a reply to it never sees a stale count.
+func (p *pipeline) attempt(id uint64) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.inflight[id]
+	if !ok {
+		return 0
+	}
+	t.attempts++
+	return t.attempts - 1
+}
+
+func (p *pipeline) wasDelivered(md5 string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.delivered[md5]
+}
+
+// Finishes the file and frees its slot. Unknown ids are ignored.
+func (p *pipeline) done(id uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.inflight[id]; !ok {
+		return
+	}
+	delete(p.inflight, id)
+	<-p.slots
+}
+
+// Takes a slot in the window, sending any file data the replica asked for
+// and walking into directories it answered while waiting. Without slot it
+// returns after the next directory answer instead.
+func (s *Syncer) waitForSlot(p *pipeline, sends <-chan transfer, reader *mainReader, walk *treeWalk, slot bool) error {
+	slots := p.slots
+	if !slot {
+		slots = nil
+	}
+	for {
+		select {
+		case slots <- struct{}{}:
+			return nil
+		case t := <-sends:
+			if err := s.sendTransfer(p, t); err != nil {
+				return err
+			}
+		case a := <-walk.answers:
+			s.dirAnswered(walk, a)
+			if !slot {
+				return nil
+			}
+		case <-reader.done:
+			if reader.err != nil {
+				return reader.err
+			}
+			return &ProtocolError{Code: ErrCodeProtocol, Text: "replica finished the session before main"}
+		}
+	}
+}
+
+// Sends a file the replica asked for. Content already sent this session is
+// not sent again, the replica is told to link to it instead, unless it is
+// asking again because its copy was corrupt. A file that can't be read
+// locally only fails that file.
+func (s *Syncer) sendTransfer(p *pipeline, t transfer) error {
+	if p.attempt(t.id) == 0 && p.wasDelivered(t.md5) {
+		msg := Message{Type: MsgTypeLink, FileName: t.filename, ID: t.id, MD5: t.md5}
+		if err := s.SendMessage(msg); err != nil {
+			return fmt.Errorf("failed to send link message for file %s: %w", t.filename, err)
+		}
+		slog.Debug("Main sent link message", "filename", t.filename, "id", t.id, "md5", t.md5)
+		p.sent(t.id, 0, true)
+		return nil
+	}
+
+	size, err := s.sendFile(t.filename, t.id)
+	if err != nil {
+		var pe *ProtocolError
+		if errors.As(err, &pe) {
+			s.fileFailed(pe)
+			p.done(t.id)
+			return nil
+		}
+		return err
+	}
+	p.sent(t.id, int64(size), false)
+	return nil
+}
+
+// Main's goroutine reading replies. done is closed once it stops, with err
+// saying why if it wasn't a finish.
+type mainReader struct {
+	done chan struct{}
+	err  error
+}
+
+// What the replica's read goroutine hands to the session loop
+type readResult struct {
+	msg Message
+	err error
+}
+
+// Reads messages on their own goroutine so the replica can apply finished
+// writes while it waits for the next message. Stops after an error or once
+// done is closed.
+func (s *Syncer) readMessages(reader *bufio.Reader, done <-chan struct{}) <-chan readResult {
+	results := make(chan readResult)
+	go func() {
+		for {
+			msg, err := s.readMessage(reader)
+			select {
+			case results <- readResult{msg: msg, err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return results
+}
+
+// The outcome of one of the replica's concurrent file writes
+type writeResult struct {
+	msg     Message
+	started time.Time
+	err     error
+	// Set when what was written isn't main's content as sent, as for merges
+	action FileAction
+	md5    string
+	size   int64
+}
+
+// What the replica's session loop is waiting on
+type replicaState struct {
+	// md5s main announced for files we asked it to send
+	wanted map[string]string
+	// Writes in progress for each md5
+	writing map[string]int
+	// Links to content that is still being written, by md5
+	pendingLinks map[string][]Message
+	// md5 of main's version of every file it checked
+	checked map[string]string
+	// Whether files changed on both sides are resolved by policy rather
+	// than overwritten
+	conflictAware bool
+	// Merge bases from the last session, and the base of each file being
+	// merged in this one
+	bases  map[string]string
+	merges map[string]string
+	// Times each file was asked for again after failing verification, and
+	// those whose data hasn't arrived again yet
+	retries   map[string]int
+	resending map[string]bool
+}
+
+// Whether the replica is waiting on main for the file. Only these may be
+// written, so the session's mode, paths and conflict decisions hold whatever
+// main sends.
+func (rs *replicaState) asked(filename string) bool {
+	_, wanted := rs.wanted[filename]
+	return wanted || rs.resending[filename]
+}
+
+func newReplicaState() *replicaState {
+	return &replicaState{
+		wanted:       map[string]string{},
+		writing:      map[string]int{},
+		pendingLinks: map[string][]Message{},
+		checked:      map[string]string{},
+		bases:        map[string]string{},
+		merges:       map[string]string{},
+		retries:      map[string]int{},
+		resending:    map[string]bool{},
+	}
+}
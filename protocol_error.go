@@ -0,0 +1,103 @@
+package filesyncer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+var ErrFilesFailed = errors.New("Some files failed to sync")
+
+// ErrCode says what went wrong in a protocol error message. It travels on the
+// wire so keep the values stable.
+type ErrCode string
+
+const (
+	ErrCodeInvalidPath ErrCode = "invalid_path"
+	ErrCodePermission  ErrCode = "permission_denied"
+	ErrCodeIO          ErrCode = "io"
+	ErrCodeProtocol    ErrCode = "protocol"
+	ErrCodeInternal    ErrCode = "internal"
+	// A file changed on both sides under the abort conflict policy
+	ErrCodeConflict ErrCode = "conflict"
+)
+
+// Fatal codes end the session, the rest only fail the one file
+func (c ErrCode) Fatal() bool {
+	switch c {
+	case ErrCodeInvalidPath, ErrCodePermission, ErrCodeIO:
+		return false
+	default:
+		return true
+	}
+}
+
+// ProtocolError is an error that is (or was) sent between main and replica
+// using the MsgTypeError message
+type ProtocolError struct {
+	Code ErrCode
+	Path string
+	Text string
+	// Set when the error was reported by the other side of the connection
+	Remote bool
+
+	// Request the error ends, zero if it is not about one
+	id uint64
+}
+
+func (e *ProtocolError) Error() string {
+	where := "local"
+	if e.Remote {
+		where = "remote"
+	}
+	if e.Path == "" {
+		return fmt.Sprintf("%s %s error: %s", where, e.Code, e.Text)
+	}
+	return fmt.Sprintf("%s %s error for %s: %s", where, e.Code, e.Path, e.Text)
+}
+
+func (e *ProtocolError) Fatal() bool {
+	return e.Code.Fatal()
+}
+
+// Lets errors.Is match the sentinel errors behind the codes that have one
+func (e *ProtocolError) Unwrap() error {
+	switch e.Code {
+	case ErrCodeInvalidPath:
+		return ErrInvalidPath
+	case ErrCodePermission:
+		return fs.ErrPermission
+	default:
+		return nil
+	}
+}
+
+// Turns err into a ProtocolError for path, picking the code from the error
+func newProtocolError(path string, err error) *ProtocolError {
+	var pe *ProtocolError
+	if errors.As(err, &pe) {
+		return pe
+	}
+
+	code := ErrCodeInternal
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	switch {
+	case errors.Is(err, ErrInvalidPath):
+		code = ErrCodeInvalidPath
+	case errors.Is(err, fs.ErrPermission):
+		code = ErrCodePermission
+	case errors.As(err, &pathErr), errors.As(err, &linkErr), errors.Is(err, fs.ErrNotExist), errors.Is(err, ErrVerifyFailed):
+		code = ErrCodeIO
+	}
+	return &ProtocolError{Code: code, Path: path, Text: err.Error()}
+}
+
+func (e *ProtocolError) asMessage() Message {
+	return Message{Type: MsgTypeError, FileName: e.Path, ID: e.id, ErrCode: e.Code, ErrText: e.Text}
+}
+
+func (msg *Message) asProtocolError() *ProtocolError {
+	return &ProtocolError{Code: msg.ErrCode, Path: msg.FileName, Text: msg.ErrText, Remote: true, id: msg.ID}
+}
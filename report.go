@@ -0,0 +1,171 @@
+package filesyncer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// FileAction is what a session did with a single file
+type FileAction string
+
+const (
+	ActionUnchanged FileAction = "unchanged"
+	ActionSent      FileAction = "sent"
+	ActionReceived  FileAction = "received"
+	// Satisfied from a local file with the same content instead of a transfer
+	ActionReused  FileAction = "reused"
+	ActionDeleted FileAction = "deleted"
+	ActionFailed  FileAction = "failed"
+	// The session's sync mode did not allow the change
+	ActionSkipped FileAction = "skipped"
+	// The replica kept its own version of a file instead of main's, or a
+	// conflict copy of it
+	ActionKept FileAction = "kept"
+	// Changes made on both sides were merged cleanly
+	ActionMerged FileAction = "merged"
+	// Changes made on both sides overlapped, so the file was written with
+	// conflict markers and a copy of each version beside it
+	ActionConflict FileAction = "conflict"
+)
+
+type FileReport struct {
+	Path     string        `json:"path"`
+	Action   FileAction    `json:"action"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration_ns"`
+	Error    string        `json:"error,omitempty"`
+	// Times the file was sent again because the replica's copy didn't match
+	Retries int `json:"retries,omitempty"`
+}
+
+// SyncReport is the outcome of one session as seen from one side of it
+type SyncReport struct {
+	Role string `json:"role"`
+	// Actions are what would have happened, nothing was changed
+	DryRun   bool          `json:"dry_run"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration_ns"`
+	Files    []FileReport  `json:"files"`
+	Error    string        `json:"error,omitempty"`
+	// Snapshot the replica recorded at the end of the session
+	Snapshot string `json:"snapshot,omitempty"`
+	// Digest of the files in the session on this side once it finished, and
+	// the other side's. Empty if the other side is too old to send one.
+	TreeDigest     string `json:"tree_digest,omitempty"`
+	PeerTreeDigest string `json:"peer_tree_digest,omitempty"`
+
+	mu    sync.Mutex
+	index map[string]int
+}
+
+func newSyncReport(replica bool) *SyncReport {
+	role := "main"
+	if replica {
+		role = "replica"
+	}
+	return &SyncReport{Role: role, Started: time.Now(), Files: []FileReport{}, index: map[string]int{}}
+}
+
+// Adds the file to the report, replacing anything recorded for it earlier
+func (r *SyncReport) record(fr FileReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recordLocked(fr)
+}
+
+func (r *SyncReport) recordLocked(fr FileReport) {
+	if i, ok := r.index[fr.Path]; ok {
+		r.Files[i] = fr
+		return
+	}
+	r.index[fr.Path] = len(r.Files)
+	r.Files = append(r.Files, fr)
+}
+
+// Marks a file as failed keeping whatever was already recorded about it
+func (r *SyncReport) recordFailure(pe *ProtocolError) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fr := FileReport{Path: pe.Path}
+	if i, ok := r.index[pe.Path]; ok {
+		fr = r.Files[i]
+	}
+	fr.Action = ActionFailed
+	fr.Error = pe.Error()
+	r.recordLocked(fr)
+}
+
+func (r *SyncReport) finish(err error) {
+	r.Duration = time.Since(r.Started)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	sort.Slice(r.Files, func(i, j int) bool { return r.Files[i].Path < r.Files[j].Path })
+	for i, fr := range r.Files {
+		r.index[fr.Path] = i
+	}
+}
+
+// Whether both sides ended the session with identical trees
+func (r *SyncReport) TreesMatch() bool {
+	return r.TreeDigest != "" && r.TreeDigest == r.PeerTreeDigest
+}
+
+// Number of files the action was taken on
+func (r *SyncReport) Count(action FileAction) int {
+	count := 0
+	for _, fr := range r.Files {
+		if fr.Action == action {
+			count++
+		}
+	}
+	return count
+}
+
+// Total bytes transferred in the session
+func (r *SyncReport) Bytes() int64 {
+	var total int64
+	for _, fr := range r.Files {
+		total += fr.Bytes
+	}
+	return total
+}
+
+// Writes the report as an aligned human readable table
+func (r *SyncReport) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tACTION\tBYTES\tDURATION\tERROR")
+	for _, fr := range r.Files {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", fr.Path, fr.Action, fr.Bytes, fr.Duration.Round(time.Microsecond), fr.Error)
+	}
+	fmt.Fprintf(tw, "\n%d files (%d bytes) in %s as %s", len(r.Files), r.Bytes(), r.Duration.Round(time.Millisecond), r.Role)
+	if r.DryRun {
+		fmt.Fprint(tw, " (dry run)")
+	}
+	fmt.Fprintln(tw)
+	if r.Snapshot != "" {
+		fmt.Fprintf(tw, "Snapshot: %s\n", r.Snapshot)
+	}
+	switch {
+	case r.PeerTreeDigest == "":
+	case r.TreesMatch():
+		fmt.Fprintf(tw, "Trees match: %s\n", r.TreeDigest)
+	default:
+		fmt.Fprintf(tw, "Trees differ: %s here, %s on the other side\n", r.TreeDigest, r.PeerTreeDigest)
+	}
+	if r.Error != "" {
+		fmt.Fprintf(tw, "Error: %s\n", r.Error)
+	}
+	return tw.Flush()
+}
+
+func (r *SyncReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
@@ -0,0 +1,334 @@
+package filesyncer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config is where an S3Store keeps its files and how it signs requests
+type S3Config struct {
+	// Base URL of the service, e.g. https://s3.eu-west-2.amazonaws.com.
+	// Buckets are addressed path style so any S3 compatible server works.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Key prefix the store lives under, e.g. "notes/". Empty uses the whole bucket.
+	Prefix       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// Defaults to http.DefaultClient
+	Client *http.Client
+}
+
+// S3Store keeps files as objects in an S3 compatible bucket. Requests are
+// signed with AWS Signature Version 4.
+type S3Store struct {
+	config   S3Config
+	endpoint *url.URL
+	now      func() time.Time
+}
+
+func NewS3Store(config S3Config) (*S3Store, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, errors.New("S3 bucket is required")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Prefix != "" && !strings.HasSuffix(config.Prefix, "/") {
+		config.Prefix += "/"
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &S3Store{config: config, endpoint: endpoint, now: time.Now}, nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3Store) List() ([]FileInfo, error) {
+	var files []FileInfo
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if s.config.Prefix != "" {
+			query.Set("prefix", s.config.Prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode S3 listing: %w", err)
+		}
+
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, s.config.Prefix)
+			if name == "" || strings.HasSuffix(name, "/") || name == StateDirName || strings.HasPrefix(name, StateDirName+"/") {
+				continue
+			}
+			files = append(files, FileInfo{Name: name, Size: object.Size, ModTime: object.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3Store) Stat(name string) (FileInfo, error) {
+	resp, err := s.do(http.MethodHead, name, nil, nil, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+	info := FileInfo{Name: name, Size: resp.ContentLength}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return info, nil
+}
+
+func (s *S3Store) Open(name string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, name, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Objects are buffered in memory and uploaded in one PUT on Close, which S3
+// makes visible atomically
+func (s *S3Store) Create(name string) (FileWriter, error) {
+	return &s3FileWriter{store: s, name: name}, nil
+}
+
+// S3 has no rename so the object is copied then the original deleted
+func (s *S3Store) Rename(from string, to string) error {
+	_, source := s.objectPath(from)
+	header := http.Header{"X-Amz-Copy-Source": {source}}
+	resp, err := s.do(http.MethodPut, to, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return s.Remove(from)
+}
+
+func (s *S3Store) Remove(name string) error {
+	resp, err := s.do(http.MethodDelete, name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Path of the object for name, or of the bucket if name is empty, and the
+// same path URI encoded the way it is sent and signed
+func (s *S3Store) objectPath(name string) (string, string) {
+	p := "/" + s.config.Bucket
+	if name != "" {
+		p += "/" + s.config.Prefix + name
+	}
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return p, strings.Join(segments, "/")
+}
+
+// Sends a signed request for the object name. Responses other than 2xx are
+// turned into errors and their body closed.
+func (s *S3Store) do(method string, name string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	objectPath, rawPath := s.objectPath(name)
+	u := *s.endpoint
+	base := strings.TrimSuffix(u.EscapedPath(), "/")
+	u.Path = strings.TrimSuffix(u.Path, "/") + objectPath
+	u.RawPath = base + rawPath
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if s.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.config.SessionToken)
+	}
+	signV4(req, body, s.config, s.now())
+
+	resp, err := s.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	op := strings.ToLower(method)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	case http.StatusForbidden:
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	default:
+		return nil, &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("S3 returned %s: %s", resp.Status, strings.TrimSpace(string(detail)))}
+	}
+}
+
+type s3FileWriter struct {
+	store *S3Store
+	name  string
+	buf   bytes.Buffer
+}
+
+func (w *s3FileWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+func (w *s3FileWriter) Close() error {
+	resp, err := w.store.do(http.MethodPut, w.name, nil, nil, w.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (w *s3FileWriter) Abort() error {
+	w.buf.Reset()
+	return nil
+}
+
+const sigV4Algorithm = "AWS4-HMAC-SHA256"
+
+// Signs req for S3 with AWS Signature Version 4. Every header already on the
+// request is signed along with the host, date and payload hash.
+func signV4(req *http.Request, body []byte, config S3Config, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Del("Authorization")
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL.EscapedPath()),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, config.Region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+config.SecretKey), date)
+	key = hmacSHA256(key, config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, config.AccessKey, scope, signedHeaders, signature))
+}
+
+// S3 signs the path exactly as sent, without normalising it
+func canonicalURI(escapedPath string) string {
+	if escapedPath == "" {
+		return "/"
+	}
+	return escapedPath
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, uriEncode(key)+"="+uriEncode(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Percent encodes everything but the RFC 3986 unreserved characters
+func uriEncode(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
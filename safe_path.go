@@ -0,0 +1,51 @@
+package filesyncer
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var ErrInvalidPath = errors.New("Invalid file path")
+
+// ValidateFileName checks a filename that came in over the wire before it is
+// used on disk. Names must be relative, clean, slash separated and must not
+// climb out of the sync directory. Symlink escapes are caught separately by
+// doing all file operations through an os.Root.
+func ValidateFileName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%w: empty name", ErrInvalidPath)
+	case strings.ContainsRune(name, '\x00'):
+		return fmt.Errorf("%w: %q contains a NUL byte", ErrInvalidPath, name)
+	case strings.ContainsRune(name, '\\'):
+		return fmt.Errorf("%w: %q contains a backslash", ErrInvalidPath, name)
+	case path.IsAbs(name) || filepath.IsAbs(name):
+		return fmt.Errorf("%w: %q is absolute", ErrInvalidPath, name)
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return fmt.Errorf("%w: %q contains a '..' segment", ErrInvalidPath, name)
+		}
+	}
+	if path.Clean(name) != name || !filepath.IsLocal(name) {
+		return fmt.Errorf("%w: %q is not a clean local path", ErrInvalidPath, name)
+	}
+	if name == StateDirName || strings.HasPrefix(name, StateDirName+"/") {
+		return fmt.Errorf("%w: %q is inside the %s state directory", ErrInvalidPath, name, StateDirName)
+	}
+	return nil
+}
+
+// Reports if name is one of paths or inside one of them as a directory
+func withinPaths(name string, paths []string) bool {
+	for _, p := range paths {
+		p = strings.TrimSuffix(p, "/")
+		if name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
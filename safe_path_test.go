@@ -0,0 +1,71 @@
+package filesyncer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateFileName(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileName string
+		valid    bool
+	}{
+		{name: "plain", fileName: "bob.md", valid: true},
+		{name: "nested", fileName: "notes/bob.md", valid: true},
+		{name: "dots in name", fileName: "bob..md", valid: true},
+		{name: "empty", fileName: "", valid: false},
+		{name: "absolute", fileName: "/etc/passwd", valid: false},
+		{name: "parent", fileName: "../bob.md", valid: false},
+		{name: "nested parent", fileName: "notes/../../etc/cron.d/x", valid: false},
+		{name: "NUL byte", fileName: "bob.md\x00.txt", valid: false},
+		{name: "backslash", fileName: "..\\bob.md", valid: false},
+		{name: "not clean", fileName: "./bob.md", valid: false},
+		{name: "state directory", fileName: ".filesyncer/last-sync.json", valid: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateFileName(tc.fileName)
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidPath)
+			}
+		})
+	}
+}
+
+func TestWriteFileStaysInsideDirectory(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	assert.NoError(t, os.Symlink(outside, filepath.Join(dir, "escape")))
+
+	fc, err := CreateFileCache(dir)
+	assert.NoError(t, err)
+	syncer := Syncer{Replica: true, FileCache: fc}
+
+	err = syncer.WriteFile(Message{Type: MsgTypeData, FileName: "../x.md", Data: []byte("x")})
+	assert.ErrorIs(t, err, ErrInvalidPath)
+
+	err = syncer.WriteFile(Message{Type: MsgTypeData, FileName: "escape/x.md", Data: []byte("x")})
+	assert.Error(t, err, "Writing through a symlink out of the directory should fail")
+	_, statErr := os.Stat(filepath.Join(outside, "x.md"))
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestParseSyncPaths(t *testing.T) {
+	paths, err := ParseSyncPaths([]string{"docs/api/", "./notes/today.md"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docs/api", "notes/today.md"}, paths)
+
+	paths, err = ParseSyncPaths([]string{"docs", "."})
+	assert.NoError(t, err)
+	assert.Nil(t, paths)
+
+	_, err = ParseSyncPaths([]string{"../outside"})
+	assert.ErrorIs(t, err, ErrInvalidPath)
+}
@@ -0,0 +1,264 @@
+package filesyncer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+)
+
+// SessionOptions are proposed by main in the hello message that starts every
+// session. The replica answers with the options it will actually apply.
+type SessionOptions struct {
+	// Only work out what would change. Nothing is sent, written or deleted.
+	DryRun bool
+	// What main may do to the replica's files. Empty is mirror.
+	Mode SyncMode
+	// Keep the replica's changes instead of overwriting them. Files both
+	// sides changed since the last session are merged unless one of the
+	// replica's conflict rules says otherwise. Only replicas that keep merge
+	// bases agree to it.
+	Merge bool
+	// Only sync these files and directories, see ParseSyncPaths. Files
+	// outside them are neither checked nor deleted. Empty is everything.
+	Paths []string
+
+	// Main sends files again when asked. Always true for this version, the
+	// replica only asks mains that say so.
+	resend bool
+	// The replica compares directories by their Merkle hash. Always true
+	// for this version, main only sends directories to replicas that say so.
+	trees bool
+}
+
+// Whether the session covers the file
+func (o SessionOptions) selects(name string) bool {
+	return len(o.Paths) == 0 || withinPaths(name, o.Paths)
+}
+
+// SyncMode is which changes a session may make to the replica
+type SyncMode string
+
+const (
+	// Make the replica match main exactly
+	ModeMirror SyncMode = "mirror"
+	// Create and update files but never delete any
+	ModeAdditive SyncMode = "additive"
+	// Only refresh files the replica already has
+	ModeUpdateOnly SyncMode = "update-only"
+	// Only create files the replica doesn't have
+	ModeCreateOnly SyncMode = "create-only"
+)
+
+// What each mode allows, the modes are closed under intersection
+var syncModeChanges = map[SyncMode]struct{ create, update, delete bool }{
+	ModeMirror:     {create: true, update: true, delete: true},
+	ModeAdditive:   {create: true, update: true},
+	ModeUpdateOnly: {update: true},
+	ModeCreateOnly: {create: true},
+}
+
+func ParseSyncMode(s string) (SyncMode, error) {
+	if s == "" {
+		return ModeMirror, nil
+	}
+	if _, ok := syncModeChanges[SyncMode(s)]; !ok {
+		return "", fmt.Errorf("unknown sync mode %q", s)
+	}
+	return SyncMode(s), nil
+}
+
+// Cleans up paths relative to the sync directory, like docs/api or
+// ./notes/today.md, for SessionOptions.Paths
+func ParseSyncPaths(paths []string) ([]string, error) {
+	var parsed []string
+	for _, p := range paths {
+		clean := path.Clean(filepath.ToSlash(p))
+		if clean == "." {
+			// The whole tree
+			return nil, nil
+		}
+		if err := ValidateFileName(clean); err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, clean)
+	}
+	return parsed, nil
+}
+
+func (m SyncMode) orMirror() SyncMode {
+	if m == "" {
+		return ModeMirror
+	}
+	return m
+}
+
+func (m SyncMode) creates() bool { return syncModeChanges[m.orMirror()].create }
+func (m SyncMode) updates() bool { return syncModeChanges[m.orMirror()].update }
+func (m SyncMode) deletes() bool { return syncModeChanges[m.orMirror()].delete }
+
+// True if m allows nothing other does not
+func (m SyncMode) within(other SyncMode) bool {
+	return (!m.creates() || other.creates()) && (!m.updates() || other.updates()) && (!m.deletes() || other.deletes())
+}
+
+// The mode allowing only what both allow. False if that is nothing.
+func (m SyncMode) intersect(other SyncMode) (SyncMode, bool) {
+	for _, mode := range []SyncMode{ModeMirror, ModeAdditive, ModeUpdateOnly, ModeCreateOnly} {
+		if mode.creates() == (m.creates() && other.creates()) &&
+			mode.updates() == (m.updates() && other.updates()) &&
+			mode.deletes() == (m.deletes() && other.deletes()) {
+			return mode, true
+		}
+	}
+	return "", false
+}
+
+func (o SessionOptions) encode() []byte {
+	v := url.Values{}
+	v.Set("dry_run", strconv.FormatBool(o.DryRun))
+	v.Set("mode", string(o.Mode.orMirror()))
+	v.Set("merge", strconv.FormatBool(o.Merge))
+	for _, p := range o.Paths {
+		v.Add("path", p)
+	}
+	v.Set("resend", "true")
+	v.Set("trees", "true")
+	return []byte(v.Encode())
+}
+
+func parseSessionOptions(data []byte) (SessionOptions, error) {
+	var o SessionOptions
+	v, err := url.ParseQuery(string(data))
+	if err != nil {
+		return o, fmt.Errorf("invalid session options: %w", err)
+	}
+	if dryRun := v.Get("dry_run"); dryRun != "" {
+		if o.DryRun, err = strconv.ParseBool(dryRun); err != nil {
+			return o, fmt.Errorf("invalid dry_run session option: %w", err)
+		}
+	}
+	// Replicas from before modes only mirror
+	if o.Mode, err = ParseSyncMode(v.Get("mode")); err != nil {
+		return o, fmt.Errorf("invalid mode session option: %w", err)
+	}
+	if merge := v.Get("merge"); merge != "" {
+		if o.Merge, err = strconv.ParseBool(merge); err != nil {
+			return o, fmt.Errorf("invalid merge session option: %w", err)
+		}
+	}
+	o.resend = v.Get("resend") == "true"
+	o.trees = v.Get("trees") == "true"
+	for _, p := range v["path"] {
+		if err := ValidateFileName(p); err != nil {
+			return o, fmt.Errorf("invalid path session option: %w", err)
+		}
+		o.Paths = append(o.Paths, p)
+	}
+	return o, nil
+}
+
+// Main proposes s.Options and takes on whatever the replica answers with
+func (s *Syncer) sendHello(reader *bufio.Reader) error {
+	hello := Message{Type: MsgTypeHello, Data: s.Options.encode()}
+	if err := s.SendMessage(hello); err != nil {
+		return fmt.Errorf("failed to send hello message: %w", err)
+	}
+	slog.Debug("Main sent hello message", "type", string(hello.Type), "options", string(hello.Data))
+
+	msg, err := s.readMessage(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read hello response from replica: %w", err)
+	}
+	switch msg.Type {
+	case MsgTypeHello:
+	case MsgTypeError:
+		return msg.asProtocolError()
+	default:
+		return s.abort(ErrCodeProtocol, "", fmt.Sprintf("unexpected message type from replica: expected %c, got %c", MsgTypeHello, msg.Type))
+	}
+
+	options, err := parseSessionOptions(msg.Data)
+	if err != nil {
+		return s.abort(ErrCodeProtocol, "", err.Error())
+	}
+	if !options.Mode.within(s.Options.Mode) {
+		return s.abort(ErrCodeProtocol, "", fmt.Sprintf("replica would sync in %s mode rather than %s", options.Mode, s.Options.Mode.orMirror()))
+	}
+	// Replicas from before selective sync would delete everything else
+	if !slices.Equal(options.Paths, s.Options.Paths) {
+		return s.abort(ErrCodeProtocol, "", "replica does not support syncing selected paths")
+	}
+	s.Options = options
+	slog.Debug("Main received hello message", "type", string(msg.Type), "options", string(msg.Data))
+	return nil
+}
+
+// Refuse turns main's session away with pe in place of the hello, so main
+// fails with the reason rather than a dropped connection. Use it on the
+// replica when something goes wrong before Run.
+func (s *Syncer) Refuse(pe *ProtocolError) error {
+	defer s.Conn.Close()
+	defer s.startSession()()
+	reader := bufio.NewReader(s.connReader())
+
+	if _, err := s.readMessage(reader); err != nil {
+		return errors.Join(pe, fmt.Errorf("failed to read hello message from main: %w", err))
+	}
+	s.sendFatal(pe)
+	return pe
+}
+
+// Replica reads main's proposed options and answers with the ones it applies
+func (s *Syncer) receiveHello(reader *bufio.Reader) error {
+	msg, err := s.readMessage(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read hello message from main: %w", err)
+	}
+	if msg.Type != MsgTypeHello {
+		return s.abort(ErrCodeProtocol, "", fmt.Sprintf("unexpected message type from main: expected %c, got %c", MsgTypeHello, msg.Type))
+	}
+	options, err := parseSessionOptions(msg.Data)
+	if err != nil {
+		return s.abort(ErrCodeProtocol, "", err.Error())
+	}
+	slog.Debug("Replica received hello message", "type", string(msg.Type), "options", string(msg.Data))
+
+	if s.Client != nil {
+		needed := PermissionPush
+		if options.DryRun {
+			needed = PermissionPull
+		}
+		if !s.Client.Can(needed) {
+			slog.Warn("Client key lacks permission for session", "keyID", s.Client.ID, "permission", string(needed))
+			return s.abort(ErrCodePermission, "", fmt.Sprintf("key %q does not have %s permission", s.Client.ID, needed))
+		}
+	}
+
+	if s.Mode != "" {
+		mode, ok := options.Mode.intersect(s.Mode)
+		if !ok {
+			return s.abort(ErrCodePermission, "", fmt.Sprintf("%s mode leaves nothing to sync on a replica limited to %s mode", options.Mode, s.Mode))
+		}
+		if mode != options.Mode {
+			slog.Info("Limiting session mode", "asked", string(options.Mode), "mode", string(mode))
+		}
+		options.Mode = mode
+	}
+	if options.Merge && s.MergeBases == nil {
+		slog.Info("Refusing to merge as no merge bases are kept")
+		options.Merge = false
+	}
+
+	s.Options = options
+	reply := Message{Type: MsgTypeHello, Data: s.Options.encode()}
+	if err := s.SendMessage(reply); err != nil {
+		return fmt.Errorf("failed to send hello response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package filesyncer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const snapshotsDirName = "snapshots"
+
+var ErrSnapshotNotFound = errors.New("Snapshot not found")
+
+// Snapshot is an immutable record of a synced tree at a point in time. The
+// file contents live in the ObjectStore so unchanged files cost nothing.
+type Snapshot struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	// md5 of each file by path
+	Files map[string]string `json:"files"`
+}
+
+// SnapshotChange is how a path differs between two snapshots
+type SnapshotChange struct {
+	Path   string `json:"path"`
+	Change string `json:"change"`
+}
+
+const (
+	SnapshotAdded    = "added"
+	SnapshotRemoved  = "removed"
+	SnapshotModified = "modified"
+)
+
+// RetentionPolicy is which snapshots Prune keeps. A snapshot is kept if
+// either rule keeps it, and zero rules keep everything.
+type RetentionPolicy struct {
+	// Keep this many of the newest snapshots
+	KeepLast int
+	// Keep snapshots younger than this
+	KeepWithin time.Duration
+}
+
+// Snapshots manages the snapshots in the state directory of a synced
+// directory
+type Snapshots struct {
+	Retention RetentionPolicy
+
+	dir     string
+	objects *ObjectStore
+	bases   *MergeBases
+	now     func() time.Time
+}
+
+func NewSnapshots(directory string) *Snapshots {
+	return &Snapshots{
+		dir:     filepath.Join(directory, StateDirName, snapshotsDirName),
+		objects: NewObjectStore(directory),
+		bases:   NewMergeBases(directory),
+		now:     time.Now,
+	}
+}
+
+// Records the files in fc as a new snapshot, storing any content not
+// already held
+func (s *Snapshots) Take(fc *FileCache) (*Snapshot, error) {
+	snap := &Snapshot{Created: s.now().UTC(), Files: map[string]string{}}
+	for name, fcData := range fc.data {
+		id := fcData.md5
+		if !s.objects.Has(id) {
+			f, err := fc.store.Open(name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s for snapshot: %w", name, err)
+			}
+			// The content may have moved on since it was hashed, so keep
+			// whatever was actually stored
+			id, _, err = s.objects.Put(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to store %s for snapshot: %w", name, err)
+			}
+		}
+		snap.Files[name] = id
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	base := snap.Created.Format("20060102T150405Z")
+	snap.ID = base
+	for i := 2; ; i++ {
+		if _, err := os.Stat(s.manifestPath(snap.ID)); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		snap.ID = fmt.Sprintf("%s-%d", base, i)
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, "incoming-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), s.manifestPath(snap.ID)); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func (s *Snapshots) manifestPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// Every snapshot, oldest first
+func (s *Snapshots) List() ([]*Snapshot, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snaps []*Snapshot
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		snap, err := s.Load(id)
+		if err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		if snaps[i].Created.Equal(snaps[j].Created) {
+			return snaps[i].ID < snaps[j].ID
+		}
+		return snaps[i].Created.Before(snaps[j].Created)
+	})
+	return snaps, nil
+}
+
+// Loads a snapshot by id. "latest" is the newest one.
+func (s *Snapshots) Load(id string) (*Snapshot, error) {
+	if id == "latest" {
+		snaps, err := s.List()
+		if err != nil {
+			return nil, err
+		}
+		if len(snaps) == 0 {
+			return nil, fmt.Errorf("%w: there are no snapshots", ErrSnapshotNotFound)
+		}
+		return snaps[len(snaps)-1], nil
+	}
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return nil, fmt.Errorf("%w: %q", ErrSnapshotNotFound, id)
+	}
+
+	data, err := os.ReadFile(s.manifestPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %q", ErrSnapshotNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to parse snapshot %s", id), err)
+	}
+	return &snap, nil
+}
+
+// Lists what changed going from one snapshot to the other, sorted by path
+func DiffSnapshots(from *Snapshot, to *Snapshot) []SnapshotChange {
+	var changes []SnapshotChange
+	for name, id := range to.Files {
+		old, ok := from.Files[name]
+		switch {
+		case !ok:
+			changes = append(changes, SnapshotChange{Path: name, Change: SnapshotAdded})
+		case old != id:
+			changes = append(changes, SnapshotChange{Path: name, Change: SnapshotModified})
+		}
+	}
+	for name := range from.Files {
+		if _, ok := to.Files[name]; !ok {
+			changes = append(changes, SnapshotChange{Path: name, Change: SnapshotRemoved})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// Writes the files of a snapshot into target. Files already in target that
+// are not in the snapshot are left alone.
+func (s *Snapshots) Restore(id string, target string) error {
+	snap, err := s.Load(id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	store := NewLocalStore(target)
+	for name, objectID := range snap.Files {
+		if err := ValidateFileName(name); err != nil {
+			return err
+		}
+		if err := s.restoreFile(store, name, objectID); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *Snapshots) restoreFile(store Store, name string, objectID string) error {
+	in, err := s.objects.Open(objectID)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := store.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Abort()
+		return err
+	}
+	return out.Close()
+}
+
+// Removes the snapshots the retention policy does not keep, then any
+// objects no remaining snapshot uses. Returns the ids of the removed
+// snapshots.
+func (s *Snapshots) Prune() ([]string, error) {
+	snaps, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	policy := s.Retention
+	if policy.KeepLast > 0 || policy.KeepWithin > 0 {
+		now := s.now()
+		for i, snap := range snaps {
+			keep := (policy.KeepLast > 0 && i >= len(snaps)-policy.KeepLast) ||
+				(policy.KeepWithin > 0 && now.Sub(snap.Created) < policy.KeepWithin)
+			if keep {
+				continue
+			}
+			if err := os.Remove(s.manifestPath(snap.ID)); err != nil {
+				return removed, err
+			}
+			removed = append(removed, snap.ID)
+		}
+	}
+	if err := s.collectGarbage(); err != nil {
+		return removed, err
+	}
+	return removed, nil
+}
+
+// Removes objects no snapshot or merge base refers to
+func (s *Snapshots) collectGarbage() error {
+	used, err := s.usedObjects()
+	if err != nil {
+		return err
+	}
+	ids, err := s.objects.List()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if used[id] {
+			continue
+		}
+		if err := s.objects.Remove(id); err != nil {
+			return err
+		}
+		slog.Debug("Removed unused object", "id", id)
+	}
+	return nil
+}
+
+// Ids of the objects a snapshot or merge base refers to
+func (s *Snapshots) usedObjects() (map[string]bool, error) {
+	snaps, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	bases, err := s.bases.Load()
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	for _, snap := range snaps {
+		for _, id := range snap.Files {
+			used[id] = true
+		}
+	}
+	for _, id := range bases {
+		used[id] = true
+	}
+	return used, nil
+}
@@ -0,0 +1,96 @@
+package filesyncer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotsAcrossSyncs(t *testing.T) {
+	mainDir, replicaDir := t.TempDir(), t.TempDir()
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)}
+	snapshots := NewSnapshots(replicaDir)
+	snapshots.now = clock.Now
+
+	sync := func() *SyncReport {
+		mainFC, err := CreateFileCache(mainDir)
+		assert.NoError(t, err)
+		replicaFC, err := CreateFileCache(replicaDir)
+		assert.NoError(t, err)
+		_, replicaReport := runTestSync(t, &Syncer{FileCache: mainFC}, &Syncer{Replica: true, FileCache: replicaFC, Snapshots: snapshots})
+		clock.now = clock.now.Add(time.Hour)
+		return replicaReport
+	}
+
+	writeTestFiles(t, mainDir, map[string]string{"a.md": "# A\n", "b.md": "# B\n", "docs/c.md": "# C\n"})
+	first := sync()
+	assert.Equal(t, "20260301T090000Z", first.Snapshot)
+
+	writeTestFiles(t, mainDir, map[string]string{"a.md": "# A changed\n"})
+	assert.NoError(t, os.Remove(filepath.Join(mainDir, "b.md")))
+	second := sync()
+
+	// Only the changed content is stored again
+	objects, err := snapshots.objects.List()
+	assert.NoError(t, err)
+	assert.Len(t, objects, 4)
+
+	from, err := snapshots.Load(first.Snapshot)
+	assert.NoError(t, err)
+	to, err := snapshots.Load("latest")
+	assert.NoError(t, err)
+	assert.Equal(t, second.Snapshot, to.ID)
+	assert.Equal(t, []SnapshotChange{
+		{Path: "a.md", Change: SnapshotModified},
+		{Path: "b.md", Change: SnapshotRemoved},
+	}, DiffSnapshots(from, to))
+
+	target := t.TempDir()
+	assert.NoError(t, snapshots.Restore(first.Snapshot, target))
+	data, err := os.ReadFile(filepath.Join(target, "a.md"))
+	assert.NoError(t, err)
+	assert.Equal(t, "# A\n", string(data))
+	_, err = os.Stat(filepath.Join(target, "b.md"))
+	assert.NoError(t, err)
+
+	// Pruning the first snapshot drops the content only it used
+	snapshots.Retention = RetentionPolicy{KeepLast: 1}
+	removed, err := snapshots.Prune()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{first.Snapshot}, removed)
+	objects, err = snapshots.objects.List()
+	assert.NoError(t, err)
+	assert.Len(t, objects, 2)
+
+	_, err = snapshots.Load(first.Snapshot)
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+}
+
+func TestRetentionKeepWithin(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{"a.md": "# A\n"})
+	fc, err := CreateFileCache(dir)
+	assert.NoError(t, err)
+
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)}
+	snapshots := NewSnapshots(dir)
+	snapshots.now = clock.Now
+	for range 5 {
+		_, err := snapshots.Take(fc)
+		assert.NoError(t, err)
+		clock.now = clock.now.Add(24 * time.Hour)
+	}
+
+	snapshots.Retention = RetentionPolicy{KeepWithin: 80 * time.Hour}
+	removed, err := snapshots.Prune()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"20260301T000000Z", "20260302T000000Z"}, removed)
+
+	snaps, err := snapshots.List()
+	assert.NoError(t, err)
+	assert.Len(t, snaps, 3)
+	assert.True(t, snapshots.objects.Has(snaps[0].Files["a.md"]))
+}
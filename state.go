@@ -0,0 +1,64 @@
+package filesyncer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Directory inside a synced directory where file-syncer keeps its own state.
+// It is never synced.
+const StateDirName = ".filesyncer"
+
+const lastSyncFileName = "last-sync.json"
+
+// SyncState is what is remembered locally about the last sync
+type SyncState struct {
+	Finished time.Time   `json:"finished"`
+	Peer     string      `json:"peer"`
+	Report   *SyncReport `json:"report"`
+}
+
+// Saves the state of the last sync inside directory
+func SaveLastSync(directory string, state SyncState) error {
+	stateDir := filepath.Join(directory, StateDirName)
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a crash never leaves a half written state file
+	tmp, err := os.CreateTemp(stateDir, lastSyncFileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(stateDir, lastSyncFileName))
+}
+
+// Loads the state of the last sync in directory. Returns an error wrapping
+// os.ErrNotExist if there has not been one.
+func LoadLastSync(directory string) (*SyncState, error) {
+	data, err := os.ReadFile(filepath.Join(directory, StateDirName, lastSyncFileName))
+	if err != nil {
+		return nil, err
+	}
+	var state SyncState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to parse %s", lastSyncFileName), err)
+	}
+	return &state, nil
+}
@@ -0,0 +1,36 @@
+package filesyncer
+
+import (
+	"io"
+	"time"
+)
+
+// Store is where a FileCache keeps its files. Names are slash separated paths
+// relative to the root of the store, already checked by ValidateFileName.
+// Implementations must be safe for use from several goroutines.
+type Store interface {
+	// Every file in the store, in any order. The state directory is left out.
+	List() ([]FileInfo, error)
+	Stat(name string) (FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	// Starts replacing name, creating parent directories as needed
+	Create(name string) (FileWriter, error)
+	// Moves from onto to, replacing anything already there
+	Rename(from string, to string) error
+	Remove(name string) error
+}
+
+// FileInfo describes a file in a Store
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// FileWriter is new content for a file in a Store. Nothing is visible until
+// Close succeeds, and Abort throws the content away instead.
+type FileWriter interface {
+	io.Writer
+	Close() error
+	Abort() error
+}
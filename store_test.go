@@ -0,0 +1,241 @@
+package filesyncer
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Behaviour every Store should share
+func testStore(t *testing.T, store Store) {
+	write := func(name string, content string) {
+		w, err := store.Create(name)
+		if assert.NoError(t, err) {
+			_, err = w.Write([]byte(content))
+			assert.NoError(t, err)
+			assert.NoError(t, w.Close())
+		}
+	}
+	read := func(name string) string {
+		f, err := store.Open(name)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		assert.NoError(t, err)
+		return string(data)
+	}
+	names := func() []string {
+		files, err := store.List()
+		assert.NoError(t, err)
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	write("a.md", "# A\n")
+	write("docs/api/b.md", "# B\n")
+	write(StateDirName+"/last-sync.json", "{}")
+	assert.Equal(t, []string{"a.md", "docs/api/b.md"}, names())
+	assert.Equal(t, "# B\n", read("docs/api/b.md"))
+
+	info, err := store.Stat("a.md")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), info.Size)
+
+	// Aborted writes leave the old content alone
+	w, err := store.Create("a.md")
+	assert.NoError(t, err)
+	w.Write([]byte("half"))
+	assert.NoError(t, w.Abort())
+	assert.Equal(t, "# A\n", read("a.md"))
+	assert.Equal(t, []string{"a.md", "docs/api/b.md"}, names())
+
+	assert.NoError(t, store.Rename("a.md", "moved/a.md"))
+	assert.Equal(t, "# A\n", read("moved/a.md"))
+	assert.NoError(t, store.Remove("docs/api/b.md"))
+	assert.Equal(t, []string{"moved/a.md"}, names())
+
+	_, err = store.Open("a.md")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestLocalStore(t *testing.T) {
+	dir := t.TempDir()
+	testStore(t, NewLocalStore(dir))
+
+	// Nothing outside the directory is reachable
+	outside := t.TempDir()
+	assert.NoError(t, os.Symlink(outside, filepath.Join(dir, "escape")))
+	_, err := NewLocalStore(dir).Create("escape/x.md")
+	assert.Error(t, err)
+
+	// Removing the last file in a directory removes the directory, and any
+	// above it left empty
+	store := NewLocalStore(dir)
+	writeTestFiles(t, dir, map[string]string{"docs/a.md": "# A\n", "docs/deep/er/b.md": "# B\n"})
+	assert.NoError(t, store.Remove("docs/deep/er/b.md"))
+	_, err = os.Stat(filepath.Join(dir, "docs", "deep"))
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, store.Remove("docs/a.md"))
+	_, err = os.Stat(filepath.Join(dir, "docs"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dir)
+	assert.NoError(t, err, "The store's own directory is kept")
+}
+
+func TestMemStore(t *testing.T) {
+	testStore(t, NewMemStore())
+}
+
+// A replica can sync into something other than a directory
+func TestSyncerIntoMemStore(t *testing.T) {
+	mainDir := t.TempDir()
+	writeTestFiles(t, mainDir, map[string]string{"a.md": "# A\n", "notes/b.md": "# B\n"})
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+
+	store := NewMemStore()
+	w, _ := store.Create("old.md")
+	w.Write([]byte("# Old\n"))
+	w.Close()
+	replicaFC, err := CreateFileCacheFromStore(store, FileCacheOptions{})
+	assert.NoError(t, err)
+
+	_, replicaReport := runTestSync(t, &Syncer{FileCache: mainFC}, &Syncer{Replica: true, FileCache: replicaFC})
+	assert.Equal(t, map[string]FileAction{"a.md": ActionReceived, "notes/b.md": ActionReceived, "old.md": ActionDeleted}, reportActions(replicaReport))
+	assert.Equal(t, "# B\n", string(store.files["notes/b.md"].data))
+	_, ok := store.files["old.md"]
+	assert.False(t, ok)
+}
+
+func TestDedupStore(t *testing.T) {
+	dir := t.TempDir()
+	store := NewDedupStore(dir)
+	testStore(t, store)
+
+	for _, name := range []string{"one.md", "nested/two.md"} {
+		w, err := store.Create(name)
+		assert.NoError(t, err)
+		w.Write([]byte("# Same\n"))
+		assert.NoError(t, w.Close())
+	}
+	one, err := os.Stat(filepath.Join(dir, "one.md"))
+	assert.NoError(t, err)
+	two, err := os.Stat(filepath.Join(dir, "nested", "two.md"))
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(one, two))
+
+	// Overwriting one of them leaves the other and the stored object alone
+	w, _ := store.Create("one.md")
+	w.Write([]byte("# Changed\n"))
+	assert.NoError(t, w.Close())
+	data, err := os.ReadFile(filepath.Join(dir, "nested", "two.md"))
+	assert.NoError(t, err)
+	assert.Equal(t, "# Same\n", string(data))
+
+	size, err := store.LinkObject("three.md", "be82a2b01fa8d7ff0ed35e28ecbe3f21")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Zero(t, size)
+}
+
+// Identical files are sent once per session and stored once on a dedup
+// replica, and content the replica stored before is never sent again
+func TestSyncerDedup(t *testing.T) {
+	mainDir, replicaDir := t.TempDir(), t.TempDir()
+	writeTestFiles(t, mainDir, map[string]string{
+		"a.md":          "# Template\n",
+		"b.md":          "# Template\n",
+		"docs/c.md":     "# Template\n",
+		"unique.md":     "# Unique\n",
+		"docs/other.md": "# Other\n",
+	})
+	sync := func() (*SyncReport, *SyncReport) {
+		mainFC, err := CreateFileCache(mainDir)
+		assert.NoError(t, err)
+		replicaFC, err := CreateFileCacheFromStore(NewDedupStore(replicaDir), FileCacheOptions{})
+		assert.NoError(t, err)
+		return runTestSync(t, &Syncer{FileCache: mainFC}, &Syncer{Replica: true, FileCache: replicaFC, WriteWorkers: 1})
+	}
+
+	mainReport, replicaReport := sync()
+	// Copies are either linked to what was just sent or found by the replica
+	// when checked, depending on how far its writes have got
+	assert.Equal(t, 3, mainReport.Count(ActionSent))
+	assert.Equal(t, int64(len("# Template\n")+len("# Unique\n")+len("# Other\n")), mainReport.Bytes())
+	assert.Equal(t, 3, replicaReport.Count(ActionReceived))
+	assert.Equal(t, 2, replicaReport.Count(ActionReused))
+
+	a, err := os.Stat(filepath.Join(replicaDir, "a.md"))
+	assert.NoError(t, err)
+	c, err := os.Stat(filepath.Join(replicaDir, "docs", "c.md"))
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(a, c))
+
+	// Gone from the replica but still in its object store
+	for _, name := range []string{"a.md", "b.md", "docs/c.md"} {
+		assert.NoError(t, os.Remove(filepath.Join(replicaDir, name)))
+	}
+	mainReport, replicaReport = sync()
+	assert.Equal(t, 0, mainReport.Count(ActionSent))
+	assert.Equal(t, int64(0), mainReport.Bytes())
+	assert.Equal(t, 3, replicaReport.Count(ActionReused))
+	data, err := os.ReadFile(filepath.Join(replicaDir, "docs", "c.md"))
+	assert.NoError(t, err)
+	assert.Equal(t, "# Template\n", string(data))
+}
+
+func md5Of(content string) string {
+	sum := md5.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Contents no file on a dedup replica uses any more are removed at the end
+// of the session, unless a snapshot still needs them
+func TestSyncerDedupCollectsGarbage(t *testing.T) {
+	mainDir, replicaDir := t.TempDir(), t.TempDir()
+	writeTestFiles(t, mainDir, map[string]string{"a.md": "# A\n", "b.md": "# B\n", "c.md": "# C\n", "copy.md": "# C\n"})
+	objects := NewObjectStore(replicaDir)
+	sync := func(snapshots *Snapshots) {
+		mainFC, err := CreateFileCache(mainDir)
+		assert.NoError(t, err)
+		replicaFC, err := CreateFileCacheFromStore(NewDedupStore(replicaDir), FileCacheOptions{})
+		assert.NoError(t, err)
+		runTestSync(t, &Syncer{FileCache: mainFC}, &Syncer{Replica: true, FileCache: replicaFC, Snapshots: snapshots})
+	}
+	stored := func() []string {
+		ids, err := objects.List()
+		assert.NoError(t, err)
+		sort.Strings(ids)
+		return ids
+	}
+
+	sync(nil)
+	assert.Len(t, stored(), 3)
+
+	// Overwritten, deleted, and deleted while another file shares it
+	writeTestFiles(t, mainDir, map[string]string{"a.md": "# New A\n"})
+	assert.NoError(t, os.Remove(filepath.Join(mainDir, "b.md")))
+	assert.NoError(t, os.Remove(filepath.Join(mainDir, "copy.md")))
+	sync(nil)
+	assert.ElementsMatch(t, []string{md5Of("# New A\n"), md5Of("# C\n")}, stored())
+
+	// Snapshots keep what they refer to
+	sync(NewSnapshots(replicaDir))
+	assert.NoError(t, os.Remove(filepath.Join(mainDir, "c.md")))
+	sync(nil)
+	assert.ElementsMatch(t, []string{md5Of("# New A\n"), md5Of("# C\n")}, stored())
+	_, err := os.Stat(filepath.Join(replicaDir, "c.md"))
+	assert.True(t, os.IsNotExist(err))
+}
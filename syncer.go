@@ -5,27 +5,90 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
-	"os"
-	"path"
+	"sync"
+	"time"
 )
 
 type Syncer struct {
 	Replica   bool
 	Conn      io.ReadWriteCloser
 	FileCache *FileCache
+	// Proposed by main at the start of the session. After the handshake
+	// both sides hold the options the replica agreed to.
+	Options SessionOptions
+	// Per file errors that did not stop the session, filled in by Run
+	FileErrors []*ProtocolError
+
+	// Longest wait for the other side to read or write anything. Zero means no limit.
+	IdleTimeout time.Duration
+	// Longest a whole session may take. Zero means no limit.
+	SessionTimeout time.Duration
+	// How often to ping the other side so idle timeouts and NAT mappings
+	// don't kill a healthy but quiet connection. Zero disables pings.
+	HeartbeatInterval time.Duration
+	// Optional hooks into what the session is doing
+	Observer Observer
+	// Most files main has in flight at once. Zero uses a default.
+	Window int
+	// Most files the replica writes at once. Zero uses a default.
+	WriteWorkers int
+	// How many times the replica asks for a file again when what it wrote
+	// doesn't hash to main's md5. Zero uses a default.
+	VerifyRetries int
+	// Optional limit on how fast this side writes to the connection
+	Throttle *Throttle
+	// Where the replica records a snapshot after each successful session.
+	// Nil takes none.
+	Snapshots *Snapshots
+	// The most the replica lets main change. Sessions run in the stricter of
+	// this and the mode main asks for. Empty allows everything.
+	Mode SyncMode
+	// Where the replica keeps the version of each file from the last
+	// session, which tells it whether main, the replica or both changed a
+	// file since. Nil refuses to merge and ignores ConflictRules.
+	MergeBases *MergeBases
+	// How the replica resolves files changed on both sides, the first rule
+	// matching a file wins. Files no rule matches are merged in merge
+	// sessions and otherwise take main's version.
+	ConflictRules []ConflictRule
+	// Key main authenticated with. The replica limits the session to what
+	// it allows. Nil allows everything.
+	Client *ClientKey
+
+	sessionDeadline time.Time
+	pongs           chan struct{}
+	writeMu         sync.Mutex
+	observerMu      sync.Mutex
+	fileErrorsMu    sync.Mutex
+	report          *SyncReport
 }
 
 func (s *Syncer) SendMessage(msg Message) error {
+	return s.sendMessage(msg, nil)
+}
+
+// Sends the message calling progress with the number of msg.Data bytes
+// written after each chunk goes out
+func (s *Syncer) sendMessage(msg Message, progress func(sent int64)) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
 	msgBuf := msg.AsBytesBuf()
+	headerLen := len(msgBuf) - len(msg.Data) - 1
 	totalWritten := 0
 	for totalWritten < len(msgBuf) {
-		n, err := s.Conn.Write(msgBuf[totalWritten:])
-		slog.Debug("SendMessage", "sent", string(msgBuf[totalWritten:]))
+		end := min(totalWritten+s.nextChunkSize(), len(msgBuf))
+		n, err := s.writeChunk(msgBuf[totalWritten:end])
+		slog.Debug("SendMessage", "sent", string(msgBuf[totalWritten:end]))
 		if err != nil {
 			return errors.Join(err, fmt.Errorf("Could not send msg data to tcp connection"))
 		}
 		totalWritten += n
+		if progress != nil {
+			progress(int64(min(max(totalWritten-headerLen, 0), len(msg.Data))))
+		}
 	}
 	return nil
 }
@@ -40,53 +103,218 @@ func (s *Syncer) SendFinish() error {
 	return nil
 }
 
-func (s *Syncer) Run() error {
+// Ends this side of a session with the digest of its tree
+func (s *Syncer) sendFinish() error {
+	s.report.TreeDigest = s.FileCache.treeDigest(s.inTree)
+	return s.SendMessage(Message{Type: MsgTypeFinish, MD5: s.report.TreeDigest})
+}
+
+// Resets the per session state. The returned func stops the heartbeat.
+func (s *Syncer) startSession() func() {
+	s.report = newSyncReport(s.Replica)
+	return s.startKeepalive()
+}
+
+// Reads the next message, answering and skipping heartbeats on the way
+func (s *Syncer) readMessage(reader *bufio.Reader) (Message, error) {
+	for {
+		msgStream, err := reader.ReadBytes('\x00')
+		if err != nil {
+			return Message{}, fmt.Errorf("failed to read message: %w", err)
+		}
+		msg, err := ParseMessage(msgStream)
+		if err != nil {
+			return msg, &ProtocolError{Code: ErrCodeProtocol, Text: fmt.Sprintf("failed to parse message: %s", err)}
+		}
+
+		switch msg.Type {
+		case MsgTypePing:
+			select {
+			case s.pongs <- struct{}{}:
+			default:
+				// A pong is already waiting to go out
+			}
+		case MsgTypePong:
+		default:
+			return msg, nil
+		}
+	}
+}
+
+// Records an error that only affects one file so the session can carry on
+func (s *Syncer) fileFailed(pe *ProtocolError) {
+	slog.Warn("File failed to sync", "filename", pe.Path, "code", string(pe.Code), "error", pe.Text, "remote", pe.Remote)
+	s.fileErrorsMu.Lock()
+	s.FileErrors = append(s.FileErrors, pe)
+	s.fileErrorsMu.Unlock()
+	s.report.recordFailure(pe)
+}
+
+// Tells the other side about a fatal error before the session is torn down.
+// The write gets a short deadline as the other side may not be reading.
+func (s *Syncer) sendFatal(pe *ProtocolError) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if dc, ok := s.Conn.(deadlineConn); ok {
+		dc.SetWriteDeadline(time.Now().Add(time.Second))
+	}
+	msg := pe.asMessage()
+	if _, err := s.Conn.Write(msg.AsBytesBuf()); err != nil {
+		slog.Warn("Could not send error message", "filename", pe.Path, "error", err)
+	}
+}
+
+// Sends a fatal protocol error and returns it for the caller to return
+func (s *Syncer) abort(code ErrCode, filename string, text string) error {
+	pe := &ProtocolError{Code: code, Path: filename, Text: text}
+	s.sendFatal(pe)
+	return pe
+}
+
+// Runs one session and returns what it did to each file. The report is
+// returned even when the session fails part way.
+func (s *Syncer) Run() (*SyncReport, error) {
+	s.FileErrors = nil
+	role := "main"
 	if s.Replica {
-		return s.RunAsReplica()
+		role = "replica"
+	}
+	metrics.sessionsStarted.inc(role)
+	s.observer().SessionStarted(s.Replica)
+
+	var err error
+	if s.Replica {
+		err = s.RunAsReplica()
 	} else {
-		return s.RunAsMain()
+		err = s.RunAsMain()
+	}
+	if err == nil && len(s.FileErrors) > 0 {
+		err = fmt.Errorf("%w: %d file(s)", ErrFilesFailed, len(s.FileErrors))
+	}
+	if err == nil {
+		err = s.checkTrees()
+	}
+	if err == nil && s.Replica && s.Snapshots != nil && !s.Options.DryRun {
+		err = s.takeSnapshot()
+	}
+	if s.Replica && !s.Options.DryRun {
+		s.collectGarbage()
+	}
+	s.report.finish(err)
+	s.observer().SessionEnded(s.report, err)
+	metrics.sessionSeconds.observe(s.report.Duration)
+	if err != nil {
+		metrics.sessionsFailed.inc(role)
+	} else {
+		metrics.sessionsCompleted.inc(role)
+	}
+	return s.report, err
+}
+
+// Records the tree the session left behind and prunes old snapshots
+func (s *Syncer) takeSnapshot() error {
+	snap, err := s.Snapshots.Take(s.FileCache)
+	if err != nil {
+		slog.Error("Could not record snapshot", "error", err)
+		return fmt.Errorf("failed to record snapshot: %w", err)
+	}
+	s.report.Snapshot = snap.ID
+	slog.Info("Recorded snapshot", "id", snap.ID, "files", len(snap.Files))
+
+	removed, err := s.Snapshots.Prune()
+	if err != nil {
+		slog.Error("Could not prune snapshots", "error", err)
+		return fmt.Errorf("failed to prune snapshots: %w", err)
+	}
+	if len(removed) > 0 {
+		slog.Info("Pruned snapshots", "removed", removed)
+	}
+	return nil
+}
+
+// Frees stored contents the session left unused. The files are already
+// synced, so failing to is only logged.
+func (s *Syncer) collectGarbage() {
+	gc, ok := s.FileCache.store.(garbageCollector)
+	if !ok {
+		return
+	}
+	if err := gc.CollectGarbage(); err != nil {
+		slog.Warn("Could not remove unused objects", "error", err)
 	}
 }
+
 func (s *Syncer) RunAsMain() error {
 	defer s.Conn.Close()
-	reader := bufio.NewReader(s.Conn)
+	defer s.startSession()()
+	reader := bufio.NewReader(s.connReader())
 
-	for fileName, fcData := range s.FileCache.data {
-		// Send out msg to reciver to replica
-		checkMsg := Message{Type: MsgTypeCheck, FileName: fileName, MD5: fcData.md5}
-		_, err := s.Conn.Write(checkMsg.AsBytesBuf()) // I am going to assume the msg is so small I don't need to check n
-		slog.Debug("Main check message sent", "type", string(checkMsg.Type), "filename", checkMsg.FileName, "md5", checkMsg.MD5)
+	if err := s.sendHello(reader); err != nil {
+		slog.Error("Session handshake failed", "error", err)
+		return err
+	}
+	s.report.DryRun = s.Options.DryRun
 
-		if err != nil {
-			slog.Error("Could not send message for fileCheck", "filename", fileName, "error", err)
-			return fmt.Errorf("failed to send check message for file %s: %w", fileName, err)
+	// Replies are read on their own goroutine so checks and data can keep
+	// going out while earlier files are still being answered. A file only
+	// asks for its data again once it has been sent, so each has at most one
+	// request queued and sends never blocks the reader.
+	p := newPipeline(s.Window)
+	sends := make(chan transfer, len(s.FileCache.data))
+	walk := s.newTreeWalk()
+	mr := &mainReader{done: make(chan struct{})}
+	go func() {
+		mr.err = s.mainReadLoop(reader, p, sends, walk.answers)
+		close(mr.done)
+		if mr.err != nil {
+			// Unblocks the sender if it is stuck writing
+			s.Conn.Close()
 		}
+	}()
 
-		// Check response from replica then send if non matching
-		msgStream, err := reader.ReadBytes('\x00')
-		if err != nil {
-			slog.Error("Could not read incomming data from replica on check request", "error", err)
-			return fmt.Errorf("failed to read response from replica: %w", err)
+	if err := s.mainSendLoop(p, sends, mr, walk); err != nil {
+		select {
+		case <-mr.done:
+			// The reader failing is what stopped the sender
+			if mr.err != nil {
+				return mr.err
+			}
+		default:
+			s.Conn.Close()
+			<-mr.done
 		}
-		msg, err := ParseMessage(msgStream)
-		if err != nil {
-			slog.Error("Could not parse message from msg stream from replica on check request", "error", err)
-			return fmt.Errorf("failed to parse message from replica: %w", err)
+		return err
+	}
+	<-mr.done
+	return mr.err
+}
+
+// Sends a check for every file or directory of the walk, the data for any
+// file the replica asked for, and finally the finish message
+func (s *Syncer) mainSendLoop(p *pipeline, sends <-chan transfer, mr *mainReader, walk *treeWalk) error {
+	for walk.remaining() {
+		// With nothing queued only a directory answer can add more
+		hasNext := len(walk.queue) > 0
+		if err := s.waitForSlot(p, sends, mr, walk, hasNext); err != nil {
+			return err
 		}
-		slog.Debug("Main received match message", "type", string(msg.Type), "filename", msg.FileName, "match", msg.Match)
-		if msg.Type != MsgTypeMatch {
-			slog.Error("Unexpected msg type from replica on check request", "expected", string(MsgTypeMatch), "got", string(msg.Type))
-			return fmt.Errorf("unexpected message type from replica: expected %c, got %c", MsgTypeMatch, msg.Type)
+		if !hasNext {
+			continue
 		}
-		if !msg.Match {
-			if err := s.SendFile(fileName); err != nil {
-				slog.Error("Failed to send file", "filename", fileName, "error", err)
-				return err
-			}
+		if err := s.sendNextCheck(p, walk); err != nil {
+			return err
 		}
 	}
 
-	err := s.SendFinish()
+	// Holding every slot means every file has been answered
+	for range cap(p.slots) {
+		if err := s.waitForSlot(p, sends, mr, walk, true); err != nil {
+			return err
+		}
+	}
+
+	err := s.sendFinish()
 	if err != nil {
 		slog.Error("Failed to send finish msg", "error", err)
 		return fmt.Errorf("failed to send finish message: %w", err)
@@ -95,110 +323,553 @@ func (s *Syncer) RunAsMain() error {
 	return nil
 }
 
+// Handles the replica's replies until it finishes. Files it wants the data
+// for are handed to the sender on sends and its answers about directories on
+// answers.
+func (s *Syncer) mainReadLoop(reader *bufio.Reader, p *pipeline, sends chan<- transfer, answers chan<- dirAnswer) error {
+	for {
+		msg, err := s.readMessage(reader)
+		if err != nil {
+			slog.Error("Could not read response from replica", "error", err)
+			return fmt.Errorf("failed to read response from replica: %w", err)
+		}
+		slog.Debug("Main received message", "type", string(msg.Type), "filename", msg.FileName, "id", msg.ID)
+
+		switch msg.Type {
+		case MsgTypeMatch:
+			t, ok := p.get(msg.ID)
+			if !ok {
+				return s.abort(ErrCodeProtocol, msg.FileName, fmt.Sprintf("match for unknown request %d", msg.ID))
+			}
+			if t.dir {
+				p.done(t.id)
+				answers <- dirAnswer{dir: t.filename, match: msg.Match, started: t.started}
+				continue
+			}
+			s.observer().FileChecked(t.filename, msg.Match)
+			switch {
+			case msg.Match:
+				action := ActionUnchanged
+				if msg.Action == ActionKept || msg.Action == ActionSkipped || msg.Action == ActionReused {
+					action = msg.Action
+				}
+				s.report.record(FileReport{Path: t.filename, Action: action, Duration: time.Since(t.started)})
+				p.done(t.id)
+			case s.Options.DryRun:
+				s.report.record(FileReport{Path: t.filename, Action: ActionSent, Bytes: t.size, Duration: time.Since(t.started)})
+				p.done(t.id)
+			default:
+				if t.attempts > 0 {
+					slog.Warn("Replica asked for a file again", "filename", t.filename, "attempts", t.attempts)
+				}
+				sends <- t
+			}
+
+		case MsgTypeAck:
+			t, ok := p.get(msg.ID)
+			if !ok {
+				return s.abort(ErrCodeProtocol, msg.FileName, fmt.Sprintf("ack for unknown request %d", msg.ID))
+			}
+			action := ActionSent
+			switch {
+			case t.linked:
+				action = ActionReused
+			case msg.Action == ActionMerged, msg.Action == ActionConflict:
+				action = msg.Action
+			}
+			s.report.record(FileReport{Path: t.filename, Action: action, Bytes: t.size, Duration: time.Since(t.started), Retries: max(t.attempts-1, 0)})
+			p.done(t.id)
+
+		case MsgTypeFinish:
+			slog.Debug("Main received finish message", "type", string(msg.Type), "treeDigest", msg.MD5)
+			s.report.PeerTreeDigest = msg.MD5
+			return nil
+
+		case MsgTypeDeleted:
+			s.report.record(FileReport{Path: msg.FileName, Action: ActionDeleted})
+			s.observer().FileDeleted(msg.FileName)
+
+		case MsgTypeError:
+			pe := msg.asProtocolError()
+			if pe.Fatal() {
+				slog.Error("Replica aborted the session", "filename", pe.Path, "code", string(pe.Code), "error", pe.Text)
+				return pe
+			}
+			if t, ok := p.get(msg.ID); ok && t.dir {
+				// Its files are checked one by one instead
+				slog.Warn("Replica could not compare directory", "dir", pe.Path, "code", string(pe.Code), "error", pe.Text)
+				p.done(t.id)
+				answers <- dirAnswer{dir: t.filename, started: t.started}
+				continue
+			}
+			s.fileFailed(pe)
+			p.done(msg.ID)
+
+		default:
+			slog.Error("Unexpected msg type from replica", "got", string(msg.Type))
+			return s.abort(ErrCodeProtocol, msg.FileName, fmt.Sprintf("unexpected message type from replica: %c", msg.Type))
+		}
+	}
+}
+
 func (s *Syncer) RunAsReplica() error {
 	defer s.Conn.Close()
+	defer s.startSession()()
+
+	reader := bufio.NewReader(s.connReader())
+
+	if err := s.receiveHello(reader); err != nil {
+		slog.Error("Session handshake failed", "error", err)
+		return err
+	}
+	s.report.DryRun = s.Options.DryRun
+
+	rs := newReplicaState()
+	if s.MergeBases != nil {
+		rs.conflictAware = s.Options.Merge || len(s.ConflictRules) > 0
+		bases, err := s.MergeBases.Load()
+		if err != nil {
+			slog.Error("Could not load merge bases", "error", err)
+			return s.abort(ErrCodeInternal, "", fmt.Sprintf("failed to load merge bases: %v", err))
+		}
+		rs.bases = bases
+	}
 
-	reader := bufio.NewReader(s.Conn)
+	// Writes run on worker goroutines but their results, and every other
+	// FileCache update, are applied here on the session goroutine
+	var workers sync.WaitGroup
+	defer workers.Wait()
+	done := make(chan struct{})
+	defer close(done)
+
+	msgs := s.readMessages(reader, done)
+	results := make(chan writeResult)
+	writeWorkers := s.WriteWorkers
+	if writeWorkers <= 0 {
+		writeWorkers = defaultWriteWorkers
+	}
+	slots := make(chan struct{}, writeWorkers)
+	inflight := 0
 
 	// Not sure how I feel about labels...
 OUTER:
 	for {
-		msgStream, err := reader.ReadBytes('\x00')
-		if err != nil {
-			slog.Error("Replica could not read incomming data", "error", err)
-			return fmt.Errorf("failed to read message from main: %w", err)
+		var rr readResult
+		select {
+		case r := <-results:
+			inflight--
+			if err := s.applyWrite(r, rs); err != nil {
+				return err
+			}
+			continue
+		case rr = <-msgs:
 		}
 
-		msg, err := ParseMessage(msgStream)
+		msg, err := rr.msg, rr.err
 		if err != nil {
-			slog.Error("Replica could not parse message from msg stream", "error", err)
-			return fmt.Errorf("failed to parse message from main: %w", err)
+			slog.Error("Replica could not read message from main", "error", err)
+			var pe *ProtocolError
+			if errors.As(err, &pe) {
+				s.sendFatal(pe)
+			}
+			return err
 		}
 
 		switch msg.Type {
 		case MsgTypeFinish:
-			slog.Debug("Replica received finish message", "type", string(msg.Type))
+			slog.Debug("Replica received finish message", "type", string(msg.Type), "treeDigest", msg.MD5)
+			s.report.PeerTreeDigest = msg.MD5
 			break OUTER
 
 		case MsgTypeCheck:
-			slog.Debug("Replica received check message", "type", string(msg.Type), "filename", msg.FileName, "md5", msg.MD5)
-			responseMessage := Message{Type: MsgTypeMatch, FileName: msg.FileName}
-			fileData, ok := s.FileCache.data[msg.FileName]
-			responseMessage.Match = ok && fileData.md5 == msg.MD5
-			respErr := s.SendMessage(responseMessage)
-			slog.Debug("Replica sent match message", "type", string(responseMessage.Type), "filename", responseMessage.FileName, "match", responseMessage.Match)
-			if respErr != nil {
-				slog.Error("Replica failed to send the response message for the md5 file check", "filename", msg.FileName, "error", respErr)
-				return fmt.Errorf("Failed to send match response for file %s: %w", msg.FileName, respErr)
-			}
-
-			// Update the file cache
-			if responseMessage.Match {
-				fileData.synced = true
-				s.FileCache.data[msg.FileName] = fileData
+			if err := s.replicaCheck(msg, rs); err != nil {
+				return err
 			}
 
-		case MsgTypeMatch:
-			slog.Error("Replica received unexpected Match message type", "type", string(msg.Type))
-			return fmt.Errorf("Replica should not receive Match messages")
+		case MsgTypeTree:
+			if err := s.replicaTree(msg, rs); err != nil {
+				return err
+			}
 
 		case MsgTypeData:
-			slog.Debug("Replica received data message", "type", string(msg.Type), "filename", msg.FileName, "dataSize", len(msg.Data))
-			if err := s.WriteFile(msg); err != nil {
-				slog.Error("Failed to write file", "filename", msg.FileName, "error", err)
-				return err
+			if s.Options.DryRun {
+				return s.abort(ErrCodeProtocol, msg.FileName, "main sent data in a dry run session")
 			}
-			fileData, ok := s.FileCache.data[msg.FileName]
-			if ok {
-				fileData.synced = true
-				s.FileCache.data[msg.FileName] = fileData
+			slog.Debug("Replica received data message", "type", string(msg.Type), "filename", msg.FileName, "id", msg.ID, "dataSize", len(msg.Data))
+			if !rs.asked(msg.FileName) {
+				return s.abort(ErrCodeProtocol, msg.FileName, "main sent data for a file the replica did not ask for")
+			}
+			if rs.resending[msg.FileName] {
+				// Still counted from the copy that failed verification
+				delete(rs.resending, msg.FileName)
 			} else {
-				// Not the best idea to just set md5 to empty but only using it for final check on synced so ok for now
-				s.FileCache.data[msg.FileName] = fileCacheData{md5: "", synced: true}
+				rs.writing[rs.wanted[msg.FileName]]++
+			}
+			if err := s.acceptPath(msg.FileName); err != nil {
+				if err := s.applyWrite(writeResult{msg: msg, err: err}, rs); err != nil {
+					return err
+				}
+				continue
+			}
+
+			// Wait for a free writer, applying finished writes meanwhile
+			for acquired := false; !acquired; {
+				select {
+				case slots <- struct{}{}:
+					acquired = true
+				case r := <-results:
+					inflight--
+					if err := s.applyWrite(r, rs); err != nil {
+						return err
+					}
+				}
+			}
+			inflight++
+			workers.Add(1)
+			base, merging := rs.merges[msg.FileName]
+			md5 := rs.wanted[msg.FileName]
+			go func(msg Message, started time.Time) {
+				defer workers.Done()
+				var r writeResult
+				if merging {
+					r = s.mergeFile(msg, base)
+				} else {
+					r = writeResult{msg: msg, err: s.WriteFile(msg)}
+					if r.err == nil {
+						r.err = s.verifyWrite(msg.FileName, md5)
+					}
+				}
+				r.started = started
+				<-slots
+				select {
+				case results <- r:
+				case <-done:
+				}
+			}(msg, time.Now())
+
+		case MsgTypeLink:
+			if s.Options.DryRun {
+				return s.abort(ErrCodeProtocol, msg.FileName, "main sent a link in a dry run session")
+			}
+			slog.Debug("Replica received link message", "type", string(msg.Type), "filename", msg.FileName, "id", msg.ID, "md5", msg.MD5)
+			if !rs.asked(msg.FileName) {
+				return s.abort(ErrCodeProtocol, msg.FileName, "main sent a link for a file the replica did not ask for")
+			}
+			if err := s.replicaLink(msg, rs); err != nil {
+				return err
 			}
 
 		default:
-			slog.Error("Replica received unknown message type", "type", string(msg.Type))
-			return fmt.Errorf("Replica got unknown message type: %c", msg.Type)
+			slog.Error("Replica received unexpected message type", "type", string(msg.Type))
+			return s.abort(ErrCodeProtocol, msg.FileName, fmt.Sprintf("replica got unexpected message type: %c", msg.Type))
+		}
+	}
+
+	for ; inflight > 0; inflight-- {
+		if err := s.applyWrite(<-results, rs); err != nil {
+			return err
 		}
 	}
 
 	// remove all un-recieved files from the cache (aka not synced)
 	for k, v := range s.FileCache.data {
+		if !s.deletesUnsynced(k) {
+			continue
+		}
 		if !v.synced {
-			fileToDelete := path.Join(s.FileCache.directory, k)
-			err := os.Remove(fileToDelete)
+			var err error
+			if !s.Options.DryRun {
+				err = s.FileCache.removeFile(k)
+			}
+			msg := Message{Type: MsgTypeDeleted, FileName: k}
 			if err != nil {
-				slog.Error("Replica could not delete file", "filename", k, "path", fileToDelete, "error", err)
-				return fmt.Errorf("Replica failed to delete file %s: %w", fileToDelete, err)
+				slog.Error("Replica could not delete file", "filename", k, "error", err)
+				pe := newProtocolError(k, err)
+				s.fileFailed(pe)
+				msg = pe.asMessage()
 			} else {
 				slog.Debug("Replica deleting file", "filename", k)
+				if !s.Options.DryRun {
+					s.FileCache.unset(k)
+				}
+				s.report.record(FileReport{Path: k, Action: ActionDeleted})
+				metrics.filesDeleted.add(1)
+				s.observer().FileDeleted(k)
+			}
+			if err := s.SendMessage(msg); err != nil {
+				return fmt.Errorf("failed to send deletion result for file %s: %w", k, err)
 			}
 		}
 	}
+
+	if err := s.sendFinish(); err != nil {
+		slog.Error("Replica failed to send finish msg", "error", err)
+		return fmt.Errorf("failed to send finish message: %w", err)
+	}
+
+	if s.MergeBases != nil && !s.Options.DryRun {
+		if err := s.saveMergeBases(rs); err != nil {
+			slog.Error("Could not save merge bases", "error", err)
+			return fmt.Errorf("failed to save merge bases: %w", err)
+		}
+	}
 	return nil
 }
 
-// Reads the file and then sends it over tcp using the Message format
+// Answers a check from main, serving the file from local content where it can
+func (s *Syncer) replicaCheck(msg Message, rs *replicaState) error {
+	started := time.Now()
+	slog.Debug("Replica received check message", "type", string(msg.Type), "filename", msg.FileName, "id", msg.ID, "md5", msg.MD5)
+	var responseMessage Message
+	if err := s.acceptPath(msg.FileName); err != nil {
+		slog.Error("Replica rejected file name", "filename", msg.FileName, "error", err)
+		pe := newProtocolError(msg.FileName, err)
+		pe.id = msg.ID
+		s.fileFailed(pe)
+		responseMessage = pe.asMessage()
+	} else {
+		rs.checked[msg.FileName] = msg.MD5
+		responseMessage = Message{Type: MsgTypeMatch, FileName: msg.FileName, ID: msg.ID}
+		fileData, ok := s.FileCache.data[msg.FileName]
+		responseMessage.Match = ok && fileData.md5 == msg.MD5
+		action := ActionUnchanged
+		if !responseMessage.Match && ((ok && !s.Options.Mode.updates()) || (!ok && !s.Options.Mode.creates())) {
+			// The session's mode doesn't allow the change
+			responseMessage.Match, responseMessage.Action = true, ActionSkipped
+			action = ActionSkipped
+		}
+		if !responseMessage.Match && ok && rs.conflictAware {
+			kept, err := s.resolveConflict(msg, fileData, rs)
+			if err != nil {
+				slog.Error("Replica could not resolve conflicting changes", "filename", msg.FileName, "error", err)
+				// Whatever happened the replica's version must not be deleted
+				fileData.synced = true
+				s.FileCache.data[msg.FileName] = fileData
+				return s.failFile(msg, err)
+			}
+			if kept {
+				responseMessage.Match, responseMessage.Action = true, ActionKept
+				action = ActionKept
+			}
+		}
+		if _, merging := rs.merges[msg.FileName]; !responseMessage.Match && !merging && !s.Options.DryRun {
+			// Renamed or duplicated files can be served from what we already have
+			var err error
+			responseMessage.Match, err = s.reuseLocalFile(msg.FileName, msg.MD5)
+			if err != nil {
+				slog.Warn("Could not reuse local content, asking main for it", "filename", msg.FileName, "error", err)
+			}
+			if responseMessage.Match {
+				responseMessage.Action = ActionReused
+			}
+			action = ActionReused
+		}
+		if responseMessage.Match {
+			s.report.record(FileReport{Path: msg.FileName, Action: action, Duration: time.Since(started)})
+		} else if s.Options.DryRun {
+			s.report.record(FileReport{Path: msg.FileName, Action: ActionReceived, Duration: time.Since(started)})
+		}
+		s.observer().FileChecked(msg.FileName, responseMessage.Match)
+		if action == ActionReused && responseMessage.Match {
+			s.observer().FileWritten(msg.FileName, s.FileCache.data[msg.FileName].size)
+		}
+	}
+	respErr := s.SendMessage(responseMessage)
+	slog.Debug("Replica sent match message", "type", string(responseMessage.Type), "filename", responseMessage.FileName, "match", responseMessage.Match)
+	if respErr != nil {
+		slog.Error("Replica failed to send the response message for the md5 file check", "filename", msg.FileName, "error", respErr)
+		return fmt.Errorf("Failed to send match response for file %s: %w", msg.FileName, respErr)
+	}
+
+	// Update the file cache
+	if responseMessage.Type != MsgTypeMatch {
+		return nil
+	}
+	switch {
+	// In a dry run a mismatched file would be overwritten, not deleted
+	case responseMessage.Match || s.Options.DryRun:
+		if fileData, ok := s.FileCache.data[msg.FileName]; ok {
+			fileData.synced = true
+			s.FileCache.data[msg.FileName] = fileData
+		}
+	default:
+		// The old content is about to be overwritten so it can't be reused
+		// for other files, and a failed write keeps it rather than deleting it
+		s.FileCache.unset(msg.FileName)
+		rs.wanted[msg.FileName] = msg.MD5
+	}
+	return nil
+}
+
+// Applies the outcome of a write to the FileCache and report then acks it, or
+// tells main why it failed. Links waiting on the content are then resolved.
+func (s *Syncer) applyWrite(r writeResult, rs *replicaState) error {
+	msg := r.msg
+	if s.canAskAgain(r.err, msg.FileName, rs) {
+		// The file stays wanted and counted as being written so links to
+		// its content keep waiting
+		rs.resending[msg.FileName] = true
+		return s.askAgain(msg, r.err, rs)
+	}
+
+	md5 := rs.wanted[msg.FileName]
+	delete(rs.wanted, msg.FileName)
+	if rs.writing[md5]--; rs.writing[md5] <= 0 {
+		delete(rs.writing, md5)
+	}
+
+	if r.err != nil {
+		slog.Error("Failed to write file", "filename", msg.FileName, "error", r.err)
+		if err := s.failFile(msg, r.err); err != nil {
+			return err
+		}
+	} else {
+		if r.action == "" {
+			r.action, r.md5, r.size = ActionReceived, md5, int64(len(msg.Data))
+		}
+		// Index the new content so later checks can reuse it
+		s.FileCache.set(msg.FileName, fileCacheData{md5: r.md5, size: r.size, synced: true})
+		s.report.record(FileReport{Path: msg.FileName, Action: r.action, Bytes: int64(len(msg.Data)), Duration: time.Since(r.started), Retries: rs.retries[msg.FileName]})
+		metrics.filesReceived.add(1)
+		metrics.bytesReceived.add(int64(len(msg.Data)))
+		s.observer().FileWritten(msg.FileName, r.size)
+
+		ack := Message{Type: MsgTypeAck, FileName: msg.FileName, ID: msg.ID}
+		if r.action != ActionReceived {
+			ack.Action = r.action
+		}
+		if err := s.SendMessage(ack); err != nil {
+			return fmt.Errorf("failed to send ack for file %s: %w", msg.FileName, err)
+		}
+	}
+
+	// A failed write leaves the links to wait for another write of the same
+	// content, if there is one
+	if r.err != nil && rs.writing[md5] > 0 {
+		return nil
+	}
+	links := rs.pendingLinks[md5]
+	delete(rs.pendingLinks, md5)
+	for _, link := range links {
+		if err := s.replicaLink(link, rs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Materialises a file from content main already sent this session under
+// another name. Links to content still being written wait for the write.
+func (s *Syncer) replicaLink(msg Message, rs *replicaState) error {
+	if rs.writing[msg.MD5] > 0 {
+		rs.pendingLinks[msg.MD5] = append(rs.pendingLinks[msg.MD5], msg)
+		return nil
+	}
+
+	started := time.Now()
+	if base, merging := rs.merges[msg.FileName]; merging {
+		// The content has to be merged rather than linked
+		data, err := s.FileCache.readHash(msg.MD5)
+		r := writeResult{msg: msg, err: err}
+		if err == nil {
+			r = s.mergeFile(Message{Type: MsgTypeData, FileName: msg.FileName, ID: msg.ID, Data: data}, base)
+		}
+		r.started = started
+		rs.writing[rs.wanted[msg.FileName]]++
+		return s.applyWrite(r, rs)
+	}
+
+	delete(rs.wanted, msg.FileName)
+	err := s.acceptPath(msg.FileName)
+	if err == nil {
+		var reused bool
+		if reused, err = s.reuseLocalFile(msg.FileName, msg.MD5); err == nil && !reused {
+			err = fmt.Errorf("%w: no content with md5 %s to link %s to", fs.ErrNotExist, msg.MD5, msg.FileName)
+		}
+	}
+	if s.canAskAgain(err, msg.FileName, rs) {
+		rs.wanted[msg.FileName] = msg.MD5
+		return s.askAgain(msg, err, rs)
+	}
+	if err != nil {
+		slog.Error("Failed to link file", "filename", msg.FileName, "md5", msg.MD5, "error", err)
+		return s.failFile(msg, err)
+	}
+
+	size := s.FileCache.data[msg.FileName].size
+	s.report.record(FileReport{Path: msg.FileName, Action: ActionReused, Duration: time.Since(started)})
+	s.observer().FileWritten(msg.FileName, size)
+	if err := s.SendMessage(Message{Type: MsgTypeAck, FileName: msg.FileName, ID: msg.ID}); err != nil {
+		return fmt.Errorf("failed to send ack for file %s: %w", msg.FileName, err)
+	}
+	return nil
+}
+
+// Tells main a file it sent could not be applied. Only fatal errors end the
+// session.
+func (s *Syncer) failFile(msg Message, err error) error {
+	pe := newProtocolError(msg.FileName, err)
+	pe.id = msg.ID
+	if pe.Fatal() {
+		s.sendFatal(pe)
+		return pe
+	}
+	s.fileFailed(pe)
+	if err := s.SendMessage(pe.asMessage()); err != nil {
+		return fmt.Errorf("failed to send error for file %s: %w", msg.FileName, err)
+	}
+	return nil
+}
+
+// Checks a file name from main is safe to use and inside what the client
+// may sync
+func (s *Syncer) acceptPath(filename string) error {
+	if err := ValidateFileName(filename); err != nil {
+		return err
+	}
+	if s.Client != nil && !s.Client.AllowsPath(filename) {
+		return fmt.Errorf("%w: key %q may not sync %s", fs.ErrPermission, s.Client.ID, filename)
+	}
+	return nil
+}
+
+// Whether the replica deletes name at the end of the session if main doesn't
+// sync it. Files outside what the client may sync are not its to delete, nor
+// are those outside the session's paths, and only these may be moved to
+// serve other files.
+func (s *Syncer) deletesUnsynced(name string) bool {
+	if s.Client != nil && !s.Client.AllowsPath(name) {
+		return false
+	}
+	return !isConflictCopy(name) && s.Options.Mode.deletes() && s.Options.selects(name)
+}
+
+// Reads the file and then sends it over tcp using the Message format.
+// Failing to read the local file is returned as a ProtocolError as it
+// only affects this file.
 func (s *Syncer) SendFile(filename string) error {
+	_, err := s.sendFile(filename, 0)
+	return err
+}
+
+// Sends the file as request id returning its size
+func (s *Syncer) sendFile(filename string, id uint64) (int, error) {
 	var err error
-	msg := Message{Type: MsgTypeData, FileName: filename}
-	msg.Data, err = os.ReadFile(path.Join(s.FileCache.directory, filename))
+	msg := Message{Type: MsgTypeData, FileName: filename, ID: id}
+	msg.Data, err = s.FileCache.readFile(filename)
 	if err != nil {
-		return errors.Join(err, fmt.Errorf("Could not read file %s", filename))
+		return 0, newProtocolError(filename, errors.Join(err, fmt.Errorf("Could not read file %s", filename)))
 	}
 
-	msgDataStream := msg.AsBytesBuf()
-	totalWritten := 0
-	for totalWritten < len(msgDataStream) {
-		n, err := s.Conn.Write(msgDataStream[totalWritten:])
-		if err != nil {
-			return errors.Join(err, fmt.Errorf("Could not write data to tcp connection"))
-		}
-		totalWritten += n
+	total := int64(len(msg.Data))
+	progress := func(sent int64) { s.observer().TransferProgress(filename, sent, total) }
+	if err := s.sendMessage(msg, progress); err != nil {
+		return 0, err
 	}
 	slog.Debug("Main sent data message", "type", string(msg.Type), "filename", msg.FileName, "dataSize", len(msg.Data))
-	return nil
+	metrics.filesSent.add(1)
+	metrics.bytesSent.add(int64(len(msg.Data)))
+	return len(msg.Data), nil
 }
 
 func (s *Syncer) WriteFile(msg Message) error {
@@ -211,7 +882,10 @@ func (s *Syncer) WriteFile(msg Message) error {
 		return fmt.Errorf("data message has no data for file %s", msg.FileName)
 	}
 
-	err := os.WriteFile(path.Join(s.FileCache.directory, msg.FileName), msg.Data, 0644)
+	if err := ValidateFileName(msg.FileName); err != nil {
+		return err
+	}
+	err := s.FileCache.writeFile(msg.FileName, msg.Data)
 	if err != nil {
 		return errors.Join(fmt.Errorf("failed to write %s from msg", msg.FileName), err)
 	}
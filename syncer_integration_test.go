@@ -1,13 +1,19 @@
 package filesyncer
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/sync/errgroup"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Tests communications between Main and Replica works as expected
@@ -77,3 +83,666 @@ func TestSyncerEndToEnd(t *testing.T) {
 
 	assert.Equal(t, mainFileCount, len(replicaFcPostSync.data), "Total number of files in main folder should match synced folder")
 }
+
+// Counts the bytes written through the wrapped connection
+type countingConn struct {
+	net.Conn
+	written int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written += n
+	return n, err
+}
+
+// Renamed and duplicated files should be satisfied from the replica's own
+// copies rather than being sent again
+func TestSyncerReusesLocalContent(t *testing.T) {
+	mainDir := t.TempDir()
+	replicaDir := t.TempDir()
+
+	big := strings.Repeat("# Big recipe\n", 10000)
+	mainFiles := map[string]string{
+		"renamed.md": big,
+		"copy.md":    big,
+	}
+	for name, content := range mainFiles {
+		assert.NoError(t, os.WriteFile(filepath.Join(mainDir, name), []byte(content), 0644))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(replicaDir, "original.md"), []byte(big), 0644))
+
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	replicaFC, err := CreateFileCache(replicaDir)
+	assert.NoError(t, err)
+
+	written, mainReport, replicaReport := runCountedSync(t, &Syncer{FileCache: mainFC}, &Syncer{Replica: true, FileCache: replicaFC})
+	assert.Less(t, written, len(big), "Main should not have sent the file contents")
+	// Both sides report the files as reused rather than unchanged
+	assert.Equal(t, 2, mainReport.Count(ActionReused))
+	assert.Equal(t, 2, replicaReport.Count(ActionReused))
+	for name, content := range mainFiles {
+		got, err := os.ReadFile(filepath.Join(replicaDir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(got), fmt.Sprintf("File %s has wrong content", name))
+	}
+	_, err = os.Stat(filepath.Join(replicaDir, "original.md"))
+	assert.True(t, os.IsNotExist(err), "original.md should have been moved away")
+}
+
+// A file the replica cannot write should be reported back to main without
+// stopping the rest of the sync
+func TestSyncerContinuesAfterFileError(t *testing.T) {
+	mainDir := t.TempDir()
+	replicaDir := t.TempDir()
+
+	for name, content := range map[string]string{"a.md": "# A\n", "blocked.md": "# Blocked\n", "c.md": "# C\n"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(mainDir, name), []byte(content), 0644))
+	}
+	// A directory in the way of the file makes the write fail
+	assert.NoError(t, os.Mkdir(filepath.Join(replicaDir, "blocked.md"), 0755))
+
+	mainConn, replicaConn := net.Pipe()
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	mainSyncer := Syncer{Replica: false, Conn: mainConn, FileCache: mainFC}
+	replicaFC, err := CreateFileCache(replicaDir)
+	assert.NoError(t, err)
+	replicaSyncer := Syncer{Replica: true, Conn: replicaConn, FileCache: replicaFC}
+
+	g := new(errgroup.Group)
+	var mainErr, replicaErr error
+	g.Go(func() error { _, replicaErr = replicaSyncer.Run(); return nil })
+	g.Go(func() error { _, mainErr = mainSyncer.Run(); return nil })
+	g.Wait()
+
+	assert.ErrorIs(t, mainErr, ErrFilesFailed)
+	assert.ErrorIs(t, replicaErr, ErrFilesFailed)
+	if assert.Len(t, mainSyncer.FileErrors, 1) {
+		assert.Equal(t, "blocked.md", mainSyncer.FileErrors[0].Path)
+		assert.Equal(t, ErrCodeIO, mainSyncer.FileErrors[0].Code)
+		assert.True(t, mainSyncer.FileErrors[0].Remote)
+	}
+	for _, name := range []string{"a.md", "c.md"} {
+		_, err := os.Stat(filepath.Join(replicaDir, name))
+		assert.NoError(t, err, fmt.Sprintf("File %s should still have been synced", name))
+	}
+}
+
+// A replica that stops answering should not hang main forever
+func TestSyncerIdleTimeout(t *testing.T) {
+	mainDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(mainDir, "a.md"), []byte("# A\n"), 0644))
+
+	mainConn, replicaConn := net.Pipe()
+	defer replicaConn.Close()
+	// Swallow everything main sends and never reply
+	go io.Copy(io.Discard, replicaConn)
+
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	mainSyncer := Syncer{Replica: false, Conn: mainConn, FileCache: mainFC, IdleTimeout: 50 * time.Millisecond}
+
+	_, err = mainSyncer.Run()
+	assert.ErrorIs(t, err, ErrIdleTimeout)
+}
+
+// Heartbeats keep a quiet but healthy session inside the idle timeout
+func TestSyncerHeartbeatKeepsSessionAlive(t *testing.T) {
+	mainConn, replicaConn := net.Pipe()
+	defer mainConn.Close()
+
+	replicaFC, err := CreateFileCache(t.TempDir())
+	assert.NoError(t, err)
+	replicaSyncer := Syncer{Replica: true, Conn: replicaConn, FileCache: replicaFC, IdleTimeout: 100 * time.Millisecond}
+
+	// Stand in for a main that pings but takes a while before finishing
+	go func() {
+		quietMain := Syncer{Conn: mainConn, HeartbeatInterval: 20 * time.Millisecond}
+		stop := quietMain.startSession()
+		go io.Copy(io.Discard, mainConn)
+		quietMain.SendMessage(Message{Type: MsgTypeHello})
+		time.Sleep(300 * time.Millisecond)
+		stop()
+		quietMain.SendFinish()
+	}()
+
+	_, err = replicaSyncer.Run()
+	assert.NoError(t, err)
+}
+
+// A slow throttle still gets bytes to the replica often enough for its idle
+// timeout, even while a file much bigger than the rate is going out
+func TestSyncerThrottleWithinIdleTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		throttle *Throttle
+	}{
+		{name: "small burst", size: 70 * 1024, throttle: NewThrottle(50*1024, 5*1024)},
+		// Once the bucket is empty a full chunk would wait longer than the
+		// idle timeout
+		{name: "big burst", size: 200 * 1024, throttle: NewThrottle(100*1024, 128*1024)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mainDir, replicaDir := t.TempDir(), t.TempDir()
+			big := strings.Repeat("x", tt.size)
+			writeTestFiles(t, mainDir, map[string]string{"big.md": big})
+			mainFC, err := CreateFileCache(mainDir)
+			assert.NoError(t, err)
+			replicaFC, err := CreateFileCache(replicaDir)
+			assert.NoError(t, err)
+
+			mainSyncer := &Syncer{FileCache: mainFC, Throttle: tt.throttle, IdleTimeout: 500 * time.Millisecond, HeartbeatInterval: 100 * time.Millisecond}
+			replicaSyncer := &Syncer{Replica: true, FileCache: replicaFC, IdleTimeout: 500 * time.Millisecond, HeartbeatInterval: 100 * time.Millisecond}
+			runTestSync(t, mainSyncer, replicaSyncer)
+			got, err := os.ReadFile(filepath.Join(replicaDir, "big.md"))
+			assert.NoError(t, err)
+			assert.Equal(t, big, string(got))
+		})
+	}
+}
+
+// Pings from a peer that has stopped reading queue at most one pong rather
+// than a goroutine each
+func TestSyncerPingsToStalledPeer(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	defer conn.Close()
+	s := Syncer{Conn: conn}
+	stop := s.startSession()
+	defer stop()
+
+	var stream bytes.Buffer
+	ping, finish := Message{Type: MsgTypePing}, Message{Type: MsgTypeFinish}
+	for range 100 {
+		stream.Write(ping.AsBytesBuf())
+	}
+	stream.Write(finish.AsBytesBuf())
+	before := runtime.NumGoroutine()
+	msg, err := s.readMessage(bufio.NewReader(&stream))
+	assert.NoError(t, err)
+	assert.Equal(t, MsgTypeFinish, msg.Type)
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before+1)
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		assert.NoError(t, err)
+		err = os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		assert.NoError(t, err)
+	}
+}
+
+// Runs main against replica over an in-memory connection
+func runTestSync(t *testing.T, mainSyncer *Syncer, replicaSyncer *Syncer) (*SyncReport, *SyncReport) {
+	t.Helper()
+	mainConn, replicaConn := net.Pipe()
+	mainSyncer.Conn, replicaSyncer.Conn = mainConn, replicaConn
+
+	var mainReport, replicaReport *SyncReport
+	g := new(errgroup.Group)
+	g.Go(func() (err error) {
+		replicaReport, err = replicaSyncer.Run()
+		return err
+	})
+	g.Go(func() (err error) {
+		mainReport, err = mainSyncer.Run()
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		t.Fatal("Syncer failed", err)
+	}
+	return mainReport, replicaReport
+}
+
+func reportActions(report *SyncReport) map[string]FileAction {
+	actions := map[string]FileAction{}
+	for _, fr := range report.Files {
+		actions[fr.Path] = fr.Action
+	}
+	return actions
+}
+
+func TestSyncerReport(t *testing.T) {
+	mainDir := t.TempDir()
+	replicaDir := t.TempDir()
+	writeTestFiles(t, mainDir, map[string]string{"a.md": "# A\n", "b.md": "# B\n", "c.md": "# C\n"})
+	writeTestFiles(t, replicaDir, map[string]string{"b.md": "# B\n", "c.md": "# Old C\n", "d.md": "# D\n"})
+
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	replicaFC, err := CreateFileCache(replicaDir)
+	assert.NoError(t, err)
+
+	mainReport, replicaReport := runTestSync(t, &Syncer{FileCache: mainFC}, &Syncer{Replica: true, FileCache: replicaFC})
+
+	assert.Equal(t, map[string]FileAction{
+		"a.md": ActionSent,
+		"b.md": ActionUnchanged,
+		"c.md": ActionSent,
+		"d.md": ActionDeleted,
+	}, reportActions(mainReport))
+	assert.Equal(t, map[string]FileAction{
+		"a.md": ActionReceived,
+		"b.md": ActionUnchanged,
+		"c.md": ActionReceived,
+		"d.md": ActionDeleted,
+	}, reportActions(replicaReport))
+	assert.Equal(t, "main", mainReport.Role)
+	assert.Equal(t, int64(len("# A\n")+len("# C\n")), mainReport.Bytes())
+	assert.Equal(t, "a.md", mainReport.Files[0].Path, "Files should be sorted by path")
+}
+
+type recordingObserver struct {
+	NopObserver
+	events []string
+}
+
+func (o *recordingObserver) SessionStarted(replica bool) {
+	o.events = append(o.events, fmt.Sprintf("started replica=%t", replica))
+}
+
+func (o *recordingObserver) TransferProgress(path string, sent int64, total int64) {
+	if sent == total {
+		o.events = append(o.events, fmt.Sprintf("sent %s %d", path, total))
+	}
+}
+
+func (o *recordingObserver) FileWritten(path string, size int64) {
+	o.events = append(o.events, fmt.Sprintf("written %s %d", path, size))
+}
+
+func (o *recordingObserver) FileDeleted(path string) {
+	o.events = append(o.events, fmt.Sprintf("deleted %s", path))
+}
+
+func (o *recordingObserver) SessionEnded(report *SyncReport, err error) {
+	o.events = append(o.events, fmt.Sprintf("ended files=%d err=%v", len(report.Files), err))
+}
+
+func TestSyncerObserver(t *testing.T) {
+	mainDir := t.TempDir()
+	replicaDir := t.TempDir()
+	writeTestFiles(t, mainDir, map[string]string{"a.md": "# A\n"})
+	writeTestFiles(t, replicaDir, map[string]string{"d.md": "# D\n"})
+
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	replicaFC, err := CreateFileCache(replicaDir)
+	assert.NoError(t, err)
+
+	mainObserver, replicaObserver := &recordingObserver{}, &recordingObserver{}
+	runTestSync(t,
+		&Syncer{FileCache: mainFC, Observer: mainObserver},
+		&Syncer{Replica: true, FileCache: replicaFC, Observer: replicaObserver},
+	)
+
+	assert.Equal(t, []string{"started replica=false", "sent a.md 4", "deleted d.md", "ended files=2 err=<nil>"}, mainObserver.events)
+	assert.Equal(t, []string{"started replica=true", "written a.md 4", "deleted d.md", "ended files=2 err=<nil>"}, replicaObserver.events)
+}
+
+// A dry run reports what would change without touching the replica
+func TestSyncerDryRun(t *testing.T) {
+	mainDir := t.TempDir()
+	replicaDir := t.TempDir()
+	replicaFiles := map[string]string{"b.md": "# B\n", "c.md": "# Old C\n", "d.md": "# D\n", "copy.md": "# A\n"}
+	writeTestFiles(t, mainDir, map[string]string{"a.md": "# A\n", "b.md": "# B\n", "c.md": "# C\n"})
+	writeTestFiles(t, replicaDir, replicaFiles)
+
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	replicaFC, err := CreateFileCache(replicaDir)
+	assert.NoError(t, err)
+
+	mainReport, replicaReport := runTestSync(t,
+		&Syncer{FileCache: mainFC, Options: SessionOptions{DryRun: true}},
+		&Syncer{Replica: true, FileCache: replicaFC},
+	)
+
+	assert.True(t, mainReport.DryRun)
+	assert.True(t, replicaReport.DryRun, "Replica should pick up dry run from main")
+	assert.Equal(t, map[string]FileAction{
+		"a.md":    ActionSent,
+		"b.md":    ActionUnchanged,
+		"c.md":    ActionSent,
+		"copy.md": ActionDeleted,
+		"d.md":    ActionDeleted,
+	}, reportActions(mainReport))
+
+	for name, content := range replicaFiles {
+		got, err := os.ReadFile(filepath.Join(replicaDir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(got), fmt.Sprintf("File %s should not have changed", name))
+	}
+	_, err = os.Stat(filepath.Join(replicaDir, "a.md"))
+	assert.True(t, os.IsNotExist(err), "a.md should not have been created")
+}
+
+// A client key limited to some paths can neither write nor delete outside them
+func TestSyncerClientPathScope(t *testing.T) {
+	mainDir := t.TempDir()
+	replicaDir := t.TempDir()
+	writeTestFiles(t, mainDir, map[string]string{"todo.md": "# Todo\n", "secret.md": "# Secret\n"})
+	writeTestFiles(t, replicaDir, map[string]string{"other.md": "# Other\n"})
+
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	replicaFC, err := CreateFileCache(replicaDir)
+	assert.NoError(t, err)
+
+	mainSyncer := &Syncer{FileCache: mainFC}
+	client := &ClientKey{ID: "todo-only", Permissions: []Permission{PermissionPush}, Paths: []string{"todo.md"}, Enabled: true}
+	replicaSyncer := &Syncer{Replica: true, FileCache: replicaFC, Client: client}
+
+	mainConn, replicaConn := net.Pipe()
+	mainSyncer.Conn, replicaSyncer.Conn = mainConn, replicaConn
+	g := new(errgroup.Group)
+	g.Go(func() error { replicaSyncer.Run(); return nil })
+	_, err = mainSyncer.Run()
+	g.Wait()
+
+	assert.ErrorIs(t, err, ErrFilesFailed)
+	if assert.Len(t, mainSyncer.FileErrors, 1) {
+		assert.Equal(t, "secret.md", mainSyncer.FileErrors[0].Path)
+		assert.Equal(t, ErrCodePermission, mainSyncer.FileErrors[0].Code)
+	}
+	_, err = os.Stat(filepath.Join(replicaDir, "todo.md"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(replicaDir, "secret.md"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(replicaDir, "other.md"))
+	assert.NoError(t, err, "Files outside the key's paths should not be deleted")
+}
+
+// Content the replica already has outside the key's paths is copied, never
+// moved, to serve a file inside them
+func TestSyncerClientPathScopeReuse(t *testing.T) {
+	mainDir, replicaDir := t.TempDir(), t.TempDir()
+	writeTestFiles(t, mainDir, map[string]string{"todo.md": "# Same\n"})
+	writeTestFiles(t, replicaDir, map[string]string{"other.md": "# Same\n"})
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	replicaFC, err := CreateFileCache(replicaDir)
+	assert.NoError(t, err)
+
+	client := &ClientKey{ID: "todo-only", Permissions: []Permission{PermissionPush}, Paths: []string{"todo.md"}, Enabled: true}
+	_, replicaReport := runTestSync(t, &Syncer{FileCache: mainFC}, &Syncer{Replica: true, FileCache: replicaFC, Client: client})
+	assert.Equal(t, map[string]FileAction{"todo.md": ActionReused}, reportActions(replicaReport))
+	for _, name := range []string{"todo.md", "other.md"} {
+		got, err := os.ReadFile(filepath.Join(replicaDir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, "# Same\n", string(got))
+	}
+}
+
+// A pull only key cannot push
+func TestSyncerClientPermission(t *testing.T) {
+	mainFC, err := CreateFileCache(t.TempDir())
+	assert.NoError(t, err)
+	replicaFC, err := CreateFileCache(t.TempDir())
+	assert.NoError(t, err)
+
+	client := &ClientKey{ID: "reader", Permissions: []Permission{PermissionPull}, Enabled: true}
+	mainSyncer := &Syncer{FileCache: mainFC}
+	replicaSyncer := &Syncer{Replica: true, FileCache: replicaFC, Client: client}
+
+	mainConn, replicaConn := net.Pipe()
+	mainSyncer.Conn, replicaSyncer.Conn = mainConn, replicaConn
+	g := new(errgroup.Group)
+	g.Go(func() error { replicaSyncer.Run(); return nil })
+	_, err = mainSyncer.Run()
+	g.Wait()
+
+	var pe *ProtocolError
+	if assert.ErrorAs(t, err, &pe) {
+		assert.Equal(t, ErrCodePermission, pe.Code)
+		assert.True(t, pe.Remote)
+	}
+}
+
+// A replica that can't run the session tells main why rather than hanging up
+func TestSyncerRefuse(t *testing.T) {
+	mainFC, err := CreateFileCache(t.TempDir())
+	assert.NoError(t, err)
+	mainConn, replicaConn := net.Pipe()
+
+	refused := &ProtocolError{Code: ErrCodeInternal, Text: "pre-apply hook failed"}
+	g := new(errgroup.Group)
+	g.Go(func() error { (&Syncer{Replica: true, Conn: replicaConn}).Refuse(refused); return nil })
+	_, err = (&Syncer{FileCache: mainFC, Conn: mainConn}).Run()
+	g.Wait()
+
+	var pe *ProtocolError
+	if assert.ErrorAs(t, err, &pe) {
+		assert.Equal(t, ErrCodeInternal, pe.Code)
+		assert.Equal(t, "pre-apply hook failed", pe.Text)
+		assert.True(t, pe.Remote)
+	}
+}
+
+// Many files in flight at once with a small window and few writers still
+// leave the replica matching main
+func TestSyncerPipelinesManyFiles(t *testing.T) {
+	mainDir, replicaDir := t.TempDir(), t.TempDir()
+	mainFiles, replicaFiles := map[string]string{}, map[string]string{}
+	for i := range 60 {
+		name := fmt.Sprintf("note%02d.md", i)
+		mainFiles[name] = fmt.Sprintf("# Note %d\n", i)
+		switch i % 3 {
+		case 0:
+			replicaFiles[name] = mainFiles[name]
+		case 1:
+			replicaFiles[name] = "# Stale\n"
+		}
+	}
+	replicaFiles["gone.md"] = "# Gone\n"
+	writeTestFiles(t, mainDir, mainFiles)
+	writeTestFiles(t, replicaDir, replicaFiles)
+
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	replicaFC, err := CreateFileCache(replicaDir)
+	assert.NoError(t, err)
+
+	mainReport, replicaReport := runTestSync(t,
+		&Syncer{FileCache: mainFC, Window: 3},
+		&Syncer{Replica: true, FileCache: replicaFC, WriteWorkers: 2},
+	)
+
+	assert.Equal(t, 20, mainReport.Count(ActionUnchanged))
+	assert.Equal(t, 40, mainReport.Count(ActionSent))
+	assert.Equal(t, 1, mainReport.Count(ActionDeleted))
+	assert.Equal(t, 40, replicaReport.Count(ActionReceived))
+
+	for name, content := range mainFiles {
+		data, err := os.ReadFile(filepath.Join(replicaDir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(data), name)
+	}
+	_, err = os.Stat(filepath.Join(replicaDir, "gone.md"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSyncerModes(t *testing.T) {
+	tests := []struct {
+		mode     SyncMode
+		expected map[string]FileAction
+		files    map[string]string
+	}{
+		{
+			mode:     ModeMirror,
+			expected: map[string]FileAction{"new.md": ActionReceived, "changed.md": ActionReceived, "extra.md": ActionDeleted, "same.md": ActionUnchanged},
+			files:    map[string]string{"new.md": "# New\n", "changed.md": "# Main\n", "same.md": "# Same\n"},
+		},
+		{
+			mode:     ModeAdditive,
+			expected: map[string]FileAction{"new.md": ActionReceived, "changed.md": ActionReceived, "same.md": ActionUnchanged},
+			files:    map[string]string{"new.md": "# New\n", "changed.md": "# Main\n", "same.md": "# Same\n", "extra.md": "# Extra\n"},
+		},
+		{
+			mode:     ModeUpdateOnly,
+			expected: map[string]FileAction{"new.md": ActionSkipped, "changed.md": ActionReceived, "same.md": ActionUnchanged},
+			files:    map[string]string{"changed.md": "# Main\n", "same.md": "# Same\n", "extra.md": "# Extra\n"},
+		},
+		{
+			mode:     ModeCreateOnly,
+			expected: map[string]FileAction{"new.md": ActionReceived, "changed.md": ActionSkipped, "same.md": ActionUnchanged},
+			files:    map[string]string{"new.md": "# New\n", "changed.md": "# Replica\n", "same.md": "# Same\n", "extra.md": "# Extra\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			mainDir, replicaDir := t.TempDir(), t.TempDir()
+			writeTestFiles(t, mainDir, map[string]string{"new.md": "# New\n", "changed.md": "# Main\n", "same.md": "# Same\n"})
+			writeTestFiles(t, replicaDir, map[string]string{"changed.md": "# Replica\n", "same.md": "# Same\n", "extra.md": "# Extra\n"})
+			mainFC, err := CreateFileCache(mainDir)
+			assert.NoError(t, err)
+			replicaFC, err := CreateFileCache(replicaDir)
+			assert.NoError(t, err)
+
+			mainReport, replicaReport := runTestSync(t, &Syncer{FileCache: mainFC, Options: SessionOptions{Mode: tt.mode}}, &Syncer{Replica: true, FileCache: replicaFC})
+			assert.Equal(t, tt.expected, reportActions(replicaReport))
+			for name, action := range tt.expected {
+				if action == ActionSkipped {
+					assert.Equal(t, ActionSkipped, reportActions(mainReport)[name])
+				}
+			}
+			replicaFiles := map[string]string{}
+			for name := range replicaFC.data {
+				data, err := os.ReadFile(filepath.Join(replicaDir, name))
+				assert.NoError(t, err)
+				replicaFiles[name] = string(data)
+			}
+			assert.Equal(t, tt.files, replicaFiles)
+		})
+	}
+}
+
+// The replica's mode limits whatever main asks for
+func TestSyncerReplicaModeLimit(t *testing.T) {
+	mainDir, replicaDir := t.TempDir(), t.TempDir()
+	writeTestFiles(t, mainDir, map[string]string{"a.md": "# A\n"})
+	writeTestFiles(t, replicaDir, map[string]string{"old.md": "# Old\n"})
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	replicaFC, err := CreateFileCache(replicaDir)
+	assert.NoError(t, err)
+
+	mainSyncer := &Syncer{FileCache: mainFC}
+	_, replicaReport := runTestSync(t, mainSyncer, &Syncer{Replica: true, FileCache: replicaFC, Mode: ModeAdditive})
+	assert.Equal(t, ModeAdditive, mainSyncer.Options.Mode)
+	assert.Equal(t, map[string]FileAction{"a.md": ActionReceived}, reportActions(replicaReport))
+	assert.FileExists(t, filepath.Join(replicaDir, "old.md"))
+
+	// Nothing is left that both allow
+	mainConn, replicaConn := net.Pipe()
+	replica := &Syncer{Replica: true, FileCache: replicaFC, Conn: replicaConn, Mode: ModeUpdateOnly}
+	go replica.Run()
+	_, err = (&Syncer{FileCache: mainFC, Conn: mainConn, Options: SessionOptions{Mode: ModeCreateOnly}}).Run()
+	var pe *ProtocolError
+	if assert.ErrorAs(t, err, &pe) {
+		assert.Equal(t, ErrCodePermission, pe.Code)
+	}
+}
+
+// The replica only writes files it asked for, whatever main sends
+func TestSyncerReplicaRejectsUnaskedFiles(t *testing.T) {
+	for _, msgType := range []MsgType{MsgTypeData, MsgTypeLink} {
+		t.Run(string(msgType), func(t *testing.T) {
+			replicaDir := t.TempDir()
+			writeTestFiles(t, replicaDir, map[string]string{"keep.md": "# Keep\n", "other.md": "# Other\n"})
+			replicaFC, err := CreateFileCache(replicaDir)
+			assert.NoError(t, err)
+			msg := Message{Type: msgType, FileName: "keep.md", ID: 1, Data: []byte("# Overwritten\n")}
+			if msgType == MsgTypeLink {
+				msg = Message{Type: msgType, FileName: "keep.md", ID: 1, MD5: replicaFC.data["other.md"].md5}
+			}
+
+			mainConn, replicaConn := net.Pipe()
+			var replicaErr error
+			done := make(chan struct{})
+			go func() {
+				_, replicaErr = (&Syncer{Replica: true, FileCache: replicaFC, Conn: replicaConn, Mode: ModeCreateOnly}).Run()
+				close(done)
+			}()
+
+			// Stand in for a main that skips the check
+			rawMain := &Syncer{Conn: mainConn, Options: SessionOptions{Mode: ModeCreateOnly}}
+			reader := bufio.NewReader(mainConn)
+			assert.NoError(t, rawMain.sendHello(reader))
+			assert.NoError(t, rawMain.SendMessage(msg))
+			mainConn.SetReadDeadline(time.Now().Add(time.Second))
+			reply, err := rawMain.readMessage(reader)
+			assert.NoError(t, err)
+			mainConn.Close()
+			<-done
+
+			assert.Equal(t, MsgTypeError, reply.Type)
+			assert.Equal(t, ErrCodeProtocol, reply.ErrCode)
+			var pe *ProtocolError
+			if assert.ErrorAs(t, replicaErr, &pe) {
+				assert.Equal(t, ErrCodeProtocol, pe.Code)
+			}
+			got, err := os.ReadFile(filepath.Join(replicaDir, "keep.md"))
+			assert.NoError(t, err)
+			assert.Equal(t, "# Keep\n", string(got))
+		})
+	}
+}
+
+// Only the selected paths are checked, and nothing outside them is deleted
+func TestSyncerSelectedPaths(t *testing.T) {
+	mainDir, replicaDir := t.TempDir(), t.TempDir()
+	writeTestFiles(t, mainDir, map[string]string{
+		"docs/api/a.md":  "# A\n",
+		"docs/guide.md":  "# Guide\n",
+		"notes/today.md": "# Today\n",
+		"notes/old.md":   "# Old\n",
+	})
+	writeTestFiles(t, replicaDir, map[string]string{
+		"docs/api/gone.md": "# Gone\n",
+		"docs/guide.md":    "# Replica guide\n",
+		"notes/mine.md":    "# Mine\n",
+	})
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	replicaFC, err := CreateFileCache(replicaDir)
+	assert.NoError(t, err)
+
+	mainSyncer := &Syncer{FileCache: mainFC, Options: SessionOptions{Paths: []string{"docs/api", "notes/today.md"}}}
+	mainReport, replicaReport := runTestSync(t, mainSyncer, &Syncer{Replica: true, FileCache: replicaFC})
+	assert.Equal(t, map[string]FileAction{"docs/api/a.md": ActionSent, "notes/today.md": ActionSent, "docs/api/gone.md": ActionDeleted}, reportActions(mainReport))
+	assert.Equal(t, map[string]FileAction{"docs/api/a.md": ActionReceived, "notes/today.md": ActionReceived, "docs/api/gone.md": ActionDeleted}, reportActions(replicaReport))
+
+	data, err := os.ReadFile(filepath.Join(replicaDir, "docs", "guide.md"))
+	assert.NoError(t, err)
+	assert.Equal(t, "# Replica guide\n", string(data))
+	assert.FileExists(t, filepath.Join(replicaDir, "notes", "mine.md"))
+	assert.NoFileExists(t, filepath.Join(replicaDir, "notes", "old.md"))
+}
+
+// Content the replica already has outside the selected paths is copied,
+// never moved, to serve a file inside them
+func TestSyncerSelectedPathsReuse(t *testing.T) {
+	mainDir, replicaDir := t.TempDir(), t.TempDir()
+	writeTestFiles(t, mainDir, map[string]string{"docs/new.md": "# Same\n"})
+	writeTestFiles(t, replicaDir, map[string]string{"notes/keep.md": "# Same\n"})
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	replicaFC, err := CreateFileCache(replicaDir)
+	assert.NoError(t, err)
+
+	options := SessionOptions{Paths: []string{"docs"}}
+	_, replicaReport := runTestSync(t, &Syncer{FileCache: mainFC, Options: options}, &Syncer{Replica: true, FileCache: replicaFC})
+	assert.Equal(t, map[string]FileAction{"docs/new.md": ActionReused}, reportActions(replicaReport))
+	for _, name := range []string{"docs/new.md", "notes/keep.md"} {
+		got, err := os.ReadFile(filepath.Join(replicaDir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, "# Same\n", string(got))
+	}
+}
@@ -2,11 +2,11 @@ package filesyncer
 
 import (
 	"bufio"
-	"crypto/subtle"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -76,40 +76,149 @@ func CreateMainSenderConn(address string, apiKey string) (net.Conn, error) {
 }
 
 // CreateReplicaListenerConn listens on address, accepts connections in a loop,
-// and returns the first connection that authenticates successfully
+// and returns the first connection that authenticates successfully. Connections
+// are limited by a ConnGuard with the default config.
 func CreateReplicaListenerConn(address string, validAPIKey string) (net.Conn, error) {
+	ln, err := ListenReplica(address, StaticKey(validAPIKey), NewConnGuard(DefaultGuardConfig()))
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+
+	conn, _, err := ln.Accept()
+	return conn, err
+}
+
+// ReplicaListener accepts connections and authenticates them concurrently so a
+// slow or hostile client cannot hold up others. Every connection has to get
+// past the ConnGuard before it may try to authenticate.
+type ReplicaListener struct {
+	ln    net.Listener
+	auth  Authenticator
+	guard *ConnGuard
+
+	conns     chan authenticatedConn
+	done      chan struct{}
+	closeOnce sync.Once
+	failed    chan struct{}
+	failOnce  sync.Once
+	acceptErr error
+}
+
+type authenticatedConn struct {
+	conn   net.Conn
+	client *ClientKey
+}
+
+// ListenReplica starts listening on address. A nil guard lets every
+// connection try to authenticate.
+func ListenReplica(address string, auth Authenticator, guard *ConnGuard) (*ReplicaListener, error) {
 	ln, err := net.Listen("tcp", address)
 	if err != nil {
 		return nil, fmt.Errorf("failed to listen on %s: %w", address, err)
 	}
-	defer ln.Close()
+	if guard == nil {
+		guard = NewConnGuard(GuardConfig{})
+	}
+	l := &ReplicaListener{
+		ln:     ln,
+		auth:   auth,
+		guard:  guard,
+		conns:  make(chan authenticatedConn),
+		done:   make(chan struct{}),
+		failed: make(chan struct{}),
+	}
+	slog.Info("TCP Listening for authenticated connection", "address", ln.Addr())
+	go l.acceptLoop()
+	return l, nil
+}
+
+// Accept waits for the next connection that authenticates successfully
+func (l *ReplicaListener) Accept() (net.Conn, *ClientKey, error) {
+	select {
+	case ac := <-l.conns:
+		return ac.conn, ac.client, nil
+	case <-l.failed:
+		return nil, nil, l.acceptErr
+	}
+}
+
+func (l *ReplicaListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *ReplicaListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.ln.Close()
+	})
+	return err
+}
 
-	slog.Info("TCP Listening for authenticated connection", "address", address)
+func (l *ReplicaListener) fail(err error) {
+	l.failOnce.Do(func() {
+		l.acceptErr = err
+		close(l.failed)
+	})
+}
 
-	AcceptConnErrCounter := 0
+func (l *ReplicaListener) acceptLoop() {
+	acceptConnErrCounter := 0
 	for {
-		conn, err := ln.Accept()
+		conn, err := l.ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.fail(err)
+				return
+			}
 			slog.Warn("Failed to accept connection", "error", err)
-			if AcceptConnErrCounter >= 5 {
-				conn.Close()
-				return nil, err
+			if acceptConnErrCounter >= 5 {
+				l.fail(err)
+				return
 			}
-			AcceptConnErrCounter += 1
+			acceptConnErrCounter += 1
 			continue
 		}
-		conn, err = AuthenticateListenerConnection(conn, validAPIKey)
+		acceptConnErrCounter = 0
+
+		release, err := l.guard.Admit(conn.RemoteAddr())
 		if err != nil {
+			slog.Warn("Rejected connection", "remote", conn.RemoteAddr(), "error", err)
 			conn.Close()
-			return nil, err
+			continue
 		}
-		return conn, nil
+		go l.authenticate(conn, release)
+	}
+}
+
+func (l *ReplicaListener) authenticate(conn net.Conn, release func()) {
+	conn, client, err := AuthenticateClient(conn, l.auth)
+	release()
+	if err != nil {
+		l.guard.AuthFailed(conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	l.guard.AuthSucceeded(conn.RemoteAddr())
+
+	select {
+	case l.conns <- authenticatedConn{conn: conn, client: client}:
+	case <-l.done:
+		conn.Close()
 	}
 }
 
 // To be used if you want to create a listener and manage the the connection creation
 // yourself but then still want to authenticate it.
 func AuthenticateListenerConnection(conn net.Conn, validAPIKey string) (net.Conn, error) {
+	conn, _, err := AuthenticateClient(conn, StaticKey(validAPIKey))
+	return conn, err
+}
+
+// Like AuthenticateListenerConnection but checks the key with auth and returns
+// the client key the connection authenticated as
+func AuthenticateClient(conn net.Conn, auth Authenticator) (net.Conn, *ClientKey, error) {
 	// Set 5 second deadline for auth
 	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 
@@ -117,27 +226,32 @@ func AuthenticateListenerConnection(conn net.Conn, validAPIKey string) (net.Conn
 	msgStream, err := reader.ReadBytes('\x00')
 	if err != nil {
 		slog.Warn("Failed to read auth message", "remote", conn.RemoteAddr(), "error", err)
-		return conn, errors.Join(ErrAuthFailed, errors.New("Failed to read auth message"))
+		return conn, nil, authFailed(conn.RemoteAddr(), "read", errors.New("Failed to read auth message"))
 	}
 
 	msg, err := ParseMessage(msgStream)
 	if err != nil {
 		slog.Warn("Failed to parse auth message", "remote", conn.RemoteAddr(), "error", err)
 		sendAuthFail(conn)
-		return conn, errors.Join(ErrAuthFailed, errors.New("Failed to parse auth message"))
+		return conn, nil, authFailed(conn.RemoteAddr(), "malformed", errors.New("Failed to parse auth message"))
 	}
 
 	if msg.Type != MsgTypeAuth {
 		slog.Warn("Expected auth message", "remote", conn.RemoteAddr(), "got", string(msg.Type))
 		sendAuthFail(conn)
-		return conn, errors.Join(ErrAuthFailed, errors.New("Recieved non auth message type"))
+		return conn, nil, authFailed(conn.RemoteAddr(), "unexpected_message", errors.New("Recieved non auth message type"))
 	}
 
 	// Check auth
-	if subtle.ConstantTimeCompare(msg.Data, []byte(validAPIKey)) != 1 {
-		slog.Warn("Auth failed: invalid API key", "remote", conn.RemoteAddr())
+	client, err := auth.Authenticate(msg.Data)
+	if err != nil {
+		slog.Warn("Auth failed", "remote", conn.RemoteAddr(), "error", err)
 		sendAuthFail(conn)
-		return conn, errors.Join(ErrAuthFailed, errors.New("Recieved non auth message type"))
+		reason := "invalid_key"
+		if errors.Is(err, ErrKeyDisabled) {
+			reason = "disabled_key"
+		}
+		return conn, nil, authFailed(conn.RemoteAddr(), reason, err)
 	}
 
 	// Clear deadline for normal operation
@@ -148,11 +262,20 @@ func AuthenticateListenerConnection(conn net.Conn, validAPIKey string) (net.Conn
 	_, err = conn.Write(authOK.AsBytesBuf())
 	if err != nil {
 		slog.Warn("Failed to send auth OK", "remote", conn.RemoteAddr(), "error", err)
-		return conn, errors.Join(ErrAuthFailed, errors.New("Failed to send auth OK message"))
+		return conn, nil, errors.Join(ErrAuthFailed, errors.New("Failed to send auth OK message"))
 	}
 
-	slog.Info("Client authenticated", "remote", conn.RemoteAddr())
-	return conn, nil
+	slog.Info("Client authenticated", "remote", conn.RemoteAddr(), "keyID", client.ID)
+	return conn, client, nil
+}
+
+// Counts the failure by reason and by remote address, and wraps err in
+// ErrAuthFailed. Addresses past the first maxRemoteSeries are counted
+// together so anyone who can connect can't add series without bound.
+func authFailed(remote net.Addr, reason string, err error) error {
+	metrics.authFailures.inc(reason)
+	metrics.authFailuresRemote.inc(addrHost(remote))
+	return errors.Join(ErrAuthFailed, err)
 }
 
 func sendAuthFail(conn net.Conn) {
@@ -0,0 +1,189 @@
+package filesyncer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScheduleRule sets the rate for a time of day window. Start and End are
+// offsets from midnight and the window wraps past midnight if End is before
+// Start. A zero rate is unlimited.
+type ScheduleRule struct {
+	Start time.Duration
+	End   time.Duration
+	Rate  int64
+}
+
+func (r ScheduleRule) contains(offset time.Duration) bool {
+	if r.Start <= r.End {
+		return offset >= r.Start && offset < r.End
+	}
+	return offset >= r.Start || offset < r.End
+}
+
+// Throttle limits the bytes per second written to a connection using a token
+// bucket, optionally following a time of day schedule. It is safe to share
+// between goroutines.
+type Throttle struct {
+	rate     int64
+	burst    int64
+	schedule []ScheduleRule
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+// NewThrottle limits writes to rate bytes per second, allowing burst bytes at
+// once. A zero rate is unlimited and a zero burst allows one second's worth.
+func NewThrottle(rate int64, burst int64) *Throttle {
+	return &Throttle{rate: rate, burst: burst, now: time.Now, sleep: time.Sleep}
+}
+
+// Rules are checked in order and the first matching one sets the rate. Outside
+// every rule the throttle's own rate applies.
+func (t *Throttle) SetSchedule(rules []ScheduleRule) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.schedule = rules
+}
+
+// Rate in force at now. Must be called with t.mu held.
+func (t *Throttle) currentRate(now time.Time) int64 {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	for _, rule := range t.schedule {
+		if rule.contains(offset) {
+			return rule.Rate
+		}
+	}
+	return t.rate
+}
+
+// Bucket size at rate. Must be called with t.mu held.
+func (t *Throttle) currentBurst(rate int64) int64 {
+	if t.burst <= 0 {
+		return rate
+	}
+	return t.burst
+}
+
+// Largest write, up to limit, that waits no longer than refilling the bucket
+// takes, or than maxWait. Writing in pieces this size keeps bytes reaching
+// the other side often enough for its idle timeout at low rates, however
+// big the burst.
+func (t *Throttle) chunkSize(limit int, maxWait time.Duration) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rate := t.currentRate(t.now())
+	if rate <= 0 {
+		return limit
+	}
+	waitBytes := int64(float64(rate) * maxWait.Seconds())
+	return int(max(1, min(int64(limit), t.currentBurst(rate), waitBytes)))
+}
+
+// Wait blocks until n more bytes may be written
+func (t *Throttle) Wait(n int) {
+	t.mu.Lock()
+	now := t.now()
+	rate := t.currentRate(now)
+	if rate <= 0 {
+		t.last = now
+		t.mu.Unlock()
+		return
+	}
+	burst := float64(t.currentBurst(rate))
+	if t.last.IsZero() {
+		t.tokens = burst
+	} else {
+		t.tokens = min(burst, t.tokens+now.Sub(t.last).Seconds()*float64(rate))
+	}
+	t.last = now
+
+	// Writes bigger than the bucket go into debt that later writes wait off
+	t.tokens -= float64(n)
+	var wait time.Duration
+	if t.tokens < 0 {
+		wait = time.Duration(-t.tokens / float64(rate) * float64(time.Second))
+	}
+	t.mu.Unlock()
+
+	if wait > 0 {
+		t.sleep(wait)
+	}
+}
+
+// ParseByteRate parses a byte count such as "512K", "1.5MB" or "2MiB". K, M
+// and G are powers of 1024 with or without a trailing B or iB.
+func ParseByteRate(value string) (int64, error) {
+	s := strings.TrimSpace(value)
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "/s"), "B")
+	s = strings.TrimSuffix(s, "i")
+	multiplier := 1.0
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			multiplier = 1 << 10
+		case 'm', 'M':
+			multiplier = 1 << 20
+		case 'g', 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte rate %q", value)
+	}
+	return int64(n * multiplier), nil
+}
+
+// ParseSchedule parses a comma separated list of "HH:MM-HH:MM=RATE" rules,
+// for example "09:00-18:00=1MB,22:00-06:00=0"
+func ParseSchedule(value string) ([]ScheduleRule, error) {
+	var rules []ScheduleRule
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		window, rateText, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule rule %q: missing '='", item)
+		}
+		startText, endText, ok := strings.Cut(window, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule rule %q: missing '-'", item)
+		}
+		start, err := parseTimeOfDay(startText)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule rule %q: %w", item, err)
+		}
+		end, err := parseTimeOfDay(endText)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule rule %q: %w", item, err)
+		}
+		rate, err := ParseByteRate(rateText)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule rule %q: %w", item, err)
+		}
+		rules = append(rules, ScheduleRule{Start: start, End: end, Rate: rate})
+	}
+	return rules, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,97 @@
+package filesyncer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottleWait(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+	var slept []time.Duration
+	th := NewThrottle(1000, 500)
+	th.now = clock.Now
+	th.sleep = func(d time.Duration) {
+		slept = append(slept, d)
+		clock.now = clock.now.Add(d)
+	}
+
+	th.Wait(500)
+	assert.Empty(t, slept, "Burst should go through straight away")
+
+	th.Wait(250)
+	assert.Equal(t, []time.Duration{250 * time.Millisecond}, slept)
+
+	// Bigger than the burst goes into debt
+	slept = nil
+	th.Wait(2000)
+	assert.Equal(t, []time.Duration{2 * time.Second}, slept)
+}
+
+func TestThrottleChunkSize(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)}
+	th := NewThrottle(1000, 500)
+	th.now = clock.Now
+	assert.Equal(t, 500, th.chunkSize(writeChunkSize, time.Second), "Writes are no bigger than the burst")
+	assert.Equal(t, 100, th.chunkSize(100, time.Second))
+	assert.Equal(t, 250, th.chunkSize(writeChunkSize, 250*time.Millisecond), "Writes wait no longer than maxWait")
+
+	rules, err := ParseSchedule("09:00-18:00=300, 22:00-06:00=0")
+	assert.NoError(t, err)
+	th.SetSchedule(rules)
+	assert.Equal(t, 300, th.chunkSize(writeChunkSize, time.Second), "A lower rate shrinks the chunk below the burst")
+	clock.now = time.Date(2026, 1, 2, 23, 0, 0, 0, time.UTC)
+	assert.Equal(t, writeChunkSize, th.chunkSize(writeChunkSize, time.Second), "Unlimited rates use the full chunk")
+
+	th = NewThrottle(300, 0)
+	th.now = clock.Now
+	assert.Equal(t, 300, th.chunkSize(writeChunkSize, time.Second), "The default burst is a second's worth")
+
+	// A big burst at a low rate still writes in small pieces
+	th = NewThrottle(10_000, 1<<20)
+	th.now = clock.Now
+	assert.Equal(t, 10_000, th.chunkSize(writeChunkSize, time.Second))
+}
+
+func TestThrottleSchedule(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC)}
+	var slept time.Duration
+	th := NewThrottle(1000, 0)
+	th.now = clock.Now
+	th.sleep = func(d time.Duration) { slept += d }
+
+	rules, err := ParseSchedule("09:00-18:00=100, 22:00-06:00=0")
+	assert.NoError(t, err)
+	th.SetSchedule(rules)
+
+	th.Wait(1 << 20)
+	assert.Zero(t, slept, "Night time is unlimited")
+
+	clock.now = time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	th.Wait(200)
+	assert.Equal(t, time.Second, slept, "Business hours use the scheduled rate")
+
+	slept = 0
+	clock.now = time.Date(2026, 1, 2, 20, 0, 0, 0, time.UTC)
+	th.Wait(1000)
+	assert.Zero(t, slept, "Outside the schedule the base rate applies")
+}
+
+func TestParseByteRate(t *testing.T) {
+	tests := map[string]int64{
+		"100":    100,
+		"1K":     1024,
+		"1.5MB":  1536 * 1024,
+		"2MiB":   2 << 20,
+		"1G":     1 << 30,
+		"64KB/s": 64 << 10,
+	}
+	for input, expected := range tests {
+		got, err := ParseByteRate(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, got, input)
+	}
+	_, err := ParseByteRate("fast")
+	assert.Error(t, err)
+}
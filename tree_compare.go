@@ -0,0 +1,170 @@
+package filesyncer
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"time"
+)
+
+// What main has left to check. Replicas that compare trees are sent the hash
+// of each directory first and only get checks for what is inside the ones
+// that differ, so a session where nothing changed is a single message each
+// way. Older replicas get a check for every file up front.
+type treeWalk struct {
+	queue []walkItem
+	// Directories sent and not yet answered, whose answers may add more
+	pending int
+	// The replica's answers about directories, from main's reader
+	answers chan dirAnswer
+}
+
+type walkItem struct {
+	name string
+	dir  bool
+}
+
+type dirAnswer struct {
+	dir     string
+	match   bool
+	started time.Time
+}
+
+func (s *Syncer) newTreeWalk() *treeWalk {
+	walk := &treeWalk{}
+	if !s.Options.trees {
+		for name := range s.FileCache.data {
+			if s.Options.selects(name) {
+				walk.queue = append(walk.queue, walkItem{name: name})
+			}
+		}
+		return walk
+	}
+
+	roots := treeRoots(s.Options.Paths)
+	for _, root := range roots {
+		// Selected paths main doesn't have are compared as empty
+		// directories so the replica's copies are deleted
+		_, isFile := s.FileCache.data[root]
+		walk.queue = append(walk.queue, walkItem{name: root, dir: !isFile})
+	}
+	// Conflict copies aren't in the tree, main's own are checked one by one
+	for name := range s.FileCache.data {
+		if isConflictCopy(name) && s.Options.selects(name) && !slices.Contains(roots, name) {
+			walk.queue = append(walk.queue, walkItem{name: name})
+		}
+	}
+	// Each directory is sent at most once, so the reader never blocks
+	walk.answers = make(chan dirAnswer, len(s.FileCache.dirs)+len(roots))
+	return walk
+}
+
+// Where a walk over the selected paths starts, leaving out paths inside
+// other selected ones so nothing is checked twice
+func treeRoots(paths []string) []string {
+	if len(paths) == 0 {
+		return []string{rootDir}
+	}
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+	var roots []string
+	for _, p := range sorted {
+		if !withinPaths(p, roots) {
+			roots = append(roots, p)
+		}
+	}
+	return roots
+}
+
+func (w *treeWalk) remaining() bool {
+	return len(w.queue) > 0 || w.pending > 0
+}
+
+func (w *treeWalk) next() walkItem {
+	item := w.queue[len(w.queue)-1]
+	w.queue = w.queue[:len(w.queue)-1]
+	return item
+}
+
+// Every file under a directory the replica has the same is unchanged. The
+// contents of one that differs are queued to be checked in turn.
+func (s *Syncer) dirAnswered(walk *treeWalk, a dirAnswer) {
+	walk.pending--
+	if a.match {
+		for _, name := range s.FileCache.filesUnder(a.dir) {
+			s.report.record(FileReport{Path: name, Action: ActionUnchanged, Duration: time.Since(a.started)})
+			s.observer().FileChecked(name, true)
+		}
+		return
+	}
+	files, subdirs := s.FileCache.dirEntries(a.dir)
+	for _, name := range files {
+		walk.queue = append(walk.queue, walkItem{name: name})
+	}
+	for _, name := range subdirs {
+		walk.queue = append(walk.queue, walkItem{name: name, dir: true})
+	}
+}
+
+// Sends the next check of the walk, for a file or a directory. The caller
+// must hold a slot.
+func (s *Syncer) sendNextCheck(p *pipeline, walk *treeWalk) error {
+	item := walk.next()
+	if item.dir {
+		hash := s.FileCache.dirHash(item.name)
+		t := p.startDir(item.name, hash)
+		walk.pending++
+		msg := Message{Type: MsgTypeTree, FileName: item.name, ID: t.id, MD5: hash}
+		slog.Debug("Main tree message sent", "type", string(msg.Type), "dir", msg.FileName, "id", msg.ID, "hash", msg.MD5)
+		if err := s.SendMessage(msg); err != nil {
+			return fmt.Errorf("failed to send tree message for directory %s: %w", item.name, err)
+		}
+		return nil
+	}
+
+	fcData := s.FileCache.data[item.name]
+	t := p.start(item.name, fcData.md5, fcData.size)
+	checkMsg := Message{Type: MsgTypeCheck, FileName: item.name, ID: t.id, MD5: fcData.md5, ModTime: fcData.modTime}
+	err := s.SendMessage(checkMsg)
+	slog.Debug("Main check message sent", "type", string(checkMsg.Type), "filename", checkMsg.FileName, "id", checkMsg.ID, "md5", checkMsg.MD5)
+	if err != nil {
+		slog.Error("Could not send message for fileCheck", "filename", item.name, "error", err)
+		return fmt.Errorf("failed to send check message for file %s: %w", item.name, err)
+	}
+	return nil
+}
+
+// Answers main's hash of a directory. If the replica's is the same every
+// file under it is unchanged, otherwise main goes on to check what is
+// inside. Keys limited to part of the tree only compare directories they
+// may sync all of.
+func (s *Syncer) replicaTree(msg Message, rs *replicaState) error {
+	started := time.Now()
+	slog.Debug("Replica received tree message", "type", string(msg.Type), "dir", msg.FileName, "id", msg.ID, "hash", msg.MD5)
+	if msg.FileName != rootDir {
+		if err := ValidateFileName(msg.FileName); err != nil {
+			slog.Error("Replica rejected directory name", "dir", msg.FileName, "error", err)
+			return s.failFile(msg, err)
+		}
+	}
+
+	match := s.FileCache.dirHash(msg.FileName) == msg.MD5 && (s.Client == nil || s.Client.AllowsPath(msg.FileName))
+	if match {
+		for _, name := range s.FileCache.filesUnder(msg.FileName) {
+			fileData := s.FileCache.data[name]
+			fileData.synced = true
+			s.FileCache.data[name] = fileData
+			rs.checked[name] = fileData.md5
+			s.report.record(FileReport{Path: name, Action: ActionUnchanged, Duration: time.Since(started)})
+			s.observer().FileChecked(name, true)
+		}
+	}
+
+	response := Message{Type: MsgTypeMatch, FileName: msg.FileName, ID: msg.ID, Match: match}
+	if err := s.SendMessage(response); err != nil {
+		return fmt.Errorf("failed to send match response for directory %s: %w", msg.FileName, err)
+	}
+	slog.Debug("Replica sent match message", "type", string(response.Type), "dir", response.FileName, "match", response.Match)
+	return nil
+}
@@ -0,0 +1,181 @@
+package filesyncer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirHash(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{"a.md": "# A\n", "docs/b.md": "# B\n", "docs/deep/c.md": "# C\n", "notes/d.md": "# D\n"})
+	fc, err := CreateFileCache(dir)
+	assert.NoError(t, err)
+	root, docs, notes := fc.dirHash(rootDir), fc.dirHash("docs"), fc.dirHash("notes")
+
+	// Same files in another directory, whatever order they are found in
+	other := t.TempDir()
+	writeTestFiles(t, other, map[string]string{"notes/d.md": "# D\n", "docs/deep/c.md": "# C\n", "docs/b.md": "# B\n", "a.md": "# A\n"})
+	otherFC, err := CreateFileCache(other)
+	assert.NoError(t, err)
+	assert.Equal(t, root, otherFC.dirHash(rootDir))
+
+	// Conflict copies only exist on the replica and are left out
+	otherFC.set(conflictCopyName("docs/deep/c.md", "replica", time.Now()), fileCacheData{md5: "replica"})
+	assert.Equal(t, root, otherFC.dirHash(rootDir))
+
+	// A change only reaches the directories above it
+	fc.set("docs/deep/c.md", fileCacheData{md5: "changed"})
+	assert.NotEqual(t, root, fc.dirHash(rootDir))
+	assert.NotEqual(t, docs, fc.dirHash("docs"))
+	assert.Equal(t, notes, fc.dirHash("notes"))
+
+	// Moving a file is a change even though its content is the same
+	fc.set("docs/deep/c.md", fileCacheData{md5: otherFC.data["docs/deep/c.md"].md5})
+	assert.Equal(t, root, fc.dirHash(rootDir))
+	fc.unset("docs/deep/c.md")
+	fc.set("docs/c.md", otherFC.data["docs/deep/c.md"])
+	assert.NotEqual(t, docs, fc.dirHash("docs"))
+
+	// Directories left empty are pruned and hash like ones never seen
+	fc.unset("notes/d.md")
+	assert.False(t, fc.isDir("notes"))
+	assert.False(t, fc.isDir("docs/deep"))
+	assert.Equal(t, emptyDirHash, fc.dirHash("notes"))
+	files, subdirs := fc.dirEntries(rootDir)
+	assert.Equal(t, []string{"a.md"}, files)
+	assert.Equal(t, []string{"docs"}, subdirs)
+	assert.ElementsMatch(t, []string{"a.md", "docs/b.md", "docs/c.md"}, fc.filesUnder(rootDir))
+}
+
+func TestTreeRoots(t *testing.T) {
+	tests := []struct {
+		paths []string
+		want  []string
+	}{
+		{paths: nil, want: []string{"."}},
+		{paths: []string{"notes", "docs"}, want: []string{"docs", "notes"}},
+		{paths: []string{"docs/deep", "docs", "docs-old"}, want: []string{"docs", "docs-old"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.paths), func(t *testing.T) {
+			assert.Equal(t, tt.want, treeRoots(tt.paths))
+		})
+	}
+}
+
+// Runs main against replica and returns how many bytes main sent
+func runCountedSync(t *testing.T, mainSyncer *Syncer, replicaSyncer *Syncer) (int, *SyncReport, *SyncReport) {
+	t.Helper()
+	mainConn, replicaConn := net.Pipe()
+	counted := &countingConn{Conn: mainConn}
+	mainSyncer.Conn, replicaSyncer.Conn = counted, replicaConn
+
+	var replicaReport *SyncReport
+	var replicaErr error
+	done := make(chan struct{})
+	go func() {
+		replicaReport, replicaErr = replicaSyncer.Run()
+		close(done)
+	}()
+	mainReport, mainErr := mainSyncer.Run()
+	<-done
+	if err := errors.Join(mainErr, replicaErr); err != nil {
+		t.Fatal("Syncer failed", err)
+	}
+	return counted.written, mainReport, replicaReport
+}
+
+// Makes n files spread over a few levels of directories
+func nestedTestFiles(n int) map[string]string {
+	files := map[string]string{}
+	for i := range n {
+		files[fmt.Sprintf("dir%d/sub%d/file%d.md", i%4, i%3, i)] = fmt.Sprintf("# File %d\n", i)
+	}
+	return files
+}
+
+// With nothing changed main sends the same few messages however many files
+// there are, even with conflict copies left on the replica
+func TestSyncerUnchangedTreeSendsConstantBytes(t *testing.T) {
+	var sent []int
+	for _, n := range []int{10, 300} {
+		mainDir, replicaDir := t.TempDir(), t.TempDir()
+		writeTestFiles(t, mainDir, nestedTestFiles(n))
+		writeTestFiles(t, replicaDir, nestedTestFiles(n))
+		writeTestFiles(t, replicaDir, map[string]string{conflictCopyName("dir1/sub1/file1.md", "replica", time.Now()): "# Replica\n"})
+		mainFC, err := CreateFileCache(mainDir)
+		assert.NoError(t, err)
+		replicaFC, err := CreateFileCache(replicaDir)
+		assert.NoError(t, err)
+
+		written, mainReport, replicaReport := runCountedSync(t, &Syncer{FileCache: mainFC}, &Syncer{Replica: true, FileCache: replicaFC})
+		sent = append(sent, written)
+		assert.Equal(t, n, mainReport.Count(ActionUnchanged))
+		assert.Equal(t, n, replicaReport.Count(ActionUnchanged))
+		assert.True(t, mainReport.TreesMatch())
+	}
+	assert.Equal(t, sent[0], sent[1])
+}
+
+// Only the directories that differ are walked into, and everything in them
+// is still synced
+func TestSyncerTreeChanges(t *testing.T) {
+	mainDir, replicaDir := t.TempDir(), t.TempDir()
+	files := nestedTestFiles(40)
+	writeTestFiles(t, mainDir, files)
+	writeTestFiles(t, replicaDir, files)
+	// Main's own conflict copies aren't in the tree but are still synced
+	copyName := conflictCopyName("dir0/sub0/file0.md", "elsewhere", time.Now())
+	writeTestFiles(t, mainDir, map[string]string{"dir1/sub1/file1.md": "# Changed\n", "new/file.md": "# New\n", copyName: "# Copy\n"})
+	assert.NoError(t, os.Remove(filepath.Join(mainDir, "dir2/sub2/file2.md")))
+	writeTestFiles(t, replicaDir, map[string]string{"gone/old.md": "# Old\n"})
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	replicaFC, err := CreateFileCache(replicaDir)
+	assert.NoError(t, err)
+
+	mainReport, replicaReport := runTestSync(t, &Syncer{FileCache: mainFC}, &Syncer{Replica: true, FileCache: replicaFC})
+	actions := reportActions(replicaReport)
+	assert.Equal(t, ActionReceived, actions["dir1/sub1/file1.md"])
+	assert.Equal(t, ActionReceived, actions["new/file.md"])
+	assert.Equal(t, ActionDeleted, actions["dir2/sub2/file2.md"])
+	assert.Equal(t, ActionDeleted, actions["gone/old.md"])
+	assert.Equal(t, ActionReceived, actions[copyName])
+	assert.Equal(t, 38, replicaReport.Count(ActionUnchanged))
+	assert.Equal(t, mainFC.dirHash(rootDir), replicaFC.dirHash(rootDir))
+	assert.True(t, mainReport.TreesMatch())
+
+	got, err := os.ReadFile(filepath.Join(replicaDir, "dir1/sub1/file1.md"))
+	assert.NoError(t, err)
+	assert.Equal(t, "# Changed\n", string(got))
+	_, err = os.Stat(filepath.Join(replicaDir, "gone/old.md"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSyncerTreeSelectedPaths(t *testing.T) {
+	mainDir, replicaDir := t.TempDir(), t.TempDir()
+	writeTestFiles(t, mainDir, map[string]string{"docs/a.md": "# A\n", "docs/deep/b.md": "# B\n", "top.md": "# Top\n", "other/c.md": "# C\n"})
+	writeTestFiles(t, replicaDir, map[string]string{"docs/a.md": "# A\n", "docs/deep/b.md": "# Old B\n", "missing/d.md": "# D\n", "other/e.md": "# E\n"})
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	replicaFC, err := CreateFileCache(replicaDir)
+	assert.NoError(t, err)
+
+	options := SessionOptions{Paths: []string{"docs", "docs/deep", "missing", "top.md"}}
+	_, replicaReport := runTestSync(t, &Syncer{FileCache: mainFC, Options: options}, &Syncer{Replica: true, FileCache: replicaFC})
+	assert.Equal(t, map[string]FileAction{
+		"docs/a.md":      ActionUnchanged,
+		"docs/deep/b.md": ActionReceived,
+		"missing/d.md":   ActionDeleted,
+		"top.md":         ActionReceived,
+	}, reportActions(replicaReport))
+	_, err = os.Stat(filepath.Join(replicaDir, "other/e.md"))
+	assert.NoError(t, err, "files outside the selected paths are left alone")
+}
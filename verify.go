@@ -0,0 +1,96 @@
+package filesyncer
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// How many times the replica asks for a file again when what it wrote
+// doesn't match main's md5, when Syncer.VerifyRetries is zero
+const defaultVerifyRetries = 2
+
+var ErrVerifyFailed = errors.New("Written file does not match main's md5")
+
+var ErrTreeMismatch = errors.New("Main and replica trees differ after the session")
+
+func (s *Syncer) verifyRetries() int {
+	if s.VerifyRetries <= 0 {
+		return defaultVerifyRetries
+	}
+	return s.VerifyRetries
+}
+
+// Rehashes a file the replica just wrote and checks it holds the content main
+// announced, catching storage that silently corrupts what it is given
+func (s *Syncer) verifyWrite(filename string, md5 string) error {
+	written, err := hashFile(s.FileCache.store, filename)
+	if err != nil {
+		return err
+	}
+	if written.md5 != md5 {
+		metrics.verifyFailures.add(1)
+		return fmt.Errorf("%w: %s has md5 %s after writing, main sent %s", ErrVerifyFailed, filename, written.md5, md5)
+	}
+	return nil
+}
+
+// Serves the file from local content with FileCache.reuseLocalFile then
+// checks the result like any other write. Content that fails is dropped from
+// the cache so the caller can ask main for it instead.
+func (s *Syncer) reuseLocalFile(filename string, md5 string) (bool, error) {
+	if !s.FileCache.reuseLocalFile(filename, md5, s.deletesUnsynced) {
+		return false, nil
+	}
+	if err := s.verifyWrite(filename, md5); err != nil {
+		s.FileCache.unset(filename)
+		return false, err
+	}
+	return true, nil
+}
+
+// Whether a file that failed verification with err can be asked for again
+func (s *Syncer) canAskAgain(err error, filename string, rs *replicaState) bool {
+	return errors.Is(err, ErrVerifyFailed) && s.Options.resend && rs.retries[filename] < s.verifyRetries()
+}
+
+// Asks main to send the file again, as if it had never been sent
+func (s *Syncer) askAgain(msg Message, err error, rs *replicaState) error {
+	rs.retries[msg.FileName]++
+	slog.Warn("File failed verification, asking main for it again", "filename", msg.FileName, "retry", rs.retries[msg.FileName], "error", err)
+	if err := s.SendMessage(Message{Type: MsgTypeMatch, FileName: msg.FileName, ID: msg.ID}); err != nil {
+		return fmt.Errorf("failed to ask for file %s again: %w", msg.FileName, err)
+	}
+	return nil
+}
+
+// Whether the file or directory counts towards this side's tree digest.
+// Files outside what the client may sync are not the session's business.
+// Conflict copies are never in the tree to begin with.
+func (s *Syncer) inTree(name string) bool {
+	if !s.Options.selects(name) {
+		return false
+	}
+	return s.Client == nil || s.Client.AllowsPath(name)
+}
+
+// A session that made every change main asked for must leave both trees
+// identical, so differing digests mean something went wrong unnoticed.
+// Sessions that skipped, kept or merged anything, or ran in a mode that
+// leaves files behind, are expected to differ.
+func (s *Syncer) checkTrees() error {
+	r := s.report
+	if r.PeerTreeDigest == "" || r.TreesMatch() {
+		return nil
+	}
+	if s.Options.DryRun || s.Options.Mode.orMirror() != ModeMirror {
+		return nil
+	}
+	for _, action := range []FileAction{ActionSkipped, ActionKept, ActionMerged, ActionConflict} {
+		if r.Count(action) > 0 {
+			return nil
+		}
+	}
+	slog.Error("Trees differ after the session", "digest", r.TreeDigest, "peerDigest", r.PeerTreeDigest)
+	return fmt.Errorf("%w: %s here, %s on the other side", ErrTreeMismatch, r.TreeDigest, r.PeerTreeDigest)
+}
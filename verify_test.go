@@ -0,0 +1,209 @@
+package filesyncer
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Flips a byte in the first few writes of each file, like a failing SD card
+type corruptingStore struct {
+	*MemStore
+	mu       sync.Mutex
+	corrupts map[string]int
+}
+
+func (s *corruptingStore) Create(name string) (FileWriter, error) {
+	w, err := s.MemStore.Create(name)
+	if err != nil {
+		return w, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.corrupts[name] == 0 {
+		return w, nil
+	}
+	s.corrupts[name]--
+	return corruptingWriter{w}, nil
+}
+
+type corruptingWriter struct {
+	FileWriter
+}
+
+func (w corruptingWriter) Write(p []byte) (int, error) {
+	corrupt := append([]byte{}, p...)
+	corrupt[0] ^= 0xff
+	return w.FileWriter.Write(corrupt)
+}
+
+func TestSyncerVerifiesWrites(t *testing.T) {
+	tests := []struct {
+		name     string
+		corrupts int
+		retries  int
+		action   FileAction
+	}{
+		{name: "clean", corrupts: 0, retries: 0, action: ActionReceived},
+		{name: "sent again", corrupts: 2, retries: 2, action: ActionReceived},
+		{name: "gives up", corrupts: 3, retries: 2, action: ActionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mainDir := t.TempDir()
+			writeTestFiles(t, mainDir, map[string]string{"a.md": "# A\n", "b.md": "# B\n"})
+			mainFC, err := CreateFileCache(mainDir)
+			assert.NoError(t, err)
+			store := &corruptingStore{MemStore: NewMemStore(), corrupts: map[string]int{"a.md": tt.corrupts}}
+			replicaFC, err := CreateFileCacheFromStore(store, FileCacheOptions{})
+			assert.NoError(t, err)
+
+			mainConn, replicaConn := net.Pipe()
+			var replicaReport *SyncReport
+			var replicaErr error
+			done := make(chan struct{})
+			go func() {
+				replicaReport, replicaErr = (&Syncer{Replica: true, FileCache: replicaFC, Conn: replicaConn, WriteWorkers: 1}).Run()
+				close(done)
+			}()
+			mainReport, mainErr := (&Syncer{FileCache: mainFC, Conn: mainConn}).Run()
+			<-done
+
+			actions := reportActions(replicaReport)
+			assert.Equal(t, tt.action, actions["a.md"])
+			assert.Equal(t, ActionReceived, actions["b.md"])
+			for _, report := range []*SyncReport{mainReport, replicaReport} {
+				for _, fr := range report.Files {
+					if fr.Path == "a.md" && tt.action != ActionFailed {
+						assert.Equal(t, tt.retries, fr.Retries)
+					}
+				}
+			}
+			if tt.action == ActionFailed {
+				assert.ErrorIs(t, errors.Join(mainErr, replicaErr), ErrFilesFailed)
+				assert.False(t, mainReport.TreesMatch())
+				return
+			}
+			assert.NoError(t, errors.Join(mainErr, replicaErr))
+			assert.Equal(t, "# A\n", string(store.files["a.md"].data))
+			assert.True(t, mainReport.TreesMatch())
+			assert.True(t, replicaReport.TreesMatch())
+		})
+	}
+}
+
+// Copies of content the replica already has are checked too, whether made
+// when the file is checked or when main links it to content it just sent
+func TestSyncerVerifiesReusedContent(t *testing.T) {
+	mainDir := t.TempDir()
+	writeTestFiles(t, mainDir, map[string]string{"a.md": "# Same\n", "b.md": "# Same\n", "c.md": "# Same\n"})
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	store := &corruptingStore{MemStore: NewMemStore(), corrupts: map[string]int{"a.md": 1, "b.md": 1, "c.md": 1}}
+	replicaFC, err := CreateFileCacheFromStore(store, FileCacheOptions{})
+	assert.NoError(t, err)
+
+	mainReport, replicaReport := runTestSync(t, &Syncer{FileCache: mainFC}, &Syncer{Replica: true, FileCache: replicaFC, WriteWorkers: 1})
+	for _, name := range []string{"a.md", "b.md", "c.md"} {
+		assert.Equal(t, "# Same\n", string(store.files[name].data))
+	}
+	assert.Equal(t, 0, replicaReport.Count(ActionFailed))
+	assert.True(t, mainReport.TreesMatch())
+	assert.True(t, replicaReport.TreesMatch())
+}
+
+// Content that changes on main after it was hashed never matches what main
+// announced, so the replica fails it rather than caching the wrong md5
+func TestSyncerVerifyChangedOnMain(t *testing.T) {
+	mainDir, replicaDir := t.TempDir(), t.TempDir()
+	writeTestFiles(t, mainDir, map[string]string{"a.md": "# A\n"})
+	mainFC, err := CreateFileCache(mainDir)
+	assert.NoError(t, err)
+	writeTestFiles(t, mainDir, map[string]string{"a.md": "# Changed\n"})
+	replicaFC, err := CreateFileCache(replicaDir)
+	assert.NoError(t, err)
+
+	mainConn, replicaConn := net.Pipe()
+	var replicaErr error
+	done := make(chan struct{})
+	go func() {
+		_, replicaErr = (&Syncer{Replica: true, FileCache: replicaFC, Conn: replicaConn, VerifyRetries: 1}).Run()
+		close(done)
+	}()
+	mainReport, mainErr := (&Syncer{FileCache: mainFC, Conn: mainConn}).Run()
+	<-done
+	assert.ErrorIs(t, mainErr, ErrFilesFailed)
+	assert.ErrorIs(t, replicaErr, ErrFilesFailed)
+	assert.Equal(t, map[string]FileAction{"a.md": ActionFailed}, reportActions(mainReport))
+	_, cached := replicaFC.data["a.md"]
+	assert.False(t, cached)
+}
+
+func TestSyncerCheckTrees(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  SessionOptions
+		files    []FileReport
+		peer     string
+		mismatch bool
+	}{
+		{name: "same", peer: "abc"},
+		{name: "old peer", peer: ""},
+		{name: "differs", peer: "def", mismatch: true},
+		{name: "dry run", options: SessionOptions{DryRun: true}, peer: "def"},
+		{name: "additive", options: SessionOptions{Mode: ModeAdditive}, peer: "def"},
+		{name: "kept", files: []FileReport{{Path: "a.md", Action: ActionKept}}, peer: "def"},
+		{name: "sent", files: []FileReport{{Path: "a.md", Action: ActionSent}}, peer: "def", mismatch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Syncer{Options: tt.options, report: newSyncReport(false)}
+			for _, fr := range tt.files {
+				s.report.record(fr)
+			}
+			s.report.TreeDigest, s.report.PeerTreeDigest = "abc", tt.peer
+			err := s.checkTrees()
+			if tt.mismatch {
+				assert.ErrorIs(t, err, ErrTreeMismatch)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestTreeDigest(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{"a.md": "# A\n", "docs/b.md": "# B\n"})
+	fc, err := CreateFileCache(dir)
+	assert.NoError(t, err)
+	all := func(string) bool { return true }
+	digest := fc.treeDigest(all)
+	assert.Equal(t, fc.dirHash(rootDir), digest, "The digest of the whole tree is its Merkle root")
+
+	// Same files in another directory, whatever order they are found in
+	other := t.TempDir()
+	writeTestFiles(t, other, map[string]string{"docs/b.md": "# B\n", "a.md": "# A\n"})
+	otherFC, err := CreateFileCache(other)
+	assert.NoError(t, err)
+	assert.Equal(t, digest, otherFC.treeDigest(all))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(other, "a.md"), []byte("# Changed\n"), 0644))
+	otherFC, err = CreateFileCache(other)
+	assert.NoError(t, err)
+	assert.NotEqual(t, digest, otherFC.treeDigest(all))
+	assert.Equal(t, fc.treeDigest(func(name string) bool { return name == "docs/b.md" }), otherFC.treeDigest(func(name string) bool { return name == "docs/b.md" }))
+	docs := func(name string) bool { return withinPaths(name, []string{"docs"}) }
+	assert.Equal(t, fc.treeDigest(docs), otherFC.treeDigest(docs))
+	assert.Equal(t, emptyDirHash, fc.treeDigest(func(string) bool { return false }))
+
+	// Conflict copies only exist on the replica and are left out
+	otherFC.set(conflictCopyName("docs/b.md", "replica", time.Now()), fileCacheData{md5: "replica"})
+	assert.Equal(t, fc.treeDigest(docs), otherFC.treeDigest(docs))
+}